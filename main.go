@@ -2,9 +2,23 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"system/pkg"
+	"time"
+)
+
+var (
+	storePath   = flag.String("store", defaultStore(), "path of the persisted store (env VFS_STORE)")
+	scriptPath  = flag.String("f", "", "run the commands of a script file")
+	stopOnError = flag.Bool("stop-on-error", false, "stop a script at the first failing command")
+	auditPath   = flag.String("audit", defaultAudit(), "path of the audit log, empty to disable it (env VFS_AUDIT)")
+	dbPath      = flag.String("db", os.Getenv("VFS_DB"), "path of an on-disk key/value store keeping the users, folders and files (env VFS_DB)")
+	webhookWait = flag.Duration("webhook-wait", 30*time.Second, "how long to wait for the pending webhook deliveries at exit, the rest being kept as dead letters")
 )
 
 func init() {
@@ -17,23 +31,215 @@ func init() {
 	pkg.SetupSystem()
 }
 
+func defaultStore() string {
+	if path := os.Getenv("VFS_STORE"); path != "" {
+		return path
+	}
+	return "./vfs.json"
+}
+
+func defaultAudit() string {
+	if path, ok := os.LookupEnv("VFS_AUDIT"); ok {
+		return path
+	}
+	return "./vfs.audit.jsonl"
+}
+
 func main() {
-	scanner := bufio.NewScanner(os.Stdin)
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) > 0 && args[0] == "gen-man" {
+		path := "./vfs.1"
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if err := pkg.WriteManPage(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(pkg.ExitFailure)
+		}
+		fmt.Printf("Write %s successfully.\n", path)
+		return
+	}
+
+	if layout := os.Getenv("VFS_TIME_FORMAT"); layout != "" {
+		pkg.VFSystem.TimeFormat = layout
+	}
+	if zone := os.Getenv("VFS_TZ"); zone != "" {
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(pkg.ExitUsage)
+		}
+		pkg.VFSystem.Location = loc
+	}
 
+	if *dbPath != "" {
+		db, err := pkg.OpenDiskStore(*dbPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot open store because %v\n", err)
+			os.Exit(pkg.ExitFailure)
+		}
+		if err := pkg.VFSystem.Open(db); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot open store because %v\n", err)
+			os.Exit(pkg.ExitFailure)
+		}
+	} else {
+		blobs, err := pkg.OpenBlobDir(*storePath + ".blobs")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot open store because %v\n", err)
+			os.Exit(pkg.ExitFailure)
+		}
+		pkg.VFSystem.Blobs.SetSource(blobs)
+	}
+	if err := pkg.VFSystem.Load(*storePath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(pkg.ExitFailure)
+	}
+	if passphrase := os.Getenv(pkg.PassphraseEnv); passphrase != "" {
+		if err := pkg.VFSystem.UnlockAll(passphrase); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(pkg.ExitFailure)
+		}
+	}
+	if *auditPath != "" {
+		audit, err := pkg.OpenAuditLog(*auditPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot open audit log because %v\n", err)
+			os.Exit(pkg.ExitFailure)
+		}
+		pkg.VFSystem.Audit = audit
+	}
+
+	switch {
+	case *scriptPath != "":
+		leave(runScript(*scriptPath))
+	case len(args) > 0:
+		res := pkg.VFSystem.RunArgs(os.Stdout, os.Stderr, args)
+		leave(res.ExitCode())
+	default:
+		interactive()
+		leave(pkg.ExitOK)
+	}
+}
+
+// leave to wait for the pending webhook deliveries, save the store and close
+// the audit log before exiting with code.
+func leave(code int) {
+	ctx, cancel := context.WithTimeout(context.Background(), *webhookWait)
+	defer cancel()
+	if err := pkg.VFSystem.Webhooks.Shutdown(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: webhook deliveries are left pending, see `webhooks dead`.")
+	}
+	save()
+	if pkg.VFSystem.Audit != nil {
+		if err := pkg.VFSystem.Audit.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: cannot close audit log because %v\n", err)
+			os.Exit(pkg.ExitFailure)
+		}
+	}
+	os.Exit(code)
+}
+
+func save() {
+	if err := pkg.VFSystem.Save(*storePath); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: cannot save store because %v\n", err)
+		os.Exit(pkg.ExitFailure)
+	}
+}
+
+func runScript(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return pkg.ExitFailure
+	}
+	defer file.Close()
+
+	res := pkg.VFSystem.RunScript(file, path, os.Stdout, os.Stderr, *stopOnError)
+	return res.ExitCode()
+}
+
+func historyPath() string {
+	if path := os.Getenv("VFS_HISTORY"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".vfs_history")
+}
+
+// prompt marks a pending transaction.
+func prompt() string {
+	if pkg.VFSystem.InTx() {
+		return "tx$ "
+	}
+	return "$ "
+}
+
+func interactive() {
 	var greetings = `
 Welcome to Virtual File System!
 Type 'help' to get details and 'exit' to leave.
 `
 	fmt.Print(greetings)
-	fmt.Print("$ ")
+
+	if pkg.IsTerminal(os.Stdin.Fd()) {
+		interactiveTerminal()
+		return
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	fmt.Print(prompt())
 
 	for scanner.Scan() {
 		input := scanner.Text()
-		pkg.VFSystem.Execute(input)
-		fmt.Print("$ ")
+		if pkg.VFSystem.Execute(input) == pkg.Exited {
+			return
+		}
+		save()
+		fmt.Print(prompt())
 	}
 
 	if err := scanner.Err(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 	}
 }
+
+func interactiveTerminal() {
+	editor := pkg.NewLineEditor(os.Stdin, os.Stdout)
+	editor.Complete = pkg.VFSystem.Complete
+	editor.Redact = pkg.VFSystem.RedactLine
+	if path := historyPath(); path != "" {
+		if err := editor.LoadHistory(path); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot load history because %v\n", err)
+		}
+	}
+
+	for {
+		restore, err := pkg.MakeRaw(os.Stdin.Fd())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return
+		}
+		input, err := editor.ReadLine(prompt())
+		restore()
+
+		if err == pkg.ErrInterrupt {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			}
+			return
+		}
+
+		if pkg.VFSystem.Execute(input) == pkg.Exited {
+			return
+		}
+		save()
+	}
+}
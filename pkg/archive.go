@@ -0,0 +1,529 @@
+package pkg
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveFormats are the values accepted by `archive --format`.
+var ArchiveFormats = []string{"tar", "tar.gz", "zip"}
+
+// Limits on the archives read by Unarchive, against archive bombs.
+var (
+	MaxArchiveEntries = 10000
+	// MaxArchiveSize bounds the bytes read after decompression.
+	MaxArchiveSize int64 = 1 << 30
+	// MaxCompressionRatio bounds the uncompressed/compressed size of a zip entry.
+	MaxCompressionRatio int64 = 100
+)
+
+// ErrUnsafeArchive is returned for archives with unsafe paths or over the limits.
+var ErrUnsafeArchive = errors.New("unsafe archive")
+
+// PAX records carrying what a tar header cannot.
+const (
+	paxDescription = "VFS.description"
+	paxCreatedAt   = "VFS.created"
+	paxLabels      = "VFS.labels"
+)
+
+// archiveEntry is a folder (empty File) or a file of an archive. The content
+// of a file is streamed from Content when writing, and given to the visit
+// function of readArchive when reading.
+type archiveEntry struct {
+	Folder string
+	File   string
+	ManifestEntry
+	Size    int64
+	Content io.Reader
+}
+
+// archiveVisit is called by readArchive for each entry, with the content of
+// a file to read before the next entry.
+type archiveVisit func(entry archiveEntry, content io.Reader) error
+
+// ArchiveFormatOf returns the format of an archive named path from its extension, tar by default.
+func ArchiveFormatOf(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".zip"):
+		return "zip"
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return "tar.gz"
+	}
+	return "tar"
+}
+
+// Archive to write every folder of a user and their files to out, as
+// `foldername/` and `foldername/filename` entries in the given format.
+// Descriptions, creation times, tags and metadata go to PAX records in a tar
+// and to the comment of each entry in a zip.
+func (s *System) Archive(w io.Writer, ew io.Writer, username, format, out string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	if format == "" {
+		format = ArchiveFormatOf(out)
+	}
+	if !contains(ArchiveFormats, format) {
+		fmt.Fprintln(ew, ErrInvalidFlag.ToString())
+		return ErrInvalidFlag
+	}
+
+	if err := writeArchive(s.archiveEntries(user), format, out); err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot write "+out, err.Error()))
+		return ErrIO
+	}
+	fmt.Fprintf(w, "Archive %s to %s successfully.\n", username, out)
+	return Succeed
+}
+
+func (s *System) archiveEntries(user *User) []archiveEntry {
+	folders := user.GetFolders()
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+
+	var entries []archiveEntry
+	for _, folder := range folders {
+		entries = append(entries, archiveEntry{
+			Folder:        folder.Name,
+			ManifestEntry: manifestEntry(folder.Description, folder.CreatedAt, folder.Labels),
+		})
+		files := folder.GetFiles()
+		sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+		for _, file := range files {
+			entries = append(entries, archiveEntry{
+				Folder:        folder.Name,
+				File:          file.Name,
+				ManifestEntry: manifestEntry(file.Description, file.CreatedAt, file.Labels),
+				Size:          file.Size,
+				Content:       s.contentSection(file, 0, file.Size),
+			})
+		}
+	}
+	return entries
+}
+
+func (e archiveEntry) name() string {
+	if e.File == "" {
+		return e.Folder + "/"
+	}
+	return e.Folder + "/" + e.File
+}
+
+func writeArchive(entries []archiveEntry, format, out string) (err error) {
+	file, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(out)
+		}
+	}()
+
+	bw := bufio.NewWriter(file)
+	switch format {
+	case "zip":
+		err = writeZip(bw, entries)
+	case "tar.gz":
+		gw := gzip.NewWriter(bw)
+		if err = writeTar(gw, entries); err == nil {
+			err = gw.Close()
+		}
+	default:
+		err = writeTar(bw, entries)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func writeTar(w io.Writer, entries []archiveEntry) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:       entry.name(),
+			Mode:       0644,
+			ModTime:    entry.CreatedAt,
+			Format:     tar.FormatPAX,
+			PAXRecords: map[string]string{paxCreatedAt: entry.CreatedAt.Format(time.RFC3339Nano)},
+		}
+		if entry.File == "" {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		} else {
+			hdr.Typeflag, hdr.Size = tar.TypeReg, entry.Size
+		}
+		if entry.Description != "" {
+			hdr.PAXRecords[paxDescription] = entry.Description
+		}
+		if labels := entry.labels(); len(labels.Tags) > 0 || len(labels.Meta) > 0 {
+			data, err := json.Marshal(labels)
+			if err != nil {
+				return err
+			}
+			hdr.PAXRecords[paxLabels] = string(data)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if entry.Content != nil {
+			if _, err := io.Copy(tw, entry.Content); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, entries []archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		comment, err := json.Marshal(entry.ManifestEntry)
+		if err != nil {
+			return err
+		}
+		hdr := &zip.FileHeader{
+			Name:     entry.name(),
+			Method:   zip.Deflate,
+			Modified: entry.CreatedAt,
+			Comment:  string(comment),
+		}
+		if entry.File == "" {
+			hdr.Method = zip.Store
+		}
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if entry.Content != nil {
+			if _, err := io.Copy(fw, entry.Content); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+// Unarchive to create the folders and files of an archive written by Archive
+// for a user. The format is detected from the content. The whole archive is
+// checked before anything is created: entries must be `folder/` or
+// `folder/file` with valid names, must not exist yet, and the archive must
+// stay within MaxArchiveEntries, MaxArchiveSize and MaxCompressionRatio.
+// The folders are created first, with the metadata of their entry wherever
+// it is in the archive, then the files, whose contents are streamed from a
+// second read of the archive.
+func (s *System) Unarchive(w io.Writer, ew io.Writer, username, in string) (res RespondType) {
+	defer s.batchResponse(ew, &res)()
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+
+	var entries []archiveEntry
+	err := readArchive(in, func(entry archiveEntry, content io.Reader) error {
+		entries = append(entries, entry)
+		// the contents are read through, for their limits to be checked
+		_, err := io.Copy(io.Discard, content)
+		return err
+	})
+	if err == nil {
+		err = s.checkArchiveEntries(user, entries)
+	}
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot unarchive "+in, err.Error()))
+		return ErrIO
+	}
+
+	var names []string
+	folderEntries := make(map[string]*archiveEntry)
+	fileEntries := make(map[string]*archiveEntry)
+	for i := range entries {
+		entry := &entries[i]
+		if _, ok := folderEntries[entry.Folder]; !ok {
+			names = append(names, entry.Folder)
+			folderEntries[entry.Folder] = nil
+		}
+		if entry.File == "" {
+			folderEntries[entry.Folder] = entry
+		} else {
+			fileEntries[entry.name()] = entry
+		}
+	}
+
+	folders, files := 0, 0
+	for _, name := range names {
+		if user.GetFolder(name) != nil {
+			continue
+		}
+		entry := folderEntries[name]
+		desc := ""
+		if entry != nil {
+			desc = entry.Description
+		}
+		if res := s.CreateFolder(io.Discard, ew, username, name, desc); res != Succeed {
+			return res
+		}
+		if entry != nil {
+			folder := user.GetFolder(name)
+			folder.CreatedAt, folder.Labels = entry.CreatedAt, entry.labels()
+		}
+		folders++
+	}
+
+	res = Succeed
+	err = readArchive(in, func(entry archiveEntry, content io.Reader) error {
+		if entry.File == "" {
+			return nil
+		}
+		if err := s.archiveNames(&entry); err != nil {
+			return err
+		}
+		checked := fileEntries[entry.name()]
+		if checked == nil {
+			return fmt.Errorf("%s changed since it was checked", entry.name())
+		}
+		if res = s.CreateFile(io.Discard, ew, username, entry.Folder, entry.File, checked.Description); res != Succeed {
+			return errStopped
+		}
+		file := user.GetFolder(entry.Folder).GetFile(entry.File)
+		file.CreatedAt, file.Labels = checked.CreatedAt, checked.labels()
+		files++
+		_, err := s.appendContent(file, content)
+		return err
+	})
+	if res != Succeed {
+		return res
+	}
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot unarchive "+in, err.Error()))
+		return ErrIO
+	}
+
+	fmt.Fprintf(w, "Unarchive %d folders and %d files from %s successfully.\n", folders, files, in)
+	return Succeed
+}
+
+// errStopped stops the visit of an archive whose entry failed to be created.
+var errStopped = errors.New("stopped")
+
+// archiveNames to normalize the names of entry, refusing those breaking the
+// naming policies.
+func (s *System) archiveNames(entry *archiveEntry) error {
+	var err *NameError
+	if entry.Folder, err = s.validName(s.FolderPolicy, entry.Folder); err != nil {
+		return fmt.Errorf("%w: invalid name %q, it breaks the %s rule: %s", ErrUnsafeArchive, entry.name(), err.Rule, err.Reason)
+	}
+	if entry.File != "" {
+		if entry.File, err = s.validName(s.FilePolicy, entry.File); err != nil {
+			return fmt.Errorf("%w: invalid name %q, it breaks the %s rule: %s", ErrUnsafeArchive, entry.name(), err.Rule, err.Reason)
+		}
+	}
+	return nil
+}
+
+// checkArchiveEntries to refuse unsafe names and entries which already exist.
+func (s *System) checkArchiveEntries(user *User, entries []archiveEntry) error {
+	seen := make(map[string]bool)
+	for i := range entries {
+		entry := &entries[i]
+		if err := s.archiveNames(entry); err != nil {
+			return err
+		}
+		if seen[entry.name()] {
+			return fmt.Errorf("duplicate entry %q", entry.name())
+		}
+		seen[entry.name()] = true
+
+		folder := user.GetFolder(entry.Folder)
+		if entry.File == "" && folder != nil {
+			return fmt.Errorf("folder %s already exists", entry.Folder)
+		}
+		if entry.File != "" && folder != nil && folder.GetFile(entry.File) != nil {
+			return fmt.Errorf("file %s already exists", entry.name())
+		}
+	}
+	return nil
+}
+
+// splitArchiveName to split an entry name into a folder and a file, refusing
+// absolute paths, `..` and deeper paths.
+func splitArchiveName(name string) (string, string, error) {
+	clean := path.Clean(strings.TrimSuffix(name, "/"))
+	if name == "" || path.IsAbs(name) || clean != strings.TrimSuffix(name, "/") || strings.Contains(name, `\`) {
+		return "", "", fmt.Errorf("%w: path %q", ErrUnsafeArchive, name)
+	}
+	parts := strings.Split(clean, "/")
+	for _, part := range parts {
+		if part == ".." || part == "." {
+			return "", "", fmt.Errorf("%w: path %q", ErrUnsafeArchive, name)
+		}
+	}
+	switch len(parts) {
+	case 1:
+		return parts[0], "", nil
+	case 2:
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("%w: path %q is nested too deep", ErrUnsafeArchive, name)
+}
+
+// limitedReader fails once more than n bytes are read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, fmt.Errorf("%w: too much data after decompression", ErrUnsafeArchive)
+	}
+	return n, err
+}
+
+// readArchive to visit the entries of the archive in, streaming the content
+// of its files without holding them in memory.
+func readArchive(in string, visit archiveVisit) error {
+	file, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		return readZip(file, info.Size(), visit)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		return readTar(&limitedReader{gr, MaxArchiveSize}, visit)
+	}
+	return readTar(&limitedReader{br, MaxArchiveSize}, visit)
+}
+
+func readTar(r io.Reader, visit archiveVisit) error {
+	tr := tar.NewReader(r)
+	for count := 0; ; count++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if count >= MaxArchiveEntries {
+			return fmt.Errorf("%w: more than %d entries", ErrUnsafeArchive, MaxArchiveEntries)
+		}
+
+		var entry archiveEntry
+		if entry.Folder, entry.File, err = splitArchiveName(hdr.Name); err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if entry.File != "" {
+				return fmt.Errorf("%w: path %q is nested too deep", ErrUnsafeArchive, hdr.Name)
+			}
+		case tar.TypeReg:
+			if entry.File == "" {
+				return fmt.Errorf("%w: file %q outside of a folder", ErrUnsafeArchive, hdr.Name)
+			}
+		default:
+			return fmt.Errorf("%w: %q is not a regular file or directory", ErrUnsafeArchive, hdr.Name)
+		}
+		entry.Size = hdr.Size
+
+		entry.Description = hdr.PAXRecords[paxDescription]
+		entry.CreatedAt = hdr.ModTime
+		if created, err := time.Parse(time.RFC3339Nano, hdr.PAXRecords[paxCreatedAt]); err == nil {
+			entry.CreatedAt = created
+		}
+		if data := hdr.PAXRecords[paxLabels]; data != "" {
+			var labels Labels
+			if err := json.Unmarshal([]byte(data), &labels); err != nil {
+				return fmt.Errorf("invalid labels of %q: %w", hdr.Name, err)
+			}
+			entry.Tags, entry.Meta = labels.Tags, labels.Meta
+		}
+		if err := visit(entry, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func readZip(r io.ReaderAt, size int64, visit archiveVisit) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return err
+	}
+	if len(zr.File) > MaxArchiveEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrUnsafeArchive, MaxArchiveEntries)
+	}
+
+	total := int64(0)
+	for _, zf := range zr.File {
+		var entry archiveEntry
+		if entry.Folder, entry.File, err = splitArchiveName(zf.Name); err != nil {
+			return err
+		}
+		if strings.HasSuffix(zf.Name, "/") != (entry.File == "") || !(zf.Mode().IsRegular() || zf.Mode().IsDir()) {
+			return fmt.Errorf("%w: %q is not a regular file or folder", ErrUnsafeArchive, zf.Name)
+		}
+
+		// the sizes of the header may lie, so the reads are bounded as well
+		usize, csize := int64(zf.UncompressedSize64), int64(zf.CompressedSize64)
+		if usize > MaxArchiveSize-total || (usize > 1024 && usize > csize*MaxCompressionRatio) {
+			return fmt.Errorf("%w: %q is too large", ErrUnsafeArchive, zf.Name)
+		}
+		total += usize
+		entry.Size = usize
+
+		entry.CreatedAt = zf.Modified
+		if zf.Comment != "" {
+			var meta ManifestEntry
+			if err := json.Unmarshal([]byte(zf.Comment), &meta); err != nil {
+				return fmt.Errorf("invalid comment of %q: %w", zf.Name, err)
+			}
+			entry.ManifestEntry = meta
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = visit(entry, &limitedReader{rc, usize})
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build linux
+
+package pkg
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the access time of a host file, if the system keeps it.
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Atim.Sec, stat.Atim.Nsec), true
+}
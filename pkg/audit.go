@@ -0,0 +1,512 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	osuser "os/user"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry is one line of the audit log. Actor is who made the command or
+// API call, User the owner of its target.
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Op      string    `json:"op"`
+	Target  string    `json:"target,omitempty"`
+	Args    []string  `json:"args"`
+	Outcome string    `json:"outcome"`
+}
+
+// AuditFilter selects the entries returned by AuditLog.Query. Empty fields match everything.
+type AuditFilter struct {
+	Actor string
+	User  string
+	Since time.Time
+	// Op is a glob pattern such as `delete-*`.
+	Op string
+}
+
+// Match reports whether entry is selected by f.
+func (f AuditFilter) Match(entry AuditEntry) bool {
+	if f.Actor != "" && f.Actor != entry.Actor {
+		return false
+	}
+	if f.User != "" && !strings.EqualFold(f.User, entry.User) {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if f.Op != "" {
+		if ok, _ := path.Match(f.Op, entry.Op); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// AuditLog appends entries as JSON lines to a file which is rotated to
+// `path.1`, `path.2`, ... once it grows over MaxSize bytes. Entries are never
+// rewritten; the oldest backups beyond MaxBackups are removed.
+type AuditLog struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+const (
+	DefaultAuditMaxSize    = 1 << 20
+	DefaultAuditMaxBackups = 5
+)
+
+// OpenAuditLog to open the audit log at path for appending, creating it if needed.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	l := &AuditLog{
+		Path:       path,
+		MaxSize:    DefaultAuditMaxSize,
+		MaxBackups: DefaultAuditMaxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Close to close the current file of the log.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+func (l *AuditLog) backup(n int) string {
+	return fmt.Sprintf("%s.%d", l.Path, n)
+}
+
+// rotate to shift the backups by one and start a new file.
+func (l *AuditLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+
+	os.Remove(l.backup(l.MaxBackups))
+	for n := l.MaxBackups - 1; n >= 1; n-- {
+		if err := os.Rename(l.backup(n), l.backup(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if l.MaxBackups > 0 {
+		if err := os.Rename(l.Path, l.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(l.Path); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Record to append entry to the log, rotating it first when it is full.
+func (l *AuditLog) Record(entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return os.ErrClosed
+	}
+	if l.size > 0 && l.MaxSize > 0 && l.size+int64(len(data)) > l.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+// Query to read the entries matching filter, oldest first, from the backups and the current file.
+func (l *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	files := []string{}
+	for n := l.MaxBackups; n >= 1; n-- {
+		files = append(files, l.backup(n))
+	}
+	files = append(files, l.Path)
+
+	var entries []AuditEntry
+	for _, name := range files {
+		file, err := os.Open(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+		for scanner.Scan() {
+			var entry AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if filter.Match(entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// bindArgs to map the positional argument names of specs to their values in
+// args. Optional arguments are only bound when args has room for them.
+func bindArgs(specs []ArgSpec, args []string) map[string]string {
+	bound := make(map[string]string)
+	for name, i := range bindArgIndexes(specs, args) {
+		bound[name] = args[i]
+	}
+	return bound
+}
+
+// bindArgIndexes to map the positional argument names of specs to their index in args.
+func bindArgIndexes(specs []ArgSpec, args []string) map[string]int {
+	required := 0
+	for _, spec := range specs {
+		if !spec.Flag && !spec.Optional && !spec.Repeated {
+			required++
+		}
+	}
+
+	bound := make(map[string]int)
+	i := 0
+	for _, spec := range specs {
+		if spec.Flag || spec.Repeated || i >= len(args) {
+			break
+		}
+		if spec.Optional {
+			if len(args)-i <= required {
+				continue
+			}
+		} else {
+			required--
+		}
+		bound[spec.Name] = i
+		i++
+	}
+	return bound
+}
+
+// Redacted replaces the secret arguments in the audit log and the history.
+const Redacted = "***"
+
+// RedactArgs returns args with the secret arguments of cmd, and the values
+// of its secret flags, replaced by Redacted. args is returned as is when it
+// holds no secret.
+func RedactArgs(cmd Command, args []string) []string {
+	specs := cmd.ArgSpec()
+	secret := make(map[int]bool)
+	for name, i := range bindArgIndexes(specs, args) {
+		for _, spec := range specs {
+			if spec.Name == name && spec.Secret {
+				secret[i] = true
+			}
+		}
+	}
+	for _, spec := range specs {
+		if !spec.Flag || !spec.Secret || spec.Width() != 2 {
+			continue
+		}
+		flag, _, _ := strings.Cut(spec.Name, " ")
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == flag {
+				secret[i+1] = true
+			}
+		}
+	}
+	if len(secret) == 0 {
+		return args
+	}
+
+	redacted := append([]string(nil), args...)
+	for i := range secret {
+		redacted[i] = Redacted
+	}
+	return redacted
+}
+
+// RedactLine returns the command line with its secret arguments replaced by
+// Redacted, as RedactArgs does for the audit log. It is used to keep
+// passphrases and secrets out of the history.
+func (s *System) RedactLine(line string) string {
+	args := SplitArgs(line)
+	if len(args) == 0 {
+		return line
+	}
+	cmd := s.Commands.Lookup(args[0])
+	if cmd == nil {
+		return line
+	}
+	redacted := RedactArgs(cmd, args[1:])
+	if slices.Equal(redacted, args[1:]) {
+		return line
+	}
+
+	words := []string{args[0]}
+	for _, arg := range redacted {
+		words = append(words, quoteArg(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+// quoteArg to quote arg as SplitArgs reads it back, when it needs quoting.
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"\\") {
+		return arg
+	}
+	arg = strings.ReplaceAll(arg, `\`, `\\`)
+	return `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+}
+
+// auditEntry to describe a command dispatched at now for the audit log.
+func auditEntry(cmd Command, name string, args []string, res RespondType, now time.Time) AuditEntry {
+	entry := AuditEntry{
+		Time:    now,
+		Op:      name,
+		Args:    args,
+		Outcome: res.Name(),
+	}
+	if entry.Args == nil {
+		entry.Args = []string{}
+	}
+	if cmd == nil {
+		return entry
+	}
+
+	entry.Args = RedactArgs(cmd, entry.Args)
+	bound := bindArgs(cmd.ArgSpec(), args)
+	entry.User = bound["username"]
+	target := []string{}
+	for _, name := range []string{"username", "foldername", "foldername[/filename]", "filename"} {
+		if value, ok := bound[name]; ok {
+			target = append(target, value)
+		}
+	}
+	entry.Target = strings.Join(target, "/")
+	return entry
+}
+
+// processUser returns the name of the user running the process, the default Actor.
+func processUser() string {
+	if u, err := osuser.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// eventEntry to describe for the audit log a change made by a call of the
+// API rather than by a dispatched command.
+func eventEntry(event Event) AuditEntry {
+	entry := AuditEntry{
+		Time:    event.Time,
+		User:    event.UserName,
+		Op:      string(event.Type),
+		Target:  event.Path(),
+		Args:    []string{},
+		Outcome: Succeed.Name(),
+	}
+	if event.OldName != "" {
+		entry.Args = []string{event.OldName}
+	}
+	return entry
+}
+
+// audit to record a dispatched command, warning on ew if the log cannot be written.
+func (s *System) audit(ew io.Writer, cmd Command, name string, args []string, res RespondType) {
+	if s.Audit == nil {
+		return
+	}
+	entry := auditEntry(cmd, name, args, res, s.now())
+	entry.Actor = s.Actor
+	if user := s.GetUser(entry.User); user != nil && user.Encrypted() && cmd != nil {
+		entry.Args = sealedArgs(cmd, entry.Args)
+	}
+	s.record(ew, entry)
+}
+
+// nameArgs are the arguments naming a user, folder or file, which stay in
+// clear for an encrypted user like the names in the store.
+var nameArgs = map[string]bool{
+	"username":              true,
+	"foldername":            true,
+	"foldername[/filename]": true,
+	"filename":              true,
+}
+
+// sealedArgs returns args with every argument of cmd but the names replaced
+// by Redacted, so that the audit log of an encrypted user holds no more than
+// its store does in clear: no description, tag, metadata or content.
+func sealedArgs(cmd Command, args []string) []string {
+	redacted := make([]string, len(args))
+	for i := range redacted {
+		redacted[i] = Redacted
+	}
+	for name, i := range bindArgIndexes(cmd.ArgSpec(), args) {
+		if nameArgs[name] {
+			redacted[i] = args[i]
+		}
+	}
+	return redacted
+}
+
+// auditEvent to record a change which no dispatched command recorded, as
+// made by a direct call of the API.
+func (s *System) auditEvent(event Event) {
+	if s.Audit == nil || event.audited {
+		return
+	}
+	entry := eventEntry(event)
+	entry.Actor = s.Actor
+	s.record(os.Stderr, entry)
+}
+
+// record to write entry to the audit log, or to hold it back until commit in a transaction.
+func (s *System) record(ew io.Writer, entry AuditEntry) {
+	if s.tx != nil {
+		s.tx.entries = append(s.tx.entries, entry)
+		return
+	}
+	if s.Audit == nil {
+		return
+	}
+	if err := s.Audit.Record(entry); err != nil {
+		fmt.Fprintf(ew, "Warning: cannot write the audit log because %v\n", err)
+	}
+}
+
+// AuditColumns are the fields of an audit entry.
+var AuditColumns = []Column{
+	{"time", func(row any) any { return row.(AuditEntry).Time }},
+	{"actor", func(row any) any { return row.(AuditEntry).Actor }},
+	{"user", func(row any) any { return row.(AuditEntry).User }},
+	{"op", func(row any) any { return row.(AuditEntry).Op }},
+	{"target", func(row any) any { return row.(AuditEntry).Target }},
+	{"args", func(row any) any { return row.(AuditEntry).Args }},
+	{"outcome", func(row any) any { return row.(AuditEntry).Outcome }},
+}
+
+// ShowAudit to print the audit entries matching filter, oldest first.
+func (s *System) ShowAudit(w io.Writer, ew io.Writer, filter AuditFilter, opts OutputOptions) RespondType {
+	if s.Audit == nil {
+		fmt.Fprintln(ew, ErrIO.ToString("audit log is disabled"))
+		return ErrIO
+	}
+	entries, err := s.Audit.Query(filter)
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot read the audit log", err.Error()))
+		return ErrIO
+	}
+	if len(entries) == 0 && opts.Format == "" {
+		fmt.Fprintln(ew, WarnNoMatches.ToString())
+		return WarnNoMatches
+	}
+
+	if opts.Format != "" {
+		rows := make([]any, len(entries))
+		for i, entry := range entries {
+			rows[i] = entry
+		}
+		return s.writeRows(w, ew, opts, AuditColumns, rows)
+	}
+
+	for _, entry := range entries {
+		actor := entry.Actor
+		if actor == "" {
+			actor = "-"
+		}
+		line := fmt.Sprintf("%s %s %s %s %s %s", s.FormatTime(entry.Time, opts), actor, entry.Op, entry.Target, entry.Outcome, strings.Join(entry.Args, " "))
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+	}
+	return Succeed
+}
+
+// ParseAuditArgs to parse [--actor a] [--user u] [--since t] [--op pattern] and the output flags of the audit command.
+// An age given to --since is taken back from now.
+func ParseAuditArgs(args []string, now time.Time) (AuditFilter, OutputOptions, string) {
+	opts, rest, msg := ParseOutputArgs(args)
+	if msg != "" {
+		return AuditFilter{}, OutputOptions{}, msg
+	}
+
+	var filter AuditFilter
+	for i := 0; i < len(rest); i += 2 {
+		if i+1 >= len(rest) {
+			return AuditFilter{}, OutputOptions{}, ErrInvalidFlag.ToString()
+		}
+		value := rest[i+1]
+		switch rest[i] {
+		case "--actor":
+			filter.Actor = value
+		case "--user":
+			filter.User = value
+		case "--since":
+			t, ok := ParseSince(value, now)
+			if !ok {
+				return AuditFilter{}, OutputOptions{}, ErrInvalidFlag.ToString()
+			}
+			filter.Since = t
+		case "--op":
+			if _, err := path.Match(value, ""); err != nil {
+				return AuditFilter{}, OutputOptions{}, ErrInvalidFlag.ToString()
+			}
+			filter.Op = value
+		default:
+			return AuditFilter{}, OutputOptions{}, ErrInvalidFlag.ToString()
+		}
+	}
+	return filter, opts, ""
+}
@@ -0,0 +1,402 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+)
+
+// HashContent returns the address of data in a BlobStore: the hex SHA-256 of its bytes.
+func HashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// BlobSource keeps the blobs of a BlobStore by hash. A missing blob is
+// returned as nil without error. Every Store is a BlobSource.
+type BlobSource interface {
+	GetBlob(hash string) ([]byte, error)
+	PutBlob(hash string, data []byte) error
+	DeleteBlob(hash string) error
+	ListBlobs() ([]string, error)
+}
+
+type blob struct {
+	// data is held until the blob is written to the source, then read from
+	// it on demand. Without a source it is always held.
+	data []byte
+	size int64
+	refs int
+}
+
+// BlobStore holds the contents of the files by their hash, so that identical
+// contents, such as those of copied files, are stored once. Each blob counts
+// the files referring to it and is dropped when the last one releases it.
+// The data of a blob is never modified once stored. Only the references and
+// sizes are kept in memory once the blobs are written to the source.
+type BlobStore struct {
+	mu     sync.Mutex
+	blobs  map[string]*blob
+	source BlobSource
+	// added and removed hold the hashes stored and dropped since the last
+	// flush to the source.
+	added   map[string]bool
+	removed map[string]bool
+
+	// A staging store holds the changes of a transaction to base, see
+	// Stage. dropped holds the blobs of base it dropped.
+	base    *BlobStore
+	dropped map[string]bool
+}
+
+func NewBlobStore() *BlobStore {
+	return &BlobStore{
+		blobs:   make(map[string]*blob, 0),
+		added:   make(map[string]bool, 0),
+		removed: make(map[string]bool, 0),
+	}
+}
+
+// SetSource to keep the blobs in source from the next Restore on.
+func (b *BlobStore) SetSource(source BlobSource) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.source = source
+}
+
+// Stage returns a store staging changes to b, applied by Apply, as a
+// transaction does. A blob of b is copied to it when first used.
+func (b *BlobStore) Stage() *BlobStore {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	staging := NewBlobStore()
+	staging.source, staging.base = b.source, b
+	staging.dropped = make(map[string]bool, 0)
+	return staging
+}
+
+// Apply to make the changes staged by staging.
+func (b *BlobStore) Apply(staging *BlobStore) {
+	staging.mu.Lock()
+	defer staging.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for hash, existing := range staging.blobs {
+		b.blobs[hash] = existing
+	}
+	for hash := range staging.dropped {
+		delete(b.blobs, hash)
+	}
+	for hash := range staging.added {
+		b.added[hash] = true
+		delete(b.removed, hash)
+	}
+	for hash := range staging.removed {
+		b.removed[hash] = true
+		delete(b.added, hash)
+	}
+}
+
+// lookup returns the blob of hash, copied from the base of a staging store
+// when first used. The caller holds b.mu.
+func (b *BlobStore) lookup(hash string) (*blob, bool) {
+	if existing, ok := b.blobs[hash]; ok || b.base == nil || b.dropped[hash] {
+		return existing, ok
+	}
+	b.base.mu.Lock()
+	existing, ok := b.base.blobs[hash]
+	var copied blob
+	if ok {
+		copied = *existing
+	}
+	b.base.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	b.blobs[hash] = &copied
+	return &copied, true
+}
+
+// all returns every blob, with those of the base of a staging store not
+// copied yet. The caller holds b.mu.
+func (b *BlobStore) all() map[string]*blob {
+	if b.base == nil {
+		return b.blobs
+	}
+	all := make(map[string]*blob, len(b.blobs))
+	b.base.mu.Lock()
+	for hash, existing := range b.base.blobs {
+		if !b.dropped[hash] {
+			copied := *existing
+			all[hash] = &copied
+		}
+	}
+	b.base.mu.Unlock()
+	for hash, existing := range b.blobs {
+		all[hash] = existing
+	}
+	return all
+}
+
+// Put to store data with one more reference, returning its hash.
+func (b *BlobStore) Put(data []byte) string {
+	hash := HashContent(data)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if existing, ok := b.lookup(hash); ok {
+		existing.refs++
+		return hash
+	}
+	b.blobs[hash] = &blob{data: append([]byte(nil), data...), size: int64(len(data)), refs: 1}
+	delete(b.dropped, hash)
+	if b.source != nil {
+		b.added[hash] = true
+		delete(b.removed, hash)
+	}
+	return hash
+}
+
+// Ref to add a reference to the blob of hash, if any.
+func (b *BlobStore) Ref(hash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if existing, ok := b.lookup(hash); ok {
+		existing.refs++
+	}
+}
+
+// Release to drop a reference to the blob of hash, collecting the blob when
+// it was the last one.
+func (b *BlobStore) Release(hash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	existing, ok := b.lookup(hash)
+	if !ok {
+		return
+	}
+	if existing.refs--; existing.refs <= 0 {
+		b.drop(hash)
+	}
+}
+
+// drop to forget the blob of hash, for it to be deleted from the source. The
+// caller holds b.mu.
+func (b *BlobStore) drop(hash string) {
+	delete(b.blobs, hash)
+	delete(b.added, hash)
+	if b.base != nil {
+		b.dropped[hash] = true
+	}
+	if b.source != nil {
+		b.removed[hash] = true
+	}
+}
+
+// Get returns the data of the blob of hash, read from the source unless it
+// is not written there yet.
+func (b *BlobStore) Get(hash string) ([]byte, bool) {
+	b.mu.Lock()
+	existing, ok := b.lookup(hash)
+	var data []byte
+	var size int64
+	if ok {
+		data, size = existing.data, existing.size
+	}
+	source := b.source
+	b.mu.Unlock()
+
+	if !ok || data != nil || size == 0 || source == nil {
+		return data, ok
+	}
+	data, err := source.GetBlob(hash)
+	if err != nil || data == nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// Refs returns the number of references to the blob of hash.
+func (b *BlobStore) Refs(hash string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if existing, ok := b.lookup(hash); ok {
+		return existing.refs
+	}
+	return 0
+}
+
+// Stats returns the number of blobs and their total size in bytes.
+func (b *BlobStore) Stats() (int, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all := b.all()
+	var size int64
+	for _, existing := range all {
+		size += existing.size
+	}
+	return len(all), size
+}
+
+// Restore to replace the blobs by those of the source and of data, such as
+// the blobs of a snapshot, counting the references from the files of users.
+// Blobs of data missing from the source are written to it at the next flush,
+// and the blobs no file refers to are then deleted.
+func (b *BlobStore) Restore(data map[string][]byte, users map[string]*User) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stored := make(map[string]bool, 0)
+	if b.source != nil {
+		hashes, err := b.source.ListBlobs()
+		if err != nil {
+			return err
+		}
+		for _, hash := range hashes {
+			stored[hash] = true
+		}
+	}
+
+	blobs := make(map[string]*blob, len(data))
+	b.added = make(map[string]bool, 0)
+	for _, user := range users {
+		for _, folder := range user.Folders {
+			for _, file := range folder.Files {
+				for _, hash := range file.Chunks {
+					if existing, ok := blobs[hash]; ok {
+						existing.refs++
+						continue
+					}
+					if content, ok := data[hash]; ok && !stored[hash] {
+						blobs[hash] = &blob{data: content, size: int64(len(content)), refs: 1}
+						if b.source != nil {
+							b.added[hash] = true
+						}
+					} else if stored[hash] {
+						size, err := b.sourceSize(hash)
+						if err != nil {
+							return err
+						}
+						blobs[hash] = &blob{size: size, refs: 1}
+					}
+				}
+			}
+		}
+	}
+	b.blobs = blobs
+	b.removed = make(map[string]bool, 0)
+	for hash := range stored {
+		if _, ok := blobs[hash]; !ok {
+			b.removed[hash] = true
+		}
+	}
+	return nil
+}
+
+// blobSizer is implemented by the sources telling the size of a blob without reading it.
+type blobSizer interface {
+	BlobSize(hash string) (int64, error)
+}
+
+// sourceSize returns the size of the blob of hash in the source. The caller holds b.mu.
+func (b *BlobStore) sourceSize(hash string) (int64, error) {
+	if sizer, ok := b.source.(blobSizer); ok {
+		return sizer.BlobSize(hash)
+	}
+	data, err := b.source.GetBlob(hash)
+	return int64(len(data)), err
+}
+
+// Embedded reports whether the blobs are saved in the snapshot, along the
+// users, rather than kept in a BlobDir.
+func (b *BlobStore) Embedded() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.source.(*BlobDir)
+	return !ok
+}
+
+// Data returns the data of every blob by hash, reading from the source those
+// which were written there.
+func (b *BlobStore) Data() (map[string][]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all := b.all()
+	data := make(map[string][]byte, len(all))
+	for hash, existing := range all {
+		if existing.data != nil || b.source == nil {
+			data[hash] = existing.data
+			continue
+		}
+		content, err := b.source.GetBlob(hash)
+		if err != nil {
+			return nil, err
+		}
+		data[hash] = content
+	}
+	return data, nil
+}
+
+// pending returns the hashes stored and dropped since the last flush.
+func (b *BlobStore) pending() (added, removed []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return sortedKeys(b.added), sortedKeys(b.removed)
+}
+
+// write to put the blobs of hashes to the source, then hold their data no longer.
+func (b *BlobStore) write(hashes []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, hash := range hashes {
+		existing, ok := b.blobs[hash]
+		if !ok || !b.added[hash] {
+			continue
+		}
+		if err := b.source.PutBlob(hash, existing.data); err != nil {
+			return err
+		}
+		existing.data = nil
+		delete(b.added, hash)
+	}
+	return nil
+}
+
+// collect to delete the dropped blobs of hashes from the source.
+func (b *BlobStore) collect(hashes []string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, hash := range hashes {
+		if !b.removed[hash] {
+			continue
+		}
+		if err := b.source.DeleteBlob(hash); err != nil {
+			return err
+		}
+		delete(b.removed, hash)
+	}
+	return nil
+}
+
+// counts returns the number of references to every blob by hash.
+func (b *BlobStore) counts() map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	all := b.all()
+	refs := make(map[string]int, len(all))
+	for hash, existing := range all {
+		refs[hash] = existing.refs
+	}
+	return refs
+}
+
+// recount to set the references of every blob to refs, collecting the blobs
+// without any.
+func (b *BlobStore) recount(refs map[string]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for hash := range b.all() {
+		existing, _ := b.lookup(hash)
+		if existing.refs = refs[hash]; existing.refs <= 0 {
+			b.drop(hash)
+		}
+	}
+}
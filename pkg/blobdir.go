@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// BlobDir is a BlobSource keeping each blob in a file of a directory named by
+// its hash. It keeps the contents of a System saved as a snapshot, which then
+// holds the users only: contents are read on demand, and only the new and the
+// collected ones are written.
+type BlobDir struct {
+	path string
+}
+
+// OpenBlobDir to open the directory at path, creating it if needed.
+func OpenBlobDir(path string) (*BlobDir, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &BlobDir{path: path}, nil
+}
+
+// file returns the path of the blob of hash, or false when hash is not a hex
+// SHA-256, which could name a file out of the directory.
+func (d *BlobDir) file(hash string) (string, bool) {
+	if len(hash) != 64 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", false
+	}
+	return filepath.Join(d.path, hash), true
+}
+
+func (d *BlobDir) GetBlob(hash string) ([]byte, error) {
+	path, ok := d.file(hash)
+	if !ok {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// PutBlob to write the blob of hash atomically. A blob already written is
+// left as is, its data being that of its hash.
+func (d *BlobDir) PutBlob(hash string, data []byte) error {
+	path, ok := d.file(hash)
+	if !ok {
+		return fmt.Errorf("invalid blob hash %q", hash)
+	}
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(d.path, hash+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d *BlobDir) DeleteBlob(hash string) error {
+	path, ok := d.file(hash)
+	if !ok {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *BlobDir) ListBlobs() ([]string, error) {
+	entries, err := os.ReadDir(d.path)
+	if err != nil {
+		return nil, err
+	}
+	hashes := []string{}
+	for _, entry := range entries {
+		if _, ok := d.file(entry.Name()); ok && entry.Type().IsRegular() {
+			hashes = append(hashes, entry.Name())
+		}
+	}
+	return hashes, nil
+}
+
+// BlobSize returns the size of the blob of hash without reading it.
+func (d *BlobDir) BlobSize(hash string) (int64, error) {
+	path, ok := d.file(hash)
+	if !ok {
+		return 0, nil
+	}
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
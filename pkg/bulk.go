@@ -0,0 +1,222 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// BulkConfirmThreshold is the number of matches above which a bulk command
+// needs `--yes`.
+var BulkConfirmThreshold = 10
+
+// BulkOptions holds the flags of the commands taking glob patterns.
+type BulkOptions struct {
+	DryRun bool
+	Yes    bool
+}
+
+// bulkOptions returns the [--dry-run] [--yes] flags bound in args.
+func bulkOptions(args *Args) BulkOptions {
+	return BulkOptions{DryRun: args.Has("--dry-run"), Yes: args.Has("--yes")}
+}
+
+// matchNames returns the sorted names matching pattern, and false if the pattern is malformed.
+func matchNames(names []string, pattern string) ([]string, bool) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, false
+	}
+	var matches []string
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, name); ok {
+			matches = append(matches, name)
+		}
+	}
+	sort.Strings(matches)
+	return matches, true
+}
+
+// confirmBulk to print the preview of a dry run, or check that a large batch
+// was confirmed. It returns whether the batch must be applied.
+func confirmBulk(w io.Writer, ew io.Writer, verb string, targets []string, opts BulkOptions) (bool, RespondType) {
+	if opts.DryRun {
+		for _, target := range targets {
+			fmt.Fprintf(w, "Would %s %s\n", verb, target)
+		}
+		return false, Succeed
+	}
+	if len(targets) > BulkConfirmThreshold && !opts.Yes {
+		fmt.Fprintln(ew, ErrNeedConfirm.ToString(fmt.Sprint(len(targets))))
+		return false, ErrNeedConfirm
+	}
+	return true, Succeed
+}
+
+// bulkFolder to find the folder of a user which a bulk command works in.
+func (s *System) bulkFolder(ew io.Writer, username, foldername string) (*Folder, RespondType) {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return nil, ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return nil, ErrNotExists
+	}
+	return folder, Succeed
+}
+
+func (s *System) matchFiles(ew io.Writer, folder *Folder, pattern string) ([]string, RespondType) {
+	names := make([]string, 0, len(folder.Files))
+	for name := range folder.Files {
+		names = append(names, name)
+	}
+	matches, ok := matchNames(names, pattern)
+	if !ok {
+		fmt.Fprintln(ew, ErrInvalidChars.ToString(pattern))
+		return nil, ErrInvalidChars
+	}
+	if len(matches) == 0 {
+		fmt.Fprintln(ew, ErrNotExists.ToString(pattern))
+		return nil, ErrNotExists
+	}
+	return matches, Succeed
+}
+
+// DeleteFiles to delete the files of a folder matching a glob pattern
+func (s *System) DeleteFiles(w io.Writer, ew io.Writer, username, foldername, pattern string, opts BulkOptions) RespondType {
+	folder, res := s.bulkFolder(ew, username, foldername)
+	if folder == nil {
+		return res
+	}
+	matches, res := s.matchFiles(ew, folder, pattern)
+	if res != Succeed {
+		return res
+	}
+
+	targets := make([]string, len(matches))
+	for i, name := range matches {
+		targets[i] = joinPath(username, foldername, name)
+	}
+	if apply, res := confirmBulk(w, ew, "delete", targets, opts); !apply {
+		return res
+	}
+
+	for _, name := range matches {
+		s.DeleteFile(w, ew, username, foldername, name)
+	}
+	return Succeed
+}
+
+// DeleteFolders to delete the folders of a user matching a glob pattern
+func (s *System) DeleteFolders(w io.Writer, ew io.Writer, username, pattern string, opts BulkOptions) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	names := make([]string, 0, len(user.Folders))
+	for name := range user.Folders {
+		names = append(names, name)
+	}
+	matches, ok := matchNames(names, pattern)
+	if !ok {
+		fmt.Fprintln(ew, ErrInvalidChars.ToString(pattern))
+		return ErrInvalidChars
+	}
+	if len(matches) == 0 {
+		fmt.Fprintln(ew, ErrNotExists.ToString(pattern))
+		return ErrNotExists
+	}
+
+	targets := make([]string, len(matches))
+	for i, name := range matches {
+		targets[i] = joinPath(username, name)
+	}
+	if apply, res := confirmBulk(w, ew, "delete", targets, opts); !apply {
+		return res
+	}
+
+	for _, name := range matches {
+		s.DeleteFolder(w, ew, username, name)
+	}
+	return Succeed
+}
+
+// MoveFiles to move the files of a folder matching a pattern to another folder of the user
+func (s *System) MoveFiles(w io.Writer, ew io.Writer, username, foldername, pattern, dest string, opts BulkOptions) RespondType {
+	return s.transferFiles(w, ew, username, foldername, pattern, dest, opts, true)
+}
+
+// CopyFiles to copy the files of a folder matching a pattern to another folder of the user
+func (s *System) CopyFiles(w io.Writer, ew io.Writer, username, foldername, pattern, dest string, opts BulkOptions) RespondType {
+	return s.transferFiles(w, ew, username, foldername, pattern, dest, opts, false)
+}
+
+// transferFiles to move or copy files. Every match is checked against the
+// destination before any is changed, so the batch is applied entirely or not at all.
+func (s *System) transferFiles(w io.Writer, ew io.Writer, username, foldername, pattern, dest string, opts BulkOptions, move bool) RespondType {
+	folder, res := s.bulkFolder(ew, username, foldername)
+	if folder == nil {
+		return res
+	}
+	target, res := s.bulkFolder(ew, username, dest)
+	if target == nil {
+		return res
+	}
+	matches, res := s.matchFiles(ew, folder, pattern)
+	if res != Succeed {
+		return res
+	}
+	for _, name := range matches {
+		if target.GetFile(name) != nil {
+			fmt.Fprintln(ew, ErrAlreadyExists.ToString(joinPath(username, dest, name)))
+			return ErrAlreadyExists
+		}
+	}
+
+	verb := "copy"
+	if move {
+		verb = "move"
+	}
+	targets := make([]string, len(matches))
+	for i, name := range matches {
+		targets[i] = fmt.Sprintf("%s to %s", joinPath(username, foldername, name), joinPath(username, dest))
+	}
+	if apply, res := confirmBulk(w, ew, verb, targets, opts); !apply {
+		return res
+	}
+
+	for _, name := range matches {
+		file := folder.GetFile(name)
+		if move {
+			delete(folder.Files, name)
+			s.Index.RemoveFile(username, foldername, name)
+			s.emit(EventFileDeleted, username, foldername, name)
+			file.FolderName = target.Name
+			fmt.Fprintf(w, "Move %s from %s/%s to %s/%s successfully.\n", name, username, foldername, username, dest)
+		} else {
+			file = file.Copy(target.Name, s.now())
+			file.Seq = s.nextSeq()
+			for _, hash := range file.Chunks {
+				s.Blobs.Ref(hash)
+			}
+			fmt.Fprintf(w, "Copy %s from %s/%s to %s/%s successfully.\n", name, username, foldername, username, dest)
+		}
+		target.AddFile(name, file)
+		s.Index.AddFile(target, file)
+		s.emit(EventFileCreated, username, dest, name)
+	}
+	return Succeed
+}
+
+// Copy returns a copy of the file in folder foldername, created at now.
+func (file *File) Copy(foldername string, now time.Time) *File {
+	clone := file.Clone()
+	clone.FolderName = foldername
+	clone.CreatedAt, clone.ModifiedAt, clone.AccessedAt = now, now, now
+	return clone
+}
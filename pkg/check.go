@@ -0,0 +1,335 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// Categories of the problems found by Check, in report order.
+const (
+	CheckNames      = "names"
+	CheckReferences = "references"
+	CheckUniqueness = "uniqueness"
+	CheckTimestamps = "timestamps"
+	CheckContent    = "content"
+)
+
+var checkCategories = []string{CheckNames, CheckReferences, CheckUniqueness, CheckTimestamps, CheckContent}
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Category string
+	// Path is the `user`, `user/folder` or `user/folder/file` path of the
+	// record, or the hash of a blob.
+	Path     string
+	Message  string
+	Repaired bool
+	// repair fixes the problem, nil when it cannot be fixed.
+	repair func()
+}
+
+// Repairable reports whether `fsck --repair` fixes the problem.
+func (p *Problem) Repairable() bool {
+	return p.repair != nil
+}
+
+// CheckReport is the result of Check: the number of records checked and the
+// problems found, in category then path order.
+type CheckReport struct {
+	Users    int
+	Folders  int
+	Files    int
+	Blobs    int
+	Problems []*Problem
+}
+
+func (r *CheckReport) add(category, path, message string, repair func()) {
+	r.Problems = append(r.Problems, &Problem{Category: category, Path: path, Message: message, repair: repair})
+}
+
+// Unrepaired returns the number of problems left.
+func (r *CheckReport) Unrepaired() int {
+	n := 0
+	for _, problem := range r.Problems {
+		if !problem.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+// CheckColumns are the fields of a problem.
+var CheckColumns = []Column{
+	{"category", func(row any) any { return row.(*Problem).Category }},
+	{"path", func(row any) any { return row.(*Problem).Path }},
+	{"problem", func(row any) any { return row.(*Problem).Message }},
+	{"repairable", func(row any) any { return row.(*Problem).Repairable() }},
+	{"repaired", func(row any) any { return row.(*Problem).Repaired }},
+}
+
+// Check to verify that the users, folders and files of the system are
+// consistent: valid names, records matching their parents and keys, unique
+// names, set and past creation, modification and access times, and contents whose chunks are all
+// stored, match their checksum and are referenced as counted. Only the names
+// and the contents of locked users are checked.
+func (s *System) Check() *CheckReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.check()
+}
+
+func (s *System) check() *CheckReport {
+	report := &CheckReport{}
+	now := s.now()
+	refs := make(map[string]int)
+
+	for _, username := range sortedKeys(s.UserTable) {
+		user := s.GetUser(username)
+		report.Users++
+		s.checkName(report, username, s.UserPolicy, username)
+		if user.Name != username {
+			report.add(CheckReferences, username, fmt.Sprintf("user name is %s", user.Name), func() {
+				user.Name = username
+				s.emit(EventUserModified, username, "", "")
+			})
+		}
+
+		folderNames := make(map[string]string, len(user.Folders))
+		for _, foldername := range sortedKeys(user.Folders) {
+			folder := user.Folders[foldername]
+			path := joinPath(username, foldername)
+			report.Folders++
+			s.checkName(report, path, s.FolderPolicy, foldername)
+			if folder.Sealed == nil {
+				modified := func() { s.emit(EventFolderModified, username, foldername, "") }
+				checkRecordName(report, path, "folder", foldername, &folder.Name, user.Folders, folderNames, modified)
+				checkReference(report, path, "owner", username, &folder.UserName, modified)
+				checkTimes(report, path, &folder.CreatedAt, &folder.ModifiedAt, &folder.AccessedAt, now, modified)
+			}
+
+			fileNames := make(map[string]string, len(folder.Files))
+			for _, filename := range sortedKeys(folder.Files) {
+				file := folder.Files[filename]
+				path := joinPath(username, foldername, filename)
+				report.Files++
+				s.checkName(report, path, s.FilePolicy, filename)
+				modified := func() { s.emit(EventFileModified, username, foldername, filename) }
+				if file.Sealed == nil {
+					checkRecordName(report, path, "file", filename, &file.Name, folder.Files, fileNames, modified)
+					checkReference(report, path, "folder name", foldername, &file.FolderName, modified)
+					checkReference(report, path, "owner", username, &file.UserName, modified)
+					checkTimes(report, path, &file.CreatedAt, &file.ModifiedAt, &file.AccessedAt, now, modified)
+				}
+				for _, hash := range file.Chunks {
+					refs[hash]++
+				}
+				s.checkContent(report, path, user, file, modified)
+			}
+		}
+	}
+
+	counts := s.Blobs.counts()
+	report.Blobs = len(counts)
+	recount := func() { s.Blobs.recount(refs) }
+	for _, hash := range sortedKeys(counts) {
+		if counts[hash] != refs[hash] {
+			report.add(CheckContent, hash, fmt.Sprintf("blob has %d references, expected %d", counts[hash], refs[hash]), recount)
+		}
+	}
+
+	// stable, so that the problems of a category stay in path order
+	sorted := make([]*Problem, 0, len(report.Problems))
+	for _, category := range checkCategories {
+		for _, problem := range report.Problems {
+			if problem.Category == category {
+				sorted = append(sorted, problem)
+			}
+		}
+	}
+	report.Problems = sorted
+	return report
+}
+
+func (s *System) checkName(report *CheckReport, path string, policy *NamingPolicy, name string) {
+	var err *NameError
+	if policy == nil {
+		_, err = s.validName(nil, name)
+	} else {
+		err = policy.Check(name)
+	}
+	if err != nil {
+		report.add(CheckNames, path, fmt.Sprintf("name %q breaks the %s rule: %s", name, err.Rule, err.Reason), nil)
+	}
+}
+
+// checkRecordName to check that a folder or file record is named after its
+// key among siblings. names maps the other names seen so far to their key.
+func checkRecordName[V any](report *CheckReport, path, kind, key string, name *string, siblings map[string]V, names map[string]string, modified func()) {
+	if *name == key {
+		return
+	}
+	repair := func() {
+		*name = key
+		modified()
+	}
+	if _, ok := siblings[*name]; ok {
+		report.add(CheckUniqueness, path, fmt.Sprintf("%s name %s is taken by another %s", kind, *name, kind), repair)
+	} else if other, ok := names[*name]; ok {
+		report.add(CheckUniqueness, path, fmt.Sprintf("%s name %s is also the name of %s %s", kind, *name, kind, other), repair)
+	} else {
+		report.add(CheckReferences, path, fmt.Sprintf("%s name is %s, expected %s", kind, *name, key), repair)
+	}
+	names[*name] = key
+}
+
+// checkReference to check that a record refers to its parent by name.
+func checkReference(report *CheckReport, path, field, expected string, value *string, modified func()) {
+	if *value == expected {
+		return
+	}
+	report.add(CheckReferences, path, fmt.Sprintf("%s is %s, expected %s", field, *value, expected), func() {
+		*value = expected
+		modified()
+	})
+}
+
+// checkTimes to check that the creation, modification and access times of a
+// record are set and past.
+func checkTimes(report *CheckReport, path string, createdAt, modifiedAt, accessedAt *time.Time, now time.Time, modified func()) {
+	checkTime(report, path, "creation", createdAt, now, modified)
+	checkTime(report, path, "modification", modifiedAt, now, modified)
+	checkTime(report, path, "access", accessedAt, now, modified)
+}
+
+// checkTime to check that a time is set and past. It is repaired to the time
+// of the check.
+func checkTime(report *CheckReport, path, kind string, t *time.Time, now time.Time, modified func()) {
+	message := ""
+	switch {
+	case t.IsZero():
+		message = kind + " time is not set"
+	case t.After(now):
+		message = fmt.Sprintf("%s time %s is in the future", kind, t.Format(time.RFC3339))
+	default:
+		return
+	}
+	report.add(CheckTimestamps, path, message, func() {
+		*t = now
+		modified()
+	})
+}
+
+// checkContent to check that the chunks of a file are stored, match their
+// hash and, unless the user is locked, decode to the size of the content.
+func (s *System) checkContent(report *CheckReport, path string, user *User, file *File, modified func()) {
+	if len(file.Chunks) == 0 {
+		if file.Size != 0 {
+			report.add(CheckContent, path, fmt.Sprintf("size is %d without any chunk", file.Size), nil)
+		}
+		return
+	}
+	if file.ChunkSize <= 0 || int64(len(file.Chunks)) != (file.Size+file.ChunkSize-1)/file.ChunkSize {
+		report.add(CheckContent, path, fmt.Sprintf("%d chunks of %d bytes for a size of %d", len(file.Chunks), file.ChunkSize, file.Size), nil)
+		return
+	}
+
+	stored, intact := int64(0), true
+	for i, hash := range file.Chunks {
+		data, ok := s.Blobs.Get(hash)
+		if !ok {
+			report.add(CheckContent, path, fmt.Sprintf("chunk %d is missing", i), nil)
+			intact = false
+			continue
+		}
+		stored += int64(len(data))
+		if HashContent(data) != hash {
+			report.add(CheckContent, path, fmt.Sprintf("chunk %d does not match its checksum", i), nil)
+			intact = false
+			continue
+		}
+		if user.Locked() {
+			continue
+		}
+		if data, err := s.chunk(file, int64(i)); err != nil {
+			report.add(CheckContent, path, fmt.Sprintf("chunk %d cannot be read: %v", i, err), nil)
+			intact = false
+		} else if int64(len(data)) != chunkLen(file, int64(i)) {
+			report.add(CheckContent, path, fmt.Sprintf("chunk %d holds %d bytes, expected %d", i, len(data), chunkLen(file, int64(i))), nil)
+			intact = false
+		}
+	}
+	if intact && stored != file.StoredSize && file.Sealed == nil {
+		report.add(CheckContent, path, fmt.Sprintf("stored size is %d, expected %d", file.StoredSize, stored), func() {
+			file.StoredSize = stored
+			modified()
+		})
+	}
+}
+
+// repair to fix the repairable problems of report, then index the system again.
+func (s *System) repair(report *CheckReport) {
+	repaired := false
+	for _, problem := range report.Problems {
+		if problem.repair != nil {
+			problem.repair()
+			problem.Repaired = true
+			repaired = true
+		}
+	}
+	if repaired {
+		s.Index.Rebuild(s.UserTable)
+	}
+}
+
+// Fsck to print the problems found by Check by category, fixing those it can
+// when repair is set
+func (s *System) Fsck(w io.Writer, ew io.Writer, repair bool, opts OutputOptions) (res RespondType) {
+	defer s.batchResponse(ew, &res)()
+	report := s.check()
+	if repair {
+		s.repair(report)
+	}
+
+	if opts.Format != "" {
+		rows := make([]any, len(report.Problems))
+		for i, problem := range report.Problems {
+			rows[i] = problem
+		}
+		if res := s.writeRows(w, ew, opts, CheckColumns, rows); res != Succeed {
+			return res
+		}
+	} else {
+		for _, category := range checkCategories {
+			var problems []*Problem
+			for _, problem := range report.Problems {
+				if problem.Category == category {
+					problems = append(problems, problem)
+				}
+			}
+			if len(problems) == 0 {
+				fmt.Fprintf(w, "%s: ok\n", category)
+				continue
+			}
+			fmt.Fprintf(w, "%s: %d problems\n", category, len(problems))
+			for _, problem := range problems {
+				state := ""
+				switch {
+				case problem.Repaired:
+					state = " (repaired)"
+				case problem.Repairable():
+					state = " (repairable)"
+				}
+				fmt.Fprintf(w, "  %s: %s%s\n", problem.Path, problem.Message, state)
+			}
+		}
+		fmt.Fprintf(w, "Check %d users, %d folders, %d files and %d blobs: %d problems, %d repaired.\n",
+			report.Users, report.Folders, report.Files, report.Blobs, len(report.Problems), len(report.Problems)-report.Unrepaired())
+	}
+
+	if n := report.Unrepaired(); n > 0 {
+		fmt.Fprintln(ew, ErrCheckFailed.ToString(fmt.Sprint(n)))
+		return ErrCheckFailed
+	}
+	return Succeed
+}
@@ -0,0 +1,90 @@
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the System the time of its changes.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock of the wall time.
+var SystemClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// FakeClock is a Clock which only moves when told to, for reproducible times
+// in tests. Each call of Now advances it by its step afterwards.
+type FakeClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	step time.Duration
+}
+
+// NewFakeClock returns a FakeClock at start, advancing by step on each Now.
+// A zero step stops it.
+func NewFakeClock(start time.Time, step time.Duration) *FakeClock {
+	return &FakeClock{now: start, step: step}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now
+	c.now = c.now.Add(c.step)
+	return now
+}
+
+// Advance to move the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set to move the clock to t.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// clockFunc adapts a function to a Clock.
+type clockFunc func() time.Time
+
+func (f clockFunc) Now() time.Time {
+	return f()
+}
+
+// now returns the time of the clock of the system.
+func (s *System) now() time.Time {
+	if s.Clock == nil {
+		return time.Now()
+	}
+	return s.Clock.Now()
+}
+
+// nextSeq returns the sequence number of a new folder or file, which orders
+// the records created at the same time.
+func (s *System) nextSeq() uint64 {
+	s.seq++
+	return s.seq
+}
+
+// restoreSeq to continue the sequence after the records loaded.
+func (s *System) restoreSeq() {
+	for _, user := range s.UserTable {
+		for _, folder := range user.Folders {
+			s.seq = max(s.seq, folder.Seq)
+			for _, file := range folder.Files {
+				s.seq = max(s.seq, file.Seq)
+			}
+		}
+	}
+}
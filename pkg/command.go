@@ -0,0 +1,271 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Command is a command of the system which can be registered into a Registry
+// and dispatched by System.Execute.
+type Command interface {
+	Name() string
+	Summary() string
+	ArgSpec() []ArgSpec
+	Usage() string
+	MinArgs() int
+	// MaxArgs returns -1 when the number of arguments is unbounded.
+	MaxArgs() int
+	Run(s *System, w io.Writer, ew io.Writer, args []string) RespondType
+}
+
+// ArgSpec describes one argument of a command, used to check the number of
+// arguments and to render the usage line.
+type ArgSpec struct {
+	Name     string
+	Optional bool
+	// Flag marks an optional option such as `[asc|desc]`, rendered without `?`.
+	Flag bool
+	// Repeated marks an argument which can be given any number of times.
+	Repeated bool
+	// Secret marks an argument, or the value of a flag, which is redacted from
+	// the audit log and the history.
+	Secret bool
+}
+
+// Width returns the number of words taken by the argument, two for a flag
+// with a value such as `--tz zone`.
+func (a ArgSpec) Width() int {
+	if a.Flag && strings.Contains(a.Name, " ") {
+		return 2
+	}
+	return 1
+}
+
+func (a ArgSpec) ToString() string {
+	switch {
+	case a.Repeated && a.Flag:
+		return "[" + a.Name + "]..."
+	case a.Repeated:
+		return "[" + a.Name + "...]"
+	case a.Optional && !a.Flag:
+		return "[" + a.Name + "]?"
+	default:
+		return "[" + a.Name + "]"
+	}
+}
+
+// flagName returns the name of the flag bound from the argument, such as
+// `--from` for `--from hostpath`, or "" for a flag which is not bound, such
+// as the alternatives of `asc|desc`.
+func (a ArgSpec) flagName() string {
+	name, _, _ := strings.Cut(a.Name, " ")
+	if !a.Flag || !strings.HasPrefix(name, "--") || strings.Contains(name, "|") {
+		return ""
+	}
+	return name
+}
+
+// Args are the arguments of a command bound to its ArgSpec: the values of its
+// flags by name, and its other arguments in order.
+type Args struct {
+	Positional []string
+	named      map[string]string
+	flags      map[string][]string
+	usage      string
+}
+
+// BindArgs to bind args to specs. The flags of specs are taken wherever they
+// are given; the other arguments must match the positional specs in number.
+// It returns ErrInvalidFlag for a flag missing its value or an unknown one
+// left over, and ErrArgsLength for a wrong number of positional arguments.
+func BindArgs(specs []ArgSpec, args []string) (*Args, RespondType) {
+	widths := make(map[string]int)
+	var positional []ArgSpec
+	for _, spec := range specs {
+		if name := spec.flagName(); name != "" {
+			widths[name] = spec.Width()
+		} else if !spec.Flag {
+			positional = append(positional, spec)
+		}
+	}
+
+	bound := &Args{flags: make(map[string][]string)}
+	for i := 0; i < len(args); i++ {
+		width, ok := widths[args[i]]
+		switch {
+		case !ok:
+			bound.Positional = append(bound.Positional, args[i])
+		case width == 1:
+			bound.flags[args[i]] = append(bound.flags[args[i]], "")
+		case i+1 >= len(args):
+			return nil, ErrInvalidFlag
+		default:
+			bound.flags[args[i]] = append(bound.flags[args[i]], args[i+1])
+			i++
+		}
+	}
+
+	required, most := 0, 0
+	for _, spec := range positional {
+		if spec.Repeated {
+			most = -1
+		} else if most >= 0 {
+			most++
+		}
+		if !spec.Optional && !spec.Repeated {
+			required++
+		}
+	}
+	if most >= 0 && len(bound.Positional) > most {
+		for _, arg := range bound.Positional {
+			if strings.HasPrefix(arg, "--") {
+				return nil, ErrInvalidFlag
+			}
+		}
+		return nil, ErrArgsLength
+	}
+	if len(bound.Positional) < required {
+		return nil, ErrArgsLength
+	}
+	bound.named = bindArgs(positional, bound.Positional)
+	return bound, Succeed
+}
+
+// Get returns the positional argument name, or "" when it is omitted.
+func (a *Args) Get(name string) string {
+	return a.named[name]
+}
+
+// Has reports whether the positional argument or the flag name is given.
+func (a *Args) Has(name string) bool {
+	_, named := a.named[name]
+	_, flag := a.flags[name]
+	return named || flag
+}
+
+// Flag returns the value of the flag name given last, or "" when it is omitted.
+func (a *Args) Flag(name string) string {
+	values := a.flags[name]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[len(values)-1]
+}
+
+// UsageError to print the usage of the command, for arguments which bind but
+// do not go together.
+func (a *Args) UsageError(ew io.Writer) RespondType {
+	fmt.Fprintln(ew, ErrArgsLength.ToString(a.usage))
+	return ErrArgsLength
+}
+
+// CommandDef is the Command implementation used by the built-in commands.
+// A command with a Bind handler gets its arguments bound to Args, and fails
+// with its usage when they do not bind; Handler gets them as given.
+type CommandDef struct {
+	CmdName    string
+	CmdSummary string
+	Args       []ArgSpec
+	Handler    func(s *System, w io.Writer, ew io.Writer, args []string) RespondType
+	Bind       func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType
+}
+
+func (c *CommandDef) Name() string {
+	return c.CmdName
+}
+
+func (c *CommandDef) Summary() string {
+	return c.CmdSummary
+}
+
+func (c *CommandDef) ArgSpec() []ArgSpec {
+	return c.Args
+}
+
+func (c *CommandDef) Usage() string {
+	parts := []string{c.CmdName}
+	for _, a := range c.Args {
+		parts = append(parts, a.ToString())
+	}
+	return strings.Join(parts, " ")
+}
+
+func (c *CommandDef) MinArgs() int {
+	n := 0
+	for _, a := range c.Args {
+		if !a.Optional && !a.Flag {
+			n++
+		}
+	}
+	return n
+}
+
+func (c *CommandDef) MaxArgs() int {
+	n := 0
+	for _, a := range c.Args {
+		if a.Repeated {
+			return -1
+		}
+		n += a.Width()
+	}
+	return n
+}
+
+func (c *CommandDef) Run(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+	if c.Bind == nil {
+		return c.Handler(s, w, ew, args)
+	}
+	bound, res := BindArgs(c.Args, args)
+	switch res {
+	case Succeed:
+		bound.usage = c.Usage()
+		return c.Bind(s, w, ew, bound)
+	case ErrArgsLength:
+		fmt.Fprintln(ew, ErrArgsLength.ToString(c.Usage()))
+	default:
+		fmt.Fprintln(ew, res.ToString())
+	}
+	return res
+}
+
+// Registry holds the commands known to a System by name.
+type Registry struct {
+	commands map[string]Command
+	order    []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		commands: make(map[string]Command, 0),
+	}
+}
+
+// Register adds cmd to the registry, replacing any command of the same name.
+func (r *Registry) Register(cmd Command) {
+	if _, exists := r.commands[cmd.Name()]; !exists {
+		r.order = append(r.order, cmd.Name())
+	}
+	r.commands[cmd.Name()] = cmd
+}
+
+func (r *Registry) Lookup(name string) Command {
+	return r.commands[name]
+}
+
+// Commands returns the registered commands in registration order.
+func (r *Registry) Commands() []Command {
+	cmds := make([]Command, 0, len(r.order))
+	for _, name := range r.order {
+		cmds = append(cmds, r.commands[name])
+	}
+	return cmds
+}
+
+// CheckArgs reports whether args has a valid length for cmd.
+func CheckArgs(cmd Command, args []string) bool {
+	if len(args) < cmd.MinArgs() {
+		return false
+	}
+	return cmd.MaxArgs() < 0 || len(args) <= cmd.MaxArgs()
+}
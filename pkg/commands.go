@@ -0,0 +1,568 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// DefaultCommands returns a registry with the built-in commands of the system.
+func DefaultCommands() *Registry {
+	r := NewRegistry()
+
+	r.Register(&CommandDef{
+		CmdName:    "register",
+		CmdSummary: "Register a new user.",
+		Args:       []ArgSpec{{Name: "username"}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Register(w, ew, args[0])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "create-folder",
+		CmdSummary: "Create a folder for the specified user.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "description", Optional: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			desc := ""
+			if len(args) == 3 {
+				desc = args[2]
+			}
+			return s.CreateFolder(w, ew, args[0], args[1], desc)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "delete-folder",
+		CmdSummary: "Delete the specified folder for the user, or every folder matching a glob pattern such as tmp_*.",
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "foldername"}}, bulkFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			return s.DeleteFolders(w, ew, args.Get("username"), args.Get("foldername"), bulkOptions(args))
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "list-folders",
+		CmdSummary: "List all the folders for the user, only those carrying every given tag. Sort keys are name, created, modified, description, files and size, the total size of the files; --natural orders file2 before file10. A when is a date or an age such as 7d, 2w or 36h. With --limit, the cursor of the next page is printed on stderr.",
+		Args:       append([]ArgSpec{{Name: "username"}}, listFlags...),
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			opts, msg := ParseListArgs(args[1:], s.now())
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.ListFolders(w, ew, args[0], opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "rename-folder",
+		CmdSummary: "Rename the folder.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "new-folder-name"}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.RenameFolder(w, ew, args[0], args[1], args[2])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "create-file",
+		CmdSummary: "Create file from a folder for the user.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename"}, {Name: "description", Optional: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			desc := ""
+			if len(args) == 4 {
+				desc = args[3]
+			}
+			return s.CreateFile(w, ew, args[0], args[1], args[2], desc)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "delete-file",
+		CmdSummary: "Delete file from a folder for the user, or every file matching a glob pattern such as report_202?.",
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename"}}, bulkFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			return s.DeleteFiles(w, ew, args.Get("username"), args.Get("foldername"), args.Get("filename"), bulkOptions(args))
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "move-file",
+		CmdSummary: "Move a file, or every file matching a glob pattern, to another folder of the user. Nothing is moved if any name exists in the destination.",
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename"}, {Name: "dest-foldername"}}, bulkFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			return s.MoveFiles(w, ew, args.Get("username"), args.Get("foldername"), args.Get("filename"), args.Get("dest-foldername"), bulkOptions(args))
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "copy-file",
+		CmdSummary: "Copy a file, or every file matching a glob pattern, to another folder of the user. Nothing is copied if any name exists in the destination.",
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename"}, {Name: "dest-foldername"}}, bulkFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			return s.CopyFiles(w, ew, args.Get("username"), args.Get("foldername"), args.Get("filename"), args.Get("dest-foldername"), bulkOptions(args))
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "list-files",
+		CmdSummary: "List all files under the folder for the user, only those carrying every given tag. Sort keys are name, created, modified, description and size, otherwise as list-folders.",
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "foldername"}}, listFlags...),
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			opts, msg := ParseListArgs(args[2:], s.now())
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.ListFiles(w, ew, args[0], args[1], opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "tree",
+		CmdSummary: "Print the folders and files of the user as a tree, with the number of files of each folder, down to --depth levels. --show-desc adds the descriptions and --show-dates the creation and modification times. Sorted as list-folders.",
+		Args:       append([]ArgSpec{{Name: "username"}}, treeFlags...),
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			opts, msg := ParseTreeArgs(args[1:], s.now())
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.Tree(w, ew, args[0], opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "set-description",
+		CmdSummary: "Change the description of a folder, or of a file when filename is given.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename", Optional: true}, {Name: "description"}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			if len(args) == 4 {
+				return s.SetDescription(w, ew, args[0], args[1], args[2], args[3])
+			}
+			return s.SetDescription(w, ew, args[0], args[1], "", args[2])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "touch",
+		CmdSummary: "Set the modification and access times of a folder, or of a file when filename is given, to now. A missing file is created.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename", Optional: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			filename := ""
+			if len(args) == 3 {
+				filename = args[2]
+			}
+			return s.Touch(w, ew, args[0], args[1], filename)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "stat",
+		CmdSummary: "Print every field of a folder with the number and total size of its files, or of a file when filename is given.",
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename", Optional: true}}, outputFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			opts, msg := args.OutputOptions()
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.Stat(w, ew, args.Get("username"), args.Get("foldername"), args.Get("filename"), opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "write-file",
+		CmdSummary: "Replace the content of a file by the given text, or by the content of a host file with --from. Identical contents are stored once.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename"}, {Name: "content", Optional: true}, {Name: "--from hostpath", Flag: true}},
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			if args.Has("content") == args.Has("--from") {
+				return args.UsageError(ew)
+			}
+			data := []byte(args.Get("content"))
+			if args.Has("--from") {
+				var res RespondType
+				if data, res = ReadHostFile(ew, args.Flag("--from")); res != Succeed {
+					return res
+				}
+			}
+			return s.WriteFile(w, ew, args.Get("username"), args.Get("foldername"), args.Get("filename"), data)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "read-file",
+		CmdSummary: "Print the content of a file, or only the bytes of --range given as first-last, first- or -suffix like an HTTP Range.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "filename"}, {Name: "--range first-last", Flag: true}},
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			return s.ReadFile(w, ew, args.Get("username"), args.Get("foldername"), args.Get("filename"), args.Flag("--range"))
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "compress-folder",
+		CmdSummary: "Set the compression of the content of the folder's files to none, gzip, zlib or flate, and recompress the existing files. Without a compression, files are recompressed with the current one.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "none|gzip|zlib|flate", Optional: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			compression := ""
+			if len(args) == 3 {
+				compression = args[2]
+			}
+			return s.CompressFolder(w, ew, args[0], args[1], compression)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "du",
+		CmdSummary: "Print the number of files of a user, or of every user and their total, with their logical size and the physical size of their distinct contents.",
+		Args:       append([]ArgSpec{{Name: "username", Optional: true}}, outputFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			opts, msg := args.OutputOptions()
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.Du(w, ew, args.Get("username"), opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "encrypt-user",
+		CmdSummary: "Encrypt the folders, files and contents of the user with a key sealed by the passphrase, $VFS_PASSPHRASE when omitted. They are saved encrypted and loaded locked.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "passphrase", Optional: true, Secret: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			passphrase, ok := PassphraseArg(args, 1)
+			if !ok {
+				fmt.Fprintln(ew, ErrArgsLength.ToString(s.Commands.Lookup("encrypt-user").Usage()))
+				return ErrArgsLength
+			}
+			return s.EncryptUser(w, ew, args[0], passphrase)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "unlock",
+		CmdSummary: "Load the keys of an encrypted user with the passphrase, $VFS_PASSPHRASE when omitted, and decrypt their folders and files for the session.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "passphrase", Optional: true, Secret: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			passphrase, ok := PassphraseArg(args, 1)
+			if !ok {
+				fmt.Fprintln(ew, ErrArgsLength.ToString(s.Commands.Lookup("unlock").Usage()))
+				return ErrArgsLength
+			}
+			return s.Unlock(w, ew, args[0], passphrase)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "rotate-key",
+		CmdSummary: "Add a new key to an encrypted user. Folders and files are saved with it, contents when next written; compress-folder rewrites those of a folder at once.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "passphrase", Optional: true, Secret: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			passphrase, ok := PassphraseArg(args, 1)
+			if !ok {
+				fmt.Fprintln(ew, ErrArgsLength.ToString(s.Commands.Lookup("rotate-key").Usage()))
+				return ErrArgsLength
+			}
+			return s.RotateKey(w, ew, args[0], passphrase)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "fsck",
+		CmdSummary: "Check the names, parent references, uniqueness, creation, modification and access times and content checksums of every user, folder and file, and print the problems by category. --repair fixes those it can.",
+		Args:       append([]ArgSpec{{Name: "--repair", Flag: true}}, outputFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			opts, msg := args.OutputOptions()
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.Fsck(w, ew, args.Has("--repair"), opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "search",
+		CmdSummary: `Search names and descriptions of the user's folders and files. Terms are ANDed, OR separates alternatives and "quoted words" match a phrase. Best matches first.`,
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "terms", Repeated: true}}, outputFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			opts, msg := args.OutputOptions()
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.Search(w, ew, args.Get("username"), args.Positional[1:], opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "tag",
+		CmdSummary: "Add tags to a folder or file.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername[/filename]"}, {Name: "tag", Repeated: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Tag(w, ew, args[0], args[1], args[2:])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "untag",
+		CmdSummary: "Remove tags from a folder or file.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername[/filename]"}, {Name: "tag", Repeated: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Untag(w, ew, args[0], args[1], args[2:])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "set-meta",
+		CmdSummary: "Set a metadata value on a folder or file.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername[/filename]"}, {Name: "key"}, {Name: "value"}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.SetMeta(w, ew, args[0], args[1], args[2], args[3])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "get-meta",
+		CmdSummary: "Print one metadata value, or all of them when key is omitted.",
+		Args:       append([]ArgSpec{{Name: "username"}, {Name: "foldername[/filename]"}, {Name: "key", Optional: true}}, outputFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			opts, msg := args.OutputOptions()
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.GetMeta(w, ew, args.Get("username"), args.Get("foldername[/filename]"), args.Get("key"), opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "import",
+		CmdSummary: "Create a folder for each directory of hostpath and a file for each file in it; top-level files go to a folder named after hostpath. Invalid names are skipped, or replaced by _ with --sanitize. Descriptions and times come from an exported manifest when present.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "hostpath"}, {Name: "--sanitize", Flag: true}},
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			return s.Import(w, ew, args.Get("username"), args.Get("hostpath"), args.Has("--sanitize"))
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "export",
+		CmdSummary: "Write the folder to hostpath/foldername, with file times set to their modification time and the descriptions, tags and metadata in a " + ManifestName + " manifest.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "foldername"}, {Name: "hostpath"}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Export(w, ew, args[0], args[1], args[2])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "archive",
+		CmdSummary: "Write all the folders and files of the user to one archive file, with descriptions, creation times, tags and metadata. The format defaults to the extension of out.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "--format tar|tar.gz|zip", Flag: true}, {Name: "out"}},
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			return s.Archive(w, ew, args.Get("username"), args.Flag("--format"), args.Get("out"))
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "unarchive",
+		CmdSummary: "Create the folders and files of an archive written by archive. Nothing is created if an entry exists already, has an unsafe path or the archive is too large once decompressed.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "in"}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Unarchive(w, ew, args[0], args[1])
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "watch",
+		CmdSummary: "Print the changes of all users, of a user or of one folder as they happen, while the prompt keeps running. --stop ends every watch.",
+		Args:       []ArgSpec{{Name: "username", Optional: true}, {Name: "foldername", Optional: true}, {Name: "--stop", Flag: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			if len(args) == 1 && args[0] == "--stop" {
+				fmt.Fprintf(w, "Stop %d watches successfully.\n", s.StopWatches())
+				return Succeed
+			}
+			if len(args) > 2 {
+				fmt.Fprintln(ew, ErrArgsLength.ToString(s.Commands.Lookup("watch").Usage()))
+				return ErrArgsLength
+			}
+			var filter EventFilter
+			if len(args) > 0 {
+				filter.UserName = args[0]
+			}
+			if len(args) > 1 {
+				filter.FolderName = args[1]
+			}
+			return s.Watch(w, ew, filter)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "webhooks",
+		CmdSummary: "Manage the webhooks POSTing the changes of a user, or of one folder, as signed JSON. list shows them, add username url registers one (a secret is generated unless given), remove id unregisters one and dead shows the events which failed every retry.",
+		Args: append([]ArgSpec{
+			{Name: "list|add|remove|dead", Optional: true},
+			{Name: "args", Optional: true, Repeated: true},
+			{Name: "--folder foldername", Flag: true},
+			{Name: "--secret secret", Flag: true, Secret: true},
+		}, outputFlags...),
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			opts, msg := args.OutputOptions()
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			action, rest := "list", args.Positional
+			if len(rest) > 0 {
+				action, rest = rest[0], rest[1:]
+			}
+
+			switch action {
+			case "list", "dead":
+				if len(rest) > 0 {
+					return args.UsageError(ew)
+				}
+				return s.ListWebhooks(w, ew, action == "dead", opts)
+			case "remove":
+				if len(rest) != 1 {
+					return args.UsageError(ew)
+				}
+				return s.RemoveWebhook(w, ew, rest[0])
+			case "add":
+				if len(rest) != 2 {
+					return args.UsageError(ew)
+				}
+				return s.AddWebhook(w, ew, rest[0], args.Flag("--folder"), rest[1], args.Flag("--secret"))
+			}
+			fmt.Fprintln(ew, ErrInvalidFlag.ToString())
+			return ErrInvalidFlag
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "audit",
+		CmdSummary: "Show the audit log of the dispatched commands and of the changes made through the API, oldest first. --actor selects who made them, --user the owner of their target. --op takes a glob such as delete-* and --since a date or an age such as 7d.",
+		Args: append([]ArgSpec{
+			{Name: "--actor name", Flag: true},
+			{Name: "--user username", Flag: true},
+			{Name: "--since when", Flag: true},
+			{Name: "--op pattern", Flag: true},
+		}, outputFlags...),
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			filter, opts, msg := ParseAuditArgs(args, s.now())
+			if msg != "" {
+				fmt.Fprintln(ew, msg)
+				return ErrInvalidFlag
+			}
+			return s.ShowAudit(w, ew, filter, opts)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "begin",
+		CmdSummary: "Open a transaction: the following commands are staged, hidden from other readers, until commit applies all of them at once or rollback discards them.",
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Begin(w, ew)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "commit",
+		CmdSummary: "Apply the commands staged since begin.",
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Commit(w, ew)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "rollback",
+		CmdSummary: "Discard the commands staged since begin.",
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			return s.Rollback(w, ew)
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "help",
+		CmdSummary: "Show all commands, or the usage of one command.",
+		Args:       []ArgSpec{{Name: "command", Optional: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			if len(args) == 0 {
+				fmt.Fprint(w, s.Commands.HelpText())
+				return Succeed
+			}
+			cmd := s.Commands.Lookup(args[0])
+			if cmd == nil {
+				fmt.Fprintln(ew, ErrUnknownCmd.ToString())
+				return ErrUnknownCmd
+			}
+			fmt.Fprint(w, CommandHelp(cmd))
+			return Succeed
+		},
+	})
+
+	r.Register(&CommandDef{
+		CmdName:    "exit",
+		CmdSummary: "Leave the system.",
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			if s.InTx() {
+				s.Rollback(io.Discard, ew)
+				fmt.Fprintln(ew, "Warning: The open transaction is rolled back.")
+			}
+			fmt.Fprintln(w, "See you.")
+			return Exited
+		},
+	})
+
+	return r
+}
+
+var outputFlags = []ArgSpec{
+	{Name: "--output table|json|csv|tsv", Flag: true},
+	{Name: "--time-format layout", Flag: true},
+	{Name: "--tz zone", Flag: true},
+}
+
+var bulkFlags = []ArgSpec{
+	{Name: "--dry-run", Flag: true},
+	{Name: "--yes", Flag: true},
+}
+
+var listFlags = append([]ArgSpec{
+	{Name: "--sort-name|--sort-created|--sort-modified", Flag: true},
+	{Name: "--sort key[:asc|:desc],...", Flag: true},
+	{Name: "asc|desc", Flag: true},
+	{Name: "--natural", Flag: true},
+	{Name: "--ignore-case", Flag: true},
+	{Name: "--tag tag", Flag: true, Repeated: true},
+	{Name: "--created-since when", Flag: true},
+	{Name: "--created-before when", Flag: true},
+	{Name: "--limit n", Flag: true},
+	{Name: "--offset n", Flag: true},
+	{Name: "--cursor cursor", Flag: true},
+}, outputFlags...)
+
+// treeFlags are the flags of tree, then the sort and time flags of the list commands.
+var treeFlags = append(append([]ArgSpec{
+	{Name: "--depth n", Flag: true},
+	{Name: "--show-desc", Flag: true},
+	{Name: "--show-dates", Flag: true},
+}, listFlags[:5]...), outputFlags[1:]...)
+
+// CommandHelp renders the usage line and summary of cmd.
+func CommandHelp(cmd Command) string {
+	return fmt.Sprintf("       %s\n              %s\n", cmd.Usage(), cmd.Summary())
+}
+
+// HelpText renders the usage of every registered command.
+func (r *Registry) HelpText() string {
+	var sb strings.Builder
+	sb.WriteString("COMMANDS\n")
+	for i, cmd := range r.Commands() {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(CommandHelp(cmd))
+	}
+	return sb.String()
+}
@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"sort"
+	"strings"
+)
+
+// Complete returns the candidates completing the last word of line, and the
+// byte offset where that word starts. The candidates depend on the position
+// of the word: command names first, then the usernames, folder names and
+// file names expected by the command's ArgSpec, or the list flags.
+func (s *System) Complete(line string) ([]string, int) {
+	if tx := s.session.Load(); tx != nil {
+		s = tx.System
+	}
+	words := strings.Fields(line)
+	word := ""
+	if len(words) > 0 && !strings.HasSuffix(line, " ") {
+		word = words[len(words)-1]
+		words = words[:len(words)-1]
+	}
+	start := len(line) - len(word)
+
+	if len(words) == 0 {
+		var names []string
+		for _, cmd := range s.Commands.Commands() {
+			names = append(names, cmd.Name())
+		}
+		return filterPrefix(names, word), start
+	}
+
+	cmd := s.Commands.Lookup(words[0])
+	if cmd == nil {
+		return nil, start
+	}
+	args := words[1:]
+
+	var spec *ArgSpec
+	var flags []string
+	valued := make(map[string]bool)
+	for i, a := range cmd.ArgSpec() {
+		if a.Flag {
+			fields := strings.Fields(a.Name)
+			names := strings.Split(fields[0], "|")
+			flags = append(flags, names...)
+			for _, name := range names {
+				valued[name] = len(fields) > 1
+			}
+		} else if i == len(args) {
+			spec = &cmd.ArgSpec()[i]
+		}
+	}
+
+	if len(args) > 0 && valued[args[len(args)-1]] {
+		switch args[len(args)-1] {
+		case "--output":
+			return filterPrefix(OutputFormats, word), start
+		case "--format":
+			return filterPrefix(ArchiveFormats, word), start
+		case "--folder":
+			for _, arg := range args {
+				if s.GetUser(arg) != nil {
+					return filterPrefix(s.foldernames(arg), word), start
+				}
+			}
+		}
+		return nil, start
+	}
+	if spec == nil {
+		return filterPrefix(flags, word), start
+	}
+
+	switch spec.Name {
+	case "username":
+		return filterPrefix(s.usernames(), word), start
+	case "foldername", "dest-foldername":
+		return filterPrefix(s.foldernames(args[0]), word), start
+	case "filename":
+		return filterPrefix(s.filenames(args[0], args[1]), word), start
+	case "foldername[/filename]":
+		foldername, _, isFile := strings.Cut(word, "/")
+		if !isFile {
+			var paths []string
+			for _, name := range s.foldernames(args[0]) {
+				paths = append(paths, name+"/")
+			}
+			return filterPrefix(paths, word), start
+		}
+		var paths []string
+		for _, name := range s.filenames(args[0], foldername) {
+			paths = append(paths, foldername+"/"+name)
+		}
+		return filterPrefix(paths, word), start
+	case "command":
+		names, _ := s.Complete(word)
+		return names, start
+	}
+	return nil, start
+}
+
+func (s *System) usernames() []string {
+	var names []string
+	for name := range s.UserTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *System) foldernames(username string) []string {
+	user := s.GetUser(username)
+	if user == nil {
+		return nil
+	}
+	var names []string
+	for name := range user.Folders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *System) filenames(username, foldername string) []string {
+	user := s.GetUser(username)
+	if user == nil {
+		return nil
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		return nil
+	}
+	var names []string
+	for name := range folder.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func filterPrefix(words []string, prefix string) []string {
+	var matches []string
+	for _, w := range words {
+		if strings.HasPrefix(w, prefix) {
+			matches = append(matches, w)
+		}
+	}
+	return matches
+}
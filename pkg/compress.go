@@ -0,0 +1,229 @@
+package pkg
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Compressions are the policies accepted by `compress-folder`. A folder
+// without a policy stores the content of its files as is.
+var Compressions = []string{"none", "gzip", "zlib", "flate"}
+
+// codec compresses the chunks of a file.
+type codec struct {
+	writer func(w io.Writer) (io.WriteCloser, error)
+	reader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = map[string]codec{
+	"gzip": {
+		writer: func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+		reader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	"zlib": {
+		writer: func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriter(w), nil },
+		reader: func(r io.Reader) (io.ReadCloser, error) { return zlib.NewReader(r) },
+	},
+	"flate": {
+		writer: func(w io.Writer) (io.WriteCloser, error) { return flate.NewWriter(w, flate.DefaultCompression) },
+		reader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+	},
+}
+
+// compressChunk returns data as stored with the compression name.
+func compressChunk(name string, data []byte) ([]byte, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	zw, err := c.writer(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressChunk returns the size bytes of a chunk stored with the compression name.
+func decompressChunk(name string, stored []byte, size int64) ([]byte, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return stored, nil
+	}
+	zr, err := c.reader(bytes.NewReader(stored))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(zr, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// chunkCache keeps the last decompressed chunk, which sequential reads of a
+// compressed file go through many times.
+type chunkCache struct {
+	mu   sync.Mutex
+	key  string
+	data []byte
+}
+
+func (c *chunkCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.data, c.key == key && c.data != nil
+}
+
+func (c *chunkCache) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.key, c.data = key, data
+}
+
+// chunkLen returns the logical size of the chunk i of a file.
+func chunkLen(file *File, i int64) int64 {
+	return min(file.ChunkSize, file.Size-i*file.ChunkSize)
+}
+
+// chunk returns the content of the chunk i of a file, decrypted and decompressed.
+func (s *System) chunk(file *File, i int64) ([]byte, error) {
+	hash := file.Chunks[i]
+	stored, ok := s.Blobs.Get(hash)
+	if !ok {
+		return nil, fmt.Errorf("%w: chunk %d of %s", ErrMissingBlob, i, joinPath(file.UserName, file.FolderName, file.Name))
+	}
+	if file.Compression == "" && file.KeyVersion == 0 {
+		return stored, nil
+	}
+	key := file.Compression + ":" + hash
+	if data, ok := s.chunks.get(key); ok {
+		return data, nil
+	}
+	var err error
+	if file.KeyVersion > 0 {
+		stored, err = s.openChunk(file, stored)
+	}
+	data := stored
+	if err == nil {
+		data, err = decompressChunk(file.Compression, stored, chunkLen(file, i))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("chunk %d of %s: %w", i, joinPath(file.UserName, file.FolderName, file.Name), err)
+	}
+	s.chunks.put(key, data)
+	return data, nil
+}
+
+// putChunk to store data as a chunk of a file, returning its hash.
+func (s *System) putChunk(file *File, data []byte) (string, error) {
+	stored, err := compressChunk(file.Compression, data)
+	if err == nil && file.KeyVersion > 0 {
+		stored, err = s.sealChunk(file, stored)
+	}
+	if err != nil {
+		return "", err
+	}
+	file.StoredSize += int64(len(stored))
+	return s.Blobs.Put(stored), nil
+}
+
+// releaseChunk to drop the reference of a file to the chunk of hash.
+func (s *System) releaseChunk(file *File, hash string) {
+	if stored, ok := s.Blobs.Get(hash); ok {
+		file.StoredSize -= int64(len(stored))
+	}
+	s.Blobs.Release(hash)
+}
+
+// rewriteChunks to store the content of a file again with the compression
+// name, encrypted with the key of version, one chunk at a time.
+func (s *System) rewriteChunks(file *File, name string, version int) error {
+	if file.Compression == name && file.KeyVersion == version {
+		return nil
+	}
+	old := *file
+	chunks := make([]string, len(file.Chunks))
+	file.Compression, file.KeyVersion, file.StoredSize = name, version, 0
+	for i := range old.Chunks {
+		data, err := s.chunk(&old, int64(i))
+		if err == nil {
+			chunks[i], err = s.putChunk(file, data)
+		}
+		if err != nil {
+			for _, hash := range chunks[:i] {
+				s.Blobs.Release(hash)
+			}
+			file.Compression, file.KeyVersion, file.StoredSize = old.Compression, old.KeyVersion, old.StoredSize
+			return err
+		}
+	}
+	for _, hash := range old.Chunks {
+		s.Blobs.Release(hash)
+	}
+	file.Chunks = chunks
+	return nil
+}
+
+// CompressFolder to set the compression policy of a folder, none, gzip, zlib
+// or flate, and store the content of its files again with it and the current
+// key of the user
+func (s *System) CompressFolder(w io.Writer, ew io.Writer, username, foldername, compression string) (res RespondType) {
+	defer s.batchResponse(ew, &res)()
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
+	if compression == "" {
+		compression = folder.Compression
+	}
+	if compression != "" && !contains(Compressions, compression) {
+		fmt.Fprintln(ew, ErrInvalidFlag.ToString())
+		return ErrInvalidFlag
+	}
+	if compression == "none" {
+		compression = ""
+	}
+
+	if folder.Compression != compression {
+		folder.Compression = compression
+		s.emit(EventFolderModified, username, foldername, "")
+	}
+	var logical, stored int64
+	for _, name := range sortedKeys(folder.Files) {
+		file := folder.Files[name]
+		if version := s.keyVersion(file); file.Compression != compression || file.KeyVersion != version {
+			if err := s.rewriteChunks(file, compression, version); err != nil {
+				fmt.Fprintln(ew, ErrIO.ToString("cannot compress "+joinPath(username, foldername, name), err.Error()))
+				return ErrIO
+			}
+			s.emit(EventFileModified, username, foldername, name)
+		}
+		logical += file.Size
+		stored += file.StoredSize
+	}
+
+	if compression == "" {
+		compression = "none"
+	}
+	fmt.Fprintf(w, "Compress %s/%s with %s successfully, %d bytes stored in %d.\n", username, foldername, compression, logical, stored)
+	return Succeed
+}
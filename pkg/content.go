@@ -0,0 +1,366 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ChunkSize is the size of the chunks the content of a file is split into
+// when first written. Files keep the chunk size they were written with.
+var ChunkSize int64 = 1 << 20
+
+// ErrMissingBlob is returned when a chunk of a file is not in the BlobStore.
+var ErrMissingBlob = errors.New("missing content blob")
+
+// releaseContent to drop the references of a file to its chunks.
+func (s *System) releaseContent(file *File) {
+	for _, hash := range file.Chunks {
+		s.Blobs.Release(hash)
+	}
+}
+
+// setContent to replace the content of a file, releasing the previous one.
+func (s *System) setContent(file *File, data []byte) {
+	old := file.Chunks
+	file.Chunks, file.ChunkSize, file.Size, file.StoredSize = nil, ChunkSize, 0, 0
+	s.Index.UpdateContent(file.UserName, file.FolderName, file.Name)
+	s.writeAt(file, data, 0)
+	for _, hash := range old {
+		s.Blobs.Release(hash)
+	}
+}
+
+// readAt reads the content of a file like io.ReaderAt.
+func (s *System) readAt(file *File, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	n := 0
+	for n < len(p) && off < file.Size {
+		i := off / file.ChunkSize
+		data, err := s.chunk(file, i)
+		if err != nil {
+			return n, err
+		}
+		c := copy(p[n:], data[off-i*file.ChunkSize:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// writeAt writes to the content of a file like io.WriterAt. Only the chunks
+// overlapping p are rewritten; a gap left past the end is filled with zeros.
+func (s *System) writeAt(file *File, p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// the content written since a key rotation is encrypted with the new key
+	if version := s.keyVersion(file); file.KeyVersion != version {
+		if err := s.rewriteChunks(file, file.Compression, version); err != nil {
+			return 0, err
+		}
+	}
+	if file.ChunkSize == 0 {
+		file.ChunkSize = ChunkSize
+	}
+	cs := file.ChunkSize
+	end := off + int64(len(p))
+	size := max(file.Size, end)
+
+	// a write past the end also rewrites the last chunk and the gap
+	first, last := off/cs, (end-1)/cs
+	if off > file.Size {
+		first = file.Size / cs
+	}
+
+	old := file.Chunks
+	chunks := make([]string, (size+cs-1)/cs)
+	copy(chunks, old)
+	// undo to release the chunks stored before i on failure
+	undo := func(i int64) {
+		for j := first; j < i; j++ {
+			s.releaseChunk(file, chunks[j])
+		}
+	}
+	for i := first; i <= last; i++ {
+		start := i * cs
+		buf := make([]byte, min(start+cs, size)-start)
+		if i < int64(len(old)) {
+			data, err := s.chunk(file, i)
+			if err != nil {
+				undo(i)
+				return 0, err
+			}
+			copy(buf, data)
+		}
+		if lo, hi := max(off, start), min(end, start+int64(len(buf))); lo < hi {
+			copy(buf[lo-start:], p[lo-off:hi-off])
+		}
+		hash, err := s.putChunk(file, buf)
+		if err != nil {
+			undo(i)
+			return 0, err
+		}
+		chunks[i] = hash
+	}
+	for i := first; i <= last && i < int64(len(old)); i++ {
+		s.releaseChunk(file, old[i])
+	}
+
+	file.Chunks, file.Size = chunks, size
+	s.Index.UpdateContent(file.UserName, file.FolderName, file.Name)
+	return len(p), nil
+}
+
+// contentReader reads the content of a file without locking the system.
+type contentReader struct {
+	s    *System
+	file *File
+}
+
+func (r contentReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.s.readAt(r.file, p, off)
+}
+
+// appendContent to append what r reads to the content of a file, a chunk at
+// a time: a stream copied in small pieces would otherwise read, hash and store
+// its last chunk again for each of them. It returns the number of bytes
+// appended.
+func (s *System) appendContent(file *File, r io.Reader) (int64, error) {
+	if file.ChunkSize == 0 {
+		file.ChunkSize = ChunkSize
+	}
+	cs := file.ChunkSize
+	buf := make([]byte, cs)
+	total := int64(0)
+	for {
+		// up to the next chunk boundary, so that each chunk is written once
+		n, err := io.ReadFull(r, buf[:cs-file.Size%cs])
+		if n > 0 {
+			if _, err := s.writeAt(file, buf[:n], file.Size); err != nil {
+				return total, err
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// contentSection returns a reader of length bytes of the content of a file from off.
+func (s *System) contentSection(file *File, off, length int64) *io.SectionReader {
+	return io.NewSectionReader(contentReader{s, file}, off, length)
+}
+
+// Content returns the content of a file, empty if it was never written.
+func (s *System) Content(file *File) []byte {
+	data := make([]byte, file.Size)
+	n, _ := s.readAt(file, data, 0)
+	return data[:n]
+}
+
+// indexContent returns a reader of the content of a file for the Index, nil
+// when the file is missing or its user locked.
+func (s *System) indexContent(username, foldername, filename string) io.Reader {
+	user := s.GetUser(username)
+	if user == nil || user.Locked() {
+		return nil
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		return nil
+	}
+	file := folder.GetFile(filename)
+	if file == nil {
+		return nil
+	}
+	return s.contentSection(file, 0, file.Size)
+}
+
+// ParseRange to parse a byte range as in an HTTP Range header, without the
+// `bytes=` unit: `first-last`, `first-` or `-suffix`. It returns the offset
+// and length of the range within size bytes.
+func ParseRange(spec string, size int64) (int64, int64, bool) {
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok || (first == "" && last == "") {
+		return 0, 0, false
+	}
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		n = min(n, size)
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true
+}
+
+// WriteFile to replace the content of a file of a user
+func (s *System) WriteFile(w io.Writer, ew io.Writer, username, foldername, filename string, data []byte) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
+	file := folder.GetFile(filename)
+	if file == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(filename))
+		return ErrNotExists
+	}
+
+	s.setContent(file, data)
+	s.emit(EventFileModified, username, foldername, filename)
+
+	fmt.Fprintf(w, "Write %d bytes to %s/%s/%s successfully.\n", len(data), username, foldername, filename)
+	return Succeed
+}
+
+// ReadFile to print the content of a file of a user, or the byte range
+// rangeSpec of it when not empty, see ParseRange
+func (s *System) ReadFile(w io.Writer, ew io.Writer, username, foldername, filename, rangeSpec string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
+	file := folder.GetFile(filename)
+	if file == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(filename))
+		return ErrNotExists
+	}
+
+	off, length := int64(0), file.Size
+	if rangeSpec != "" {
+		var ok bool
+		if off, length, ok = ParseRange(rangeSpec, file.Size); !ok {
+			fmt.Fprintln(ew, ErrInvalidFlag.ToString())
+			return ErrInvalidFlag
+		}
+	}
+	if _, err := io.Copy(w, s.contentSection(file, off, length)); err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString(err.Error()))
+		return ErrIO
+	}
+	// the access time is saved without publishing a change
+	file.AccessedAt = s.now()
+	s.markDirty(Event{Type: EventFileModified, UserName: username, FolderName: foldername, FileName: filename})
+	return Succeed
+}
+
+// ReadHostFile to read the content given by `--from hostpath`.
+func ReadHostFile(ew io.Writer, hostpath string) ([]byte, RespondType) {
+	data, err := os.ReadFile(hostpath)
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot read "+hostpath, err.Error()))
+		return nil, ErrIO
+	}
+	return data, Succeed
+}
+
+// DiskUsage is the space taken by the files of a user. Logical counts the
+// size of every file, Physical the size of the distinct chunks they share.
+type DiskUsage struct {
+	UserName string
+	Files    int
+	Logical  int64
+	Physical int64
+}
+
+// DiskUsageColumns are the fields of a disk usage.
+var DiskUsageColumns = []Column{
+	{"user", func(row any) any { return row.(DiskUsage).UserName }},
+	{"files", func(row any) any { return row.(DiskUsage).Files }},
+	{"logical", func(row any) any { return row.(DiskUsage).Logical }},
+	{"physical", func(row any) any { return row.(DiskUsage).Physical }},
+}
+
+// usage to sum the sizes of the files of users, counting each chunk once.
+func (s *System) usage(name string, users []*User) DiskUsage {
+	usage := DiskUsage{UserName: name}
+	seen := make(map[string]bool)
+	for _, user := range users {
+		for _, folder := range user.Folders {
+			for _, file := range folder.Files {
+				usage.Files++
+				usage.Logical += file.Size
+				for _, hash := range file.Chunks {
+					if seen[hash] {
+						continue
+					}
+					seen[hash] = true
+					data, _ := s.Blobs.Get(hash)
+					usage.Physical += int64(len(data))
+				}
+			}
+		}
+	}
+	return usage
+}
+
+// Du to print the logical and physical bytes of a user, or of every user and
+// their total when username is empty
+func (s *System) Du(w io.Writer, ew io.Writer, username string, opts OutputOptions) RespondType {
+	var rows []any
+	if username != "" {
+		user := s.GetUser(username)
+		if user == nil {
+			fmt.Fprintln(ew, ErrNotExists.ToString(username))
+			return ErrNotExists
+		}
+		rows = append(rows, s.usage(username, []*User{user}))
+	} else {
+		var users []*User
+		for _, name := range sortedKeys(s.UserTable) {
+			user := s.GetUser(name)
+			users = append(users, user)
+			rows = append(rows, s.usage(name, []*User{user}))
+		}
+		rows = append(rows, s.usage("total", users))
+	}
+
+	if opts.Format != "" {
+		return s.writeRows(w, ew, opts, DiskUsageColumns, rows)
+	}
+	for _, row := range rows {
+		usage := row.(DiskUsage)
+		fmt.Fprintf(w, "%s %d files %d logical %d physical\n", usage.UserName, usage.Files, usage.Logical, usage.Physical)
+	}
+	return Succeed
+}
@@ -0,0 +1,578 @@
+package pkg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// PassphraseEnv names the environment variable holding the passphrase of the
+// encryption commands given none, and unlocking every user at startup.
+const PassphraseEnv = "VFS_PASSPHRASE"
+
+// KDFIterations is the number of PBKDF2 rounds deriving the key of a
+// passphrase, recorded in each keyring so that it can be raised later.
+var KDFIterations = 600000
+
+const (
+	keySize  = 32
+	saltSize = 16
+)
+
+var (
+	// ErrWrongPassphrase is returned when a passphrase does not open a keyring.
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	// ErrLockedUser is returned when the data of a user is needed before unlock.
+	ErrLockedUser = errors.New("user is locked")
+)
+
+// pbkdf2 derives a key of keyLen bytes from password and salt as in RFC 8018,
+// with HMAC-SHA256 as pseudorandom function.
+func pbkdf2(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	var index [4]byte
+	u := make([]byte, 0, hashLen)
+	t := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		binary.BigEndian.PutUint32(index[:], uint32(block))
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(index[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Keyring holds the data keys of an encrypted user, each sealed with AES-GCM
+// by the key derived from their passphrase. Keys are by version, from 1; the
+// last one seals new data, the others still open data not rewritten since a
+// rotation.
+type Keyring struct {
+	Salt       []byte
+	Iterations int
+	Keys       [][]byte
+}
+
+func keyAAD(username string, version int) []byte {
+	return []byte(fmt.Sprintf("key:%s#%d", username, version))
+}
+
+// wrapKeys returns a keyring of the data keys of a user under passphrase, with a new salt.
+func wrapKeys(username, passphrase string, keys [][]byte) (*Keyring, error) {
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return nil, err
+	}
+	ring := &Keyring{Salt: salt, Iterations: KDFIterations}
+	aead, err := newGCM(pbkdf2([]byte(passphrase), salt, ring.Iterations, keySize))
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		nonce, err := randomBytes(aead.NonceSize())
+		if err != nil {
+			return nil, err
+		}
+		ring.Keys = append(ring.Keys, aead.Seal(nonce, nonce, key, keyAAD(username, i+1)))
+	}
+	return ring, nil
+}
+
+// unwrap returns the data keys of the keyring, or ErrWrongPassphrase when
+// passphrase does not open it.
+func (k *Keyring) unwrap(username, passphrase string) ([][]byte, error) {
+	aead, err := newGCM(pbkdf2([]byte(passphrase), k.Salt, k.Iterations, keySize))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(k.Keys))
+	for i, sealed := range k.Keys {
+		if len(sealed) < aead.NonceSize() {
+			return nil, ErrWrongPassphrase
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if keys[i], err = aead.Open(nil, nonce, ciphertext, keyAAD(username, i+1)); err != nil {
+			return nil, ErrWrongPassphrase
+		}
+	}
+	return keys, nil
+}
+
+// sealData encrypts data with the key of version, as uvarint(version) ||
+// nonce || ciphertext. A nil nonce is drawn at random.
+func sealData(key []byte, version int, nonce, data []byte, aad string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if nonce == nil {
+		if nonce, err = randomBytes(aead.NonceSize()); err != nil {
+			return nil, err
+		}
+	}
+	out := binary.AppendUvarint(nil, uint64(version))
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, []byte(aad)), nil
+}
+
+// openData decrypts data sealed by sealData with one of keys.
+func openData(keys [][]byte, sealed []byte, aad string) ([]byte, error) {
+	version, n := binary.Uvarint(sealed)
+	if n <= 0 || version < 1 || version > uint64(len(keys)) {
+		return nil, fmt.Errorf("unknown key version %d", version)
+	}
+	aead, err := newGCM(keys[version-1])
+	if err != nil {
+		return nil, err
+	}
+	sealed = sealed[n:]
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("truncated data")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(aad))
+}
+
+// chunkNonce returns the nonce of a chunk, derived from its data so that equal
+// chunks of a user are sealed, and so stored, once.
+func chunkNonce(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("chunk nonce"))
+	mac = hmac.New(sha256.New, mac.Sum(nil))
+	mac.Write(data)
+	return mac.Sum(nil)[:12]
+}
+
+// userKeys returns the data keys of the user of a file.
+func (s *System) userKeys(file *File) ([][]byte, error) {
+	user := s.GetUser(file.UserName)
+	if user == nil || user.keys == nil {
+		return nil, fmt.Errorf("%w: %s", ErrLockedUser, file.UserName)
+	}
+	return user.keys, nil
+}
+
+// sealChunk to encrypt a stored chunk of a file with the key of its KeyVersion.
+func (s *System) sealChunk(file *File, stored []byte) ([]byte, error) {
+	keys, err := s.userKeys(file)
+	if err != nil {
+		return nil, err
+	}
+	if file.KeyVersion > len(keys) {
+		return nil, fmt.Errorf("unknown key version %d", file.KeyVersion)
+	}
+	key := keys[file.KeyVersion-1]
+	return sealData(key, file.KeyVersion, chunkNonce(key, stored), stored, "")
+}
+
+// openChunk to decrypt a stored chunk of a file.
+func (s *System) openChunk(file *File, sealed []byte) ([]byte, error) {
+	keys, err := s.userKeys(file)
+	if err != nil {
+		return nil, err
+	}
+	return openData(keys, sealed, "")
+}
+
+// keyVersion returns the key version the chunks of a file are written with:
+// the current one of its user, 0 when the user is not encrypted.
+func (s *System) keyVersion(file *File) int {
+	user := s.GetUser(file.UserName)
+	if user == nil || user.Locked() {
+		return file.KeyVersion
+	}
+	return len(user.keys)
+}
+
+func folderAAD(username, foldername string) string {
+	return "folder:" + joinPath(username, foldername)
+}
+
+func fileAAD(username, foldername, filename string) string {
+	return "file:" + joinPath(username, foldername, filename)
+}
+
+func webhookAAD(username string, id int) string {
+	return "webhook:" + username + "#" + strconv.Itoa(id)
+}
+
+// sealFolder returns the record of a folder as persisted, without its files.
+// The folder of an encrypted user keeps its name in clear, the other fields
+// are sealed with the current key of the user.
+func sealFolder(user *User, foldername string, folder *Folder) (*Folder, error) {
+	if !user.Encrypted() {
+		return folderRecord(folder), nil
+	}
+	record := &Folder{Name: folder.Name, Seq: folder.Seq, UserName: folder.UserName, Files: make(map[string]*File, 0), Sealed: folder.Sealed}
+	if record.Sealed != nil {
+		return record, nil
+	}
+	if user.keys == nil {
+		return nil, fmt.Errorf("%w: %s", ErrLockedUser, user.Name)
+	}
+	data, err := json.Marshal(folderRecord(folder))
+	if err != nil {
+		return nil, err
+	}
+	version := len(user.keys)
+	record.Sealed, err = sealData(user.keys[version-1], version, nil, data, folderAAD(user.Name, foldername))
+	return record, err
+}
+
+// sealFile returns the record of a file as persisted. The file of an encrypted
+// user keeps its name and the layout of its content in clear, so that its
+// chunks stay referenced while the user is locked.
+func sealFile(user *User, foldername string, file *File) (*File, error) {
+	if !user.Encrypted() || file.Sealed != nil {
+		return file, nil
+	}
+	if user.keys == nil {
+		return nil, fmt.Errorf("%w: %s", ErrLockedUser, user.Name)
+	}
+	data, err := json.Marshal(file)
+	if err != nil {
+		return nil, err
+	}
+	record := &File{
+		Name:        file.Name,
+		Seq:         file.Seq,
+		FolderName:  file.FolderName,
+		UserName:    file.UserName,
+		Chunks:      file.Chunks,
+		ChunkSize:   file.ChunkSize,
+		Size:        file.Size,
+		StoredSize:  file.StoredSize,
+		Compression: file.Compression,
+		KeyVersion:  file.KeyVersion,
+	}
+	version := len(user.keys)
+	record.Sealed, err = sealData(user.keys[version-1], version, nil, data, fileAAD(user.Name, foldername, file.Name))
+	return record, err
+}
+
+// openFolder returns a sealed folder of a user with its files, decrypted with keys.
+func openFolder(keys [][]byte, username, foldername string, folder *Folder) (*Folder, error) {
+	opened := folder
+	if folder.Sealed != nil {
+		data, err := openData(keys, folder.Sealed, folderAAD(username, foldername))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt %s: %w", joinPath(username, foldername), err)
+		}
+		opened = &Folder{}
+		if err := json.Unmarshal(data, opened); err != nil {
+			return nil, fmt.Errorf("cannot decrypt %s: %w", joinPath(username, foldername), err)
+		}
+	}
+	files := make(map[string]*File, len(folder.Files))
+	for name, file := range folder.Files {
+		files[name] = file
+		if file.Sealed == nil {
+			continue
+		}
+		data, err := openData(keys, file.Sealed, fileAAD(username, foldername, name))
+		if err == nil {
+			files[name] = &File{}
+			err = json.Unmarshal(data, files[name])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt %s: %w", joinPath(username, foldername, name), err)
+		}
+	}
+	if opened == folder {
+		opened = folder.Clone()
+	}
+	opened.Files = files
+	opened.fillTimes()
+	return opened, nil
+}
+
+// sealWebhook returns the record of a webhook as persisted. The secret of
+// a webhook of an encrypted user is sealed with their current key.
+func sealWebhook(user *User, hook *Webhook) (*Webhook, error) {
+	if user == nil || !user.Encrypted() || hook.Sealed != nil {
+		return hook, nil
+	}
+	if user.keys == nil {
+		return nil, fmt.Errorf("%w: %s", ErrLockedUser, user.Name)
+	}
+	record := *hook
+	record.Secret = ""
+	version := len(user.keys)
+	var err error
+	record.Sealed, err = sealData(user.keys[version-1], version, nil, []byte(hook.Secret), webhookAAD(user.Name, hook.ID))
+	return &record, err
+}
+
+// sealedWebhooks returns the webhooks as persisted, the secrets of those of
+// encrypted users sealed.
+func (s *System) sealedWebhooks() ([]*Webhook, error) {
+	hooks := s.Webhooks.Hooks()
+	for i, hook := range hooks {
+		record, err := sealWebhook(s.UserTable[hook.UserName], hook)
+		if err != nil {
+			return nil, err
+		}
+		hooks[i] = record
+	}
+	return hooks, nil
+}
+
+// sealedUsers returns the users as persisted, the folders and files of
+// encrypted users sealed.
+func (s *System) sealedUsers() (map[string]*User, error) {
+	users := make(map[string]*User, len(s.UserTable))
+	for name, user := range s.UserTable {
+		if !user.Encrypted() {
+			users[name] = user
+			continue
+		}
+		sealed := userRecord(user)
+		for foldername, folder := range user.Folders {
+			record, err := sealFolder(user, foldername, folder)
+			if err != nil {
+				return nil, err
+			}
+			for filename, file := range folder.Files {
+				if record.Files[filename], err = sealFile(user, foldername, file); err != nil {
+					return nil, err
+				}
+			}
+			sealed.Folders[foldername] = record
+		}
+		users[name] = sealed
+	}
+	return users, nil
+}
+
+// lockFree are the commands run for a locked user.
+var lockFree = map[string]bool{
+	"unlock": true,
+	"du":     true,
+	"watch":  true,
+}
+
+// lockedUser returns the user the args of cmd name when they are locked and
+// cmd needs their data.
+func (s *System) lockedUser(cmd Command, args []string) string {
+	if lockFree[cmd.Name()] {
+		return ""
+	}
+	username := bindArgs(cmd.ArgSpec(), args)["username"]
+	if user := s.GetUser(username); user != nil && user.Locked() {
+		return username
+	}
+	return ""
+}
+
+// PassphraseArg returns the passphrase given as the argument i, or else by
+// $VFS_PASSPHRASE.
+func PassphraseArg(args []string, i int) (string, bool) {
+	if len(args) > i {
+		return args[i], args[i] != ""
+	}
+	passphrase := os.Getenv(PassphraseEnv)
+	return passphrase, passphrase != ""
+}
+
+// unlock to load the keys of a user and decrypt their folders, files and
+// webhook secrets. The folders and files are then indexed again.
+func (s *System) unlock(user *User, keys [][]byte) error {
+	folders := make(map[string]*Folder, len(user.Folders))
+	for name, folder := range user.Folders {
+		opened, err := openFolder(keys, user.Name, name, folder)
+		if err != nil {
+			return err
+		}
+		folders[name] = opened
+	}
+	if err := s.Webhooks.openSecrets(user.Name, keys); err != nil {
+		return err
+	}
+	user.Folders, user.keys = folders, keys
+	for name, folder := range folders {
+		s.Index.RemoveFolder(user.Name, name)
+		s.Index.AddFolder(folder)
+		for _, file := range folder.Files {
+			s.Index.AddFile(folder, file)
+		}
+	}
+	s.version++
+	return nil
+}
+
+// UnlockAll to unlock every locked user with passphrase, as when the store is
+// opened. It fails on the first user the passphrase does not open.
+func (s *System) UnlockAll(passphrase string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range sortedKeys(s.UserTable) {
+		user := s.UserTable[name]
+		if !user.Locked() {
+			continue
+		}
+		keys, err := user.Keyring.unwrap(name, passphrase)
+		if err != nil {
+			return fmt.Errorf("cannot unlock %s: %w", name, err)
+		}
+		if err := s.unlock(user, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncryptUser to encrypt the folders and files of a user with a new data key
+// sealed by passphrase. The content is encrypted at once, the records when
+// they are persisted.
+func (s *System) EncryptUser(w io.Writer, ew io.Writer, username, passphrase string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	if user.Encrypted() {
+		fmt.Fprintln(ew, ErrAlreadyExists.ToString("key of "+username))
+		return ErrAlreadyExists
+	}
+
+	key, err := randomBytes(keySize)
+	var ring *Keyring
+	if err == nil {
+		ring, err = wrapKeys(username, passphrase, [][]byte{key})
+	}
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot encrypt "+username, err.Error()))
+		return ErrIO
+	}
+
+	// the content is encrypted with the key before the keyring is installed,
+	// and decrypted again when a file fails, so the user is left as it was
+	user.keys = [][]byte{key}
+	var done []*File
+	for _, foldername := range sortedKeys(user.Folders) {
+		folder := user.Folders[foldername]
+		for _, filename := range sortedKeys(folder.Files) {
+			file := folder.Files[filename]
+			if err := s.rewriteChunks(file, file.Compression, 1); err != nil {
+				for _, file := range done {
+					s.rewriteChunks(file, file.Compression, 0)
+				}
+				user.keys = nil
+				fmt.Fprintln(ew, ErrIO.ToString("cannot encrypt "+joinPath(username, foldername, filename), err.Error()))
+				return ErrIO
+			}
+			done = append(done, file)
+		}
+	}
+	user.Keyring = ring
+	s.emit(EventUserModified, username, "", "")
+
+	fmt.Fprintf(w, "Encrypt %s successfully.\n", username)
+	return Succeed
+}
+
+// Unlock to load the keys of an encrypted user with passphrase, for the time
+// of the session
+func (s *System) Unlock(w io.Writer, ew io.Writer, username, passphrase string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	if !user.Encrypted() {
+		fmt.Fprintln(ew, ErrNotExists.ToString("key of "+username))
+		return ErrNotExists
+	}
+
+	keys, err := user.Keyring.unwrap(username, passphrase)
+	if errors.Is(err, ErrWrongPassphrase) {
+		fmt.Fprintln(ew, ErrWrongKey.ToString(username))
+		return ErrWrongKey
+	}
+	if err == nil {
+		err = s.unlock(user, keys)
+	}
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot unlock "+username, err.Error()))
+		return ErrIO
+	}
+
+	fmt.Fprintf(w, "Unlock %s successfully.\n", username)
+	return Succeed
+}
+
+// RotateKey to add a new data key to an encrypted user. Records are sealed
+// with it as they are persisted, and the content of a file when it is next
+// written or compressed; older keys are kept to read the rest.
+func (s *System) RotateKey(w io.Writer, ew io.Writer, username, passphrase string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	if !user.Encrypted() {
+		fmt.Fprintln(ew, ErrNotExists.ToString("key of "+username))
+		return ErrNotExists
+	}
+
+	keys, err := user.Keyring.unwrap(username, passphrase)
+	if errors.Is(err, ErrWrongPassphrase) {
+		fmt.Fprintln(ew, ErrWrongKey.ToString(username))
+		return ErrWrongKey
+	}
+	var ring *Keyring
+	if err == nil {
+		var key []byte
+		if key, err = randomBytes(keySize); err == nil {
+			keys = append(keys[:len(keys):len(keys)], key)
+			ring, err = wrapKeys(username, passphrase, keys)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot rotate the key of "+username, err.Error()))
+		return ErrIO
+	}
+	user.Keyring, user.keys = ring, keys
+	s.emit(EventUserModified, username, "", "")
+
+	fmt.Fprintf(w, "Rotate the key of %s to version %d successfully.\n", username, len(keys))
+	return Succeed
+}
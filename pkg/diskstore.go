@@ -0,0 +1,459 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// DiskCompactSize is the size of dead records past which a DiskStore is
+// compacted, once they also make up half of its file.
+var DiskCompactSize int64 = 1 << 20
+
+// DiskStore is a Store kept in one append-only file. Every put or delete
+// appends a record, and an in-memory directory maps each live key to the
+// offset of its latest value, so a read takes one seek. Each record carries a
+// CRC-32; a torn record at the end of the file, left by a crash, is dropped
+// when the store is opened. Superseded records are reclaimed by compaction.
+type DiskStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+	dead int64
+	keys map[string]diskValue
+}
+
+// diskValue locates the value of a key in the file.
+type diskValue struct {
+	offset int64
+	length int
+}
+
+// diskHeaderSize is the size of a record header: the CRC-32 of the record from
+// the flag on, the CRC-32 of the flag and lengths, a tombstone flag, then the
+// lengths of the key and of the value. The lengths being checked on their own,
+// a record cut short is told apart from a damaged one.
+const diskHeaderSize = 4 + 4 + 1 + 4 + 4
+
+// ErrCorruptStore is returned when a record in the middle of a DiskStore file is damaged.
+var ErrCorruptStore = errors.New("corrupt store")
+
+// OpenDiskStore to open the store at path, creating it if needed.
+func OpenDiskStore(path string) (*DiskStore, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d := &DiskStore{path: path, file: file, keys: make(map[string]diskValue, 0)}
+	if err := d.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// load to rebuild the key directory by replaying the file, truncating it
+// after the last complete record.
+func (d *DiskStore) load() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(io.NewSectionReader(d.file, 0, info.Size()))
+	var offset int64
+	for {
+		key, value, deleted, n, err := readDiskRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || (errors.Is(err, ErrCorruptStore) && offset+int64(n) == info.Size()) {
+			// torn write at the end of the file
+			if err := d.file.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", d.path, offset, err)
+		}
+		d.apply(key, diskValue{offset + int64(n-len(value)), len(value)}, deleted, int64(n))
+		offset += int64(n)
+	}
+	d.size = offset
+	return nil
+}
+
+// apply to record in the directory a record of n bytes for key.
+func (d *DiskStore) apply(key string, value diskValue, deleted bool, n int64) {
+	if old, ok := d.keys[key]; ok {
+		d.dead += int64(diskHeaderSize + len(key) + old.length)
+	}
+	if deleted {
+		delete(d.keys, key)
+		d.dead += n
+		return
+	}
+	d.keys[key] = value
+}
+
+// readDiskRecord returns the next record of r and its size in bytes.
+func readDiskRecord(r io.Reader) (string, []byte, bool, int, error) {
+	header := make([]byte, diskHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || n == 0 {
+			return "", nil, false, 0, io.EOF
+		}
+		return "", nil, false, n, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(header[8:]) != binary.BigEndian.Uint32(header[4:8]) {
+		return "", nil, false, diskHeaderSize, ErrCorruptStore
+	}
+	keyLen := binary.BigEndian.Uint32(header[9:13])
+	valueLen := binary.BigEndian.Uint32(header[13:17])
+	body := make([]byte, int(keyLen)+int(valueLen))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return "", nil, false, diskHeaderSize, io.ErrUnexpectedEOF
+	}
+	n := diskHeaderSize + len(body)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[8:])
+	crc.Write(body)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[:4]) {
+		return "", nil, false, n, ErrCorruptStore
+	}
+	return string(body[:keyLen]), body[keyLen:], header[8] == 1, n, nil
+}
+
+func encodeDiskRecord(key string, value []byte, deleted bool) []byte {
+	buf := make([]byte, diskHeaderSize+len(key)+len(value))
+	if deleted {
+		buf[8] = 1
+	}
+	binary.BigEndian.PutUint32(buf[9:13], uint32(len(key)))
+	binary.BigEndian.PutUint32(buf[13:17], uint32(len(value)))
+	copy(buf[diskHeaderSize:], key)
+	copy(buf[diskHeaderSize+len(key):], value)
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(buf[8:diskHeaderSize]))
+	binary.BigEndian.PutUint32(buf[:4], crc32.ChecksumIEEE(buf[8:]))
+	return buf
+}
+
+// write to append a record for key. The caller holds d.mu.
+func (d *DiskStore) write(key string, value []byte, deleted bool) error {
+	if deleted {
+		if _, ok := d.keys[key]; !ok {
+			return nil
+		}
+	}
+	record := encodeDiskRecord(key, value, deleted)
+	if _, err := d.file.WriteAt(record, d.size); err != nil {
+		return err
+	}
+	offset := d.size + int64(diskHeaderSize+len(key))
+	d.size += int64(len(record))
+	d.apply(key, diskValue{offset, len(value)}, deleted, int64(len(record)))
+	if d.dead >= DiskCompactSize && d.dead*2 >= d.size {
+		return d.compact()
+	}
+	return nil
+}
+
+func (d *DiskStore) read(key string) ([]byte, bool, error) {
+	value, ok := d.keys[key]
+	if !ok {
+		return nil, false, nil
+	}
+	buf := make([]byte, value.length)
+	if _, err := d.file.ReadAt(buf, value.offset); err != nil {
+		return nil, false, err
+	}
+	return buf, true, nil
+}
+
+// compact to rewrite the live records to a new file replacing the current
+// one. The caller holds d.mu.
+func (d *DiskStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".compact*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	keys := make(map[string]diskValue, len(d.keys))
+	var size int64
+	for _, key := range sortedKeys(d.keys) {
+		value, _, err := d.read(key)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		record := encodeDiskRecord(key, value, false)
+		if _, err := w.Write(record); err != nil {
+			tmp.Close()
+			return err
+		}
+		keys[key] = diskValue{size + int64(diskHeaderSize+len(key)), len(value)}
+		size += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	d.file.Close()
+	d.file, d.keys, d.size, d.dead = tmp, keys, size, 0
+	return nil
+}
+
+// Compact to reclaim the space of superseded and deleted records.
+func (d *DiskStore) Compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.compact()
+}
+
+// Size returns the size of the file of the store in bytes.
+func (d *DiskStore) Size() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.size
+}
+
+// Sync to commit the written records to stable storage.
+func (d *DiskStore) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Sync()
+}
+
+func (d *DiskStore) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.file.Sync(); err != nil {
+		d.file.Close()
+		return err
+	}
+	return d.file.Close()
+}
+
+// Keys are made of a kind and the names of the record and its parents,
+// separated by NUL bytes so that they sort by name and no name can collide.
+const (
+	diskUser   = "u"
+	diskFolder = "f"
+	diskFile   = "x"
+	diskBlob   = "b"
+)
+
+func diskKey(kind string, names ...string) string {
+	return kind + "\x00" + strings.Join(names, "\x00")
+}
+
+func (d *DiskStore) get(key string, record any) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, ok, err := d.read(key)
+	if !ok || err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, record)
+}
+
+func (d *DiskStore) put(key string, record any) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.write(key, data, false)
+}
+
+// deletePrefix to delete key and every key starting with one of prefixes.
+func (d *DiskStore) deletePrefix(key string, prefixes ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	keys := []string{key}
+	for k := range d.keys {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := d.write(k, nil, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// list to decode the records whose key starts with prefix, in key order.
+func (d *DiskStore) list(prefix string, decode func(data []byte) error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var keys []string
+	for key := range d.keys {
+		if strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "\x00") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		data, _, err := d.read(key)
+		if err != nil {
+			return err
+		}
+		if err := decode(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DiskStore) GetUser(username string) (*User, error) {
+	var user User
+	if ok, err := d.get(diskKey(diskUser, username), &user); !ok || err != nil {
+		return nil, err
+	}
+	return userRecord(&user), nil
+}
+
+func (d *DiskStore) PutUser(user *User) error {
+	return d.put(diskKey(diskUser, user.Name), userRecord(user))
+}
+
+func (d *DiskStore) DeleteUser(username string) error {
+	return d.deletePrefix(diskKey(diskUser, username),
+		diskKey(diskFolder, username)+"\x00", diskKey(diskFile, username)+"\x00")
+}
+
+func (d *DiskStore) ListUsers() ([]*User, error) {
+	users := []*User{}
+	err := d.list(diskUser+"\x00", func(data []byte) error {
+		var user User
+		if err := json.Unmarshal(data, &user); err != nil {
+			return err
+		}
+		users = append(users, userRecord(&user))
+		return nil
+	})
+	return users, err
+}
+
+func (d *DiskStore) GetFolder(username, foldername string) (*Folder, error) {
+	var folder Folder
+	if ok, err := d.get(diskKey(diskFolder, username, foldername), &folder); !ok || err != nil {
+		return nil, err
+	}
+	return folderRecord(&folder), nil
+}
+
+func (d *DiskStore) PutFolder(username string, folder *Folder) error {
+	return d.put(diskKey(diskFolder, username, folder.Name), folderRecord(folder))
+}
+
+func (d *DiskStore) DeleteFolder(username, foldername string) error {
+	return d.deletePrefix(diskKey(diskFolder, username, foldername), diskKey(diskFile, username, foldername)+"\x00")
+}
+
+func (d *DiskStore) ListFolders(username string) ([]*Folder, error) {
+	folders := []*Folder{}
+	err := d.list(diskKey(diskFolder, username)+"\x00", func(data []byte) error {
+		var folder Folder
+		if err := json.Unmarshal(data, &folder); err != nil {
+			return err
+		}
+		folders = append(folders, folderRecord(&folder))
+		return nil
+	})
+	return folders, err
+}
+
+func (d *DiskStore) GetFile(username, foldername, filename string) (*File, error) {
+	var file File
+	if ok, err := d.get(diskKey(diskFile, username, foldername, filename), &file); !ok || err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+func (d *DiskStore) PutFile(username, foldername string, file *File) error {
+	return d.put(diskKey(diskFile, username, foldername, file.Name), file)
+}
+
+func (d *DiskStore) DeleteFile(username, foldername, filename string) error {
+	return d.deletePrefix(diskKey(diskFile, username, foldername, filename))
+}
+
+func (d *DiskStore) ListFiles(username, foldername string) ([]*File, error) {
+	files := []*File{}
+	err := d.list(diskKey(diskFile, username, foldername)+"\x00", func(data []byte) error {
+		var file File
+		if err := json.Unmarshal(data, &file); err != nil {
+			return err
+		}
+		files = append(files, &file)
+		return nil
+	})
+	return files, err
+}
+
+func (d *DiskStore) GetBlob(hash string) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, _, err := d.read(diskKey(diskBlob, hash))
+	return data, err
+}
+
+func (d *DiskStore) PutBlob(hash string, data []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.write(diskKey(diskBlob, hash), data, false)
+}
+
+func (d *DiskStore) DeleteBlob(hash string) error {
+	return d.deletePrefix(diskKey(diskBlob, hash))
+}
+
+func (d *DiskStore) ListBlobs() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	prefix := diskBlob + "\x00"
+	hashes := []string{}
+	for key := range d.keys {
+		if strings.HasPrefix(key, prefix) {
+			hashes = append(hashes, key[len(prefix):])
+		}
+	}
+	sort.Strings(hashes)
+	return hashes, nil
+}
+
+// BlobSize returns the size of the blob of hash without reading it.
+func (d *DiskStore) BlobSize(hash string) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return int64(d.keys[diskKey(diskBlob, hash)].length), nil
+}
@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"fmt"
+	"strings"
 )
 
 type RespondType int
@@ -15,14 +16,73 @@ const (
 	ErrArgsLength
 	ErrInvalidFlag
 	ErrUnknownCmd
+	ErrIO
+	ErrNeedConfirm
+	ErrTransaction
+	ErrLocked
+	ErrWrongKey
+	ErrCheckFailed
+	ErrInvalidName
+	ErrInvalidURL
 
 	WarnNoFolders
 	WarnEmptyFolder
+	WarnNoMatches
+
+	// Exited is returned by `exit`: the caller is to leave once the pending
+	// work is done, see main.
+	Exited
 )
 
-func (r RespondType) ToString(item ...string) string {
+// Name returns the identifier of r, as recorded in the audit log.
+func (r RespondType) Name() string {
 	switch r {
 	case Succeed:
+		return "Succeed"
+	case ErrAlreadyExists:
+		return "ErrAlreadyExists"
+	case ErrInvalidChars:
+		return "ErrInvalidChars"
+	case ErrNotExists:
+		return "ErrNotExists"
+	case ErrArgsLength:
+		return "ErrArgsLength"
+	case ErrInvalidFlag:
+		return "ErrInvalidFlag"
+	case ErrUnknownCmd:
+		return "ErrUnknownCmd"
+	case ErrIO:
+		return "ErrIO"
+	case ErrNeedConfirm:
+		return "ErrNeedConfirm"
+	case ErrTransaction:
+		return "ErrTransaction"
+	case ErrLocked:
+		return "ErrLocked"
+	case ErrWrongKey:
+		return "ErrWrongKey"
+	case ErrCheckFailed:
+		return "ErrCheckFailed"
+	case ErrInvalidName:
+		return "ErrInvalidName"
+	case ErrInvalidURL:
+		return "ErrInvalidURL"
+	case WarnNoFolders:
+		return "WarnNoFolders"
+	case WarnEmptyFolder:
+		return "WarnEmptyFolder"
+	case WarnNoMatches:
+		return "WarnNoMatches"
+	case Exited:
+		return "Exited"
+	default:
+		return "Undefined"
+	}
+}
+
+func (r RespondType) ToString(item ...string) string {
+	switch r {
+	case Succeed, Exited:
 		return ""
 	case ErrAlreadyExists:
 		return fmt.Sprintf("Error: The %v has already existed.", item)
@@ -31,16 +91,63 @@ func (r RespondType) ToString(item ...string) string {
 	case ErrNotExists:
 		return fmt.Sprintf("Error: The %v doesn't exist.", item)
 	case ErrArgsLength:
+		if len(item) > 0 {
+			return fmt.Sprintf("Error: Invalid length. Usage: %v", item[0])
+		}
 		return "Error: Invalid length. Check `help` to get info!"
 	case ErrInvalidFlag:
-		return "Error: Invalid flags. They can be [--sort-name|--sort-created] [asc|desc]."
+		return "Error: Invalid flags. Check `help` to get the flags of the command."
 	case ErrUnknownCmd:
 		return "Unrecognized command."
+	case ErrIO:
+		return fmt.Sprintf("Error: %v", strings.Join(item, ": "))
+	case ErrNeedConfirm:
+		return fmt.Sprintf("Error: %v entries match. Check them with --dry-run and add --yes to proceed.", strings.Join(item, ""))
+	case ErrTransaction:
+		return fmt.Sprintf("Error: %v", strings.Join(item, ": "))
+	case ErrLocked:
+		return fmt.Sprintf("Error: The %v is locked. Check `unlock` to load its keys.", item)
+	case ErrWrongKey:
+		return fmt.Sprintf("Error: The passphrase of %v is wrong.", item)
+	case ErrCheckFailed:
+		return fmt.Sprintf("Error: %v problems are left. Check `fsck --repair` to fix those it can.", strings.Join(item, ""))
+	case ErrInvalidName:
+		return fmt.Sprintf("Error: The name %v.", strings.Join(item, ""))
+	case ErrInvalidURL:
+		return fmt.Sprintf("Error: The url %v is invalid, an http or https url is expected.", item)
 	case WarnNoFolders:
 		return fmt.Sprintf("Warning: The %v doesn't have any folders", item)
 	case WarnEmptyFolder:
 		return "Warning: The folder is empty."
+	case WarnNoMatches:
+		return "Warning: No matches found."
 	default:
 		return "Undefined"
 	}
 }
+
+// Process exit codes of the vfs program.
+const (
+	ExitOK       = 0
+	ExitFailure  = 1
+	ExitUsage    = 2
+	ExitNotFound = 3
+	ExitConflict = 4
+)
+
+// ExitCode maps a response to the exit code of the vfs program. Warnings are
+// not failures.
+func (r RespondType) ExitCode() int {
+	switch r {
+	case Succeed, WarnNoFolders, WarnEmptyFolder, WarnNoMatches, Exited:
+		return ExitOK
+	case ErrArgsLength, ErrInvalidFlag, ErrUnknownCmd, ErrInvalidChars, ErrInvalidName, ErrInvalidURL, ErrNeedConfirm:
+		return ExitUsage
+	case ErrNotExists:
+		return ExitNotFound
+	case ErrAlreadyExists, ErrTransaction:
+		return ExitConflict
+	default:
+		return ExitFailure
+	}
+}
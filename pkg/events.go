@@ -0,0 +1,284 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventUserRegistered EventType = "user.registered"
+	EventUserModified   EventType = "user.modified"
+	EventFolderCreated  EventType = "folder.created"
+	EventFolderRenamed  EventType = "folder.renamed"
+	EventFolderDeleted  EventType = "folder.deleted"
+	EventFolderModified EventType = "folder.modified"
+	EventFileCreated    EventType = "file.created"
+	EventFileDeleted    EventType = "file.deleted"
+	EventFileModified   EventType = "file.modified"
+)
+
+// Event describes one change of the system.
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	UserName   string    `json:"user"`
+	FolderName string    `json:"folder,omitempty"`
+	FileName   string    `json:"file,omitempty"`
+	// OldName is the previous name of a renamed folder.
+	OldName string `json:"old_name,omitempty"`
+	// Dropped is the number of events the subscriber lost so far because its
+	// buffer was full, see EventBufferSize.
+	Dropped int `json:"-"`
+	// audited is set on the events of a dispatched command, which the audit
+	// log records as the command.
+	audited bool
+}
+
+// Path returns `user`, `user/folder` or `user/folder/file`.
+func (e Event) Path() string {
+	return joinPath(e.UserName, e.FolderName, e.FileName)
+}
+
+func joinPath(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "/")
+}
+
+func (e Event) ToString() string {
+	if e.Type == EventFolderRenamed {
+		return fmt.Sprintf("%s %s (from %s)", e.Type, e.Path(), e.OldName)
+	}
+	return fmt.Sprintf("%s %s", e.Type, e.Path())
+}
+
+// EventFilter selects the events of a subscription. Empty fields match
+// everything; names are compared case-insensitively.
+type EventFilter struct {
+	Types      []EventType
+	UserName   string
+	FolderName string
+}
+
+// Match reports whether event is selected by f. A renamed folder matches by
+// its old and its new name.
+func (f EventFilter) Match(event Event) bool {
+	if len(f.Types) > 0 {
+		found := false
+		for _, t := range f.Types {
+			found = found || t == event.Type
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.UserName != "" && !strings.EqualFold(f.UserName, event.UserName) {
+		return false
+	}
+	if f.FolderName != "" && !strings.EqualFold(f.FolderName, event.FolderName) &&
+		!(event.Type == EventFolderRenamed && strings.EqualFold(f.FolderName, event.OldName)) {
+		return false
+	}
+	return true
+}
+
+// EventBufferSize is the capacity of the channel of each subscription. When a
+// subscriber falls behind and its buffer is full, the oldest buffered event is
+// discarded to make room for the new one, so publishing never blocks and a
+// slow subscriber always sees the latest changes. Event.Dropped tells how many
+// events were discarded.
+var EventBufferSize = 64
+
+type subscriber struct {
+	ch      chan Event
+	filter  EventFilter
+	dropped int
+}
+
+// EventBus fans the events of the system out to its subscribers.
+type EventBus struct {
+	mu          sync.Mutex
+	subscribers map[int]*subscriber
+	next        int
+	hooks       []func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subscribers: make(map[int]*subscriber)}
+}
+
+// Subscribe to receive the events matching filter. The channel is closed by cancel.
+func (b *EventBus) Subscribe(filter EventFilter) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.next
+	b.next++
+	sub := &subscriber{ch: make(chan Event, EventBufferSize), filter: filter}
+	b.subscribers[id] = sub
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subscribers, id)
+			close(sub.ch)
+		})
+	}
+	return sub.ch, cancel
+}
+
+// OnEvent to call hook synchronously on every published event. Unlike a
+// subscription, a hook never misses an event, so it must not block.
+func (b *EventBus) OnEvent(hook func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, hook)
+}
+
+// Publish to deliver event to the matching subscribers without blocking.
+func (b *EventBus) Publish(event Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range b.subscribers {
+		if !sub.filter.Match(event) {
+			continue
+		}
+		for {
+			event.Dropped = sub.dropped
+			select {
+			case sub.ch <- event:
+			default:
+				select {
+				case <-sub.ch:
+					sub.dropped++
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+	for _, hook := range b.hooks {
+		hook(event)
+	}
+}
+
+// Subscribe to receive the events of the system matching filter, see EventBus.Subscribe.
+func (s *System) Subscribe(filter EventFilter) (<-chan Event, func()) {
+	return s.Events.Subscribe(filter)
+}
+
+// publish to deliver event to the subscribers, or to hold it back until
+// commit in a transaction.
+func (s *System) publish(event Event) {
+	s.stamp(event)
+	event.audited = event.audited || s.dispatching
+	if s.tx != nil {
+		s.tx.events = append(s.tx.events, event)
+		return
+	}
+	s.version++
+	s.markDirty(event)
+	s.auditEvent(event)
+	event.audited = false
+	s.Events.Publish(event)
+}
+
+// stamp to set the modification time of the folder or file changed by event
+// to the time of the event. A file created or deleted modifies its folder.
+func (s *System) stamp(event Event) {
+	user := s.GetUser(event.UserName)
+	if user == nil {
+		return
+	}
+	folder := user.GetFolder(event.FolderName)
+	if folder == nil {
+		return
+	}
+	switch event.Type {
+	case EventFolderRenamed, EventFolderModified, EventFileCreated, EventFileDeleted:
+		folder.ModifiedAt = event.Time
+	case EventFileModified:
+		if file := folder.GetFile(event.FileName); file != nil {
+			file.ModifiedAt = event.Time
+		}
+	}
+}
+
+func (s *System) emit(t EventType, username, foldername, filename string) {
+	s.publish(Event{
+		Type:       t,
+		Time:       s.now(),
+		UserName:   username,
+		FolderName: foldername,
+		FileName:   filename,
+	})
+}
+
+// emitLabels to publish the change of the labels of a `folder` or `folder/file` path.
+func (s *System) emitLabels(username, path string) {
+	foldername, filename := SplitPath(path)
+	if filename == "" {
+		s.emit(EventFolderModified, username, foldername, "")
+	} else {
+		s.emit(EventFileModified, username, foldername, filename)
+	}
+}
+
+// Watch to print the events matching filter to w in the background until
+// StopWatches is called.
+func (s *System) Watch(w io.Writer, ew io.Writer, filter EventFilter) RespondType {
+	if filter.UserName != "" && s.GetUser(filter.UserName) == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(filter.UserName))
+		return ErrNotExists
+	}
+
+	events, cancel := s.Subscribe(filter)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range events {
+			layout, loc := s.timeSettings(OutputOptions{})
+			fmt.Fprintf(w, "[%s] %s\n", formatTime(event.Time, layout, loc), event.ToString())
+		}
+	}()
+
+	s.watchMu.Lock()
+	s.watches = append(s.watches, func() {
+		cancel()
+		<-done
+	})
+	s.watchMu.Unlock()
+
+	target := joinPath(filter.UserName, filter.FolderName)
+	if target == "" {
+		target = "all users"
+	}
+	fmt.Fprintf(w, "Watch %s successfully.\n", target)
+	return Succeed
+}
+
+// StopWatches to end the watches started by Watch, returning how many there were.
+func (s *System) StopWatches() int {
+	s.watchMu.Lock()
+	watches := s.watches
+	s.watches = nil
+	s.watchMu.Unlock()
+
+	for _, stop := range watches {
+		stop()
+	}
+	return len(watches)
+}
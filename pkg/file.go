@@ -9,26 +9,71 @@ type File struct {
 	Name        string
 	Description string
 	CreatedAt   time.Time
-	FolderName  string
-	UserName    string
+	// ModifiedAt is the time of the last change of the file or of its
+	// content, AccessedAt the time of the last read of its content.
+	ModifiedAt time.Time
+	AccessedAt time.Time
+	// Seq orders the files created at the same time, see System.Clock.
+	Seq        uint64 `json:",omitempty"`
+	FolderName string
+	UserName   string
+	Labels
+	// Chunks address the content of the file in the BlobStore. Every chunk
+	// holds ChunkSize bytes but the last, which holds the rest up to Size.
+	Chunks    []string `json:",omitempty"`
+	ChunkSize int64    `json:",omitempty"`
+	// Size is the logical size of the content, StoredSize the size of its
+	// chunks once compressed with Compression.
+	Size        int64  `json:",omitempty"`
+	StoredSize  int64  `json:",omitempty"`
+	Compression string `json:",omitempty"`
+	// KeyVersion is the version of the key of the user the chunks are
+	// encrypted with, 0 when they are not.
+	KeyVersion int `json:",omitempty"`
+	// Sealed holds the other fields of the file of a locked user, see sealFile.
+	Sealed []byte `json:",omitempty"`
 }
 
-func CreateFile(filename, desc, foldername, username string) *File {
+// CreateFile returns a file created at now.
+func CreateFile(filename, desc, foldername, username string, now time.Time) *File {
 	return &File{
 		Name:        filename,
 		Description: desc,
-		CreatedAt:   time.Now(),
+		CreatedAt:   now,
+		ModifiedAt:  now,
+		AccessedAt:  now,
 		FolderName:  foldername,
 		UserName:    username,
 	}
 }
 
+// Clone returns a deep copy of the file.
+func (file *File) Clone() *File {
+	clone := *file
+	clone.Labels = file.Labels.Clone()
+	clone.Chunks = append([]string(nil), file.Chunks...)
+	return &clone
+}
+
+func (file *File) SetDescription(desc string) {
+	file.Description = desc
+}
+
 func (file *File) ToString() string {
-	return fmt.Sprintf("%s %s %s %s %s",
+	return file.Format(DefaultTimeFormat, nil)
+}
+
+// Format renders the file like ToString, with its creation time in the given layout and zone.
+func (file *File) Format(layout string, loc *time.Location) string {
+	str := fmt.Sprintf("%s %s %s %s %s",
 		file.Name,
 		file.Description,
-		file.CreatedAt.Format("2006-01-02 15:04:05"),
+		formatTime(file.CreatedAt, layout, loc),
 		file.FolderName,
 		file.UserName,
 	)
+	if labels := file.Labels.ToString(); labels != "" {
+		str += " " + labels
+	}
+	return str
 }
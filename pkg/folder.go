@@ -12,23 +12,73 @@ type Folder struct {
 	Description string
 	Files       map[string]*File
 	CreatedAt   time.Time
-	UserName    string
+	// ModifiedAt is the time of the last change of the folder or of its list
+	// of files, AccessedAt the time of the last read.
+	ModifiedAt time.Time
+	AccessedAt time.Time
+	// Seq orders the folders created at the same time, see System.Clock.
+	Seq      uint64 `json:",omitempty"`
+	UserName string
+	Labels
+	// Compression is the policy the content of new files is stored with, see Compressions.
+	Compression string `json:",omitempty"`
+	// Sealed holds the other fields of the folder of a locked user, see sealFolder.
+	Sealed []byte `json:",omitempty"`
 }
 
-func CreateFolder(foldername, desc, username string) *Folder {
+// CreateFolder returns a folder created at now.
+func CreateFolder(foldername, desc, username string, now time.Time) *Folder {
 	return &Folder{
 		Name:        foldername,
 		Description: desc,
 		Files:       make(map[string]*File, 0),
-		CreatedAt:   time.Now(),
+		CreatedAt:   now,
+		ModifiedAt:  now,
+		AccessedAt:  now,
 		UserName:    username,
 	}
 }
 
+// Clone returns a deep copy of the folder and its files.
+func (folder *Folder) Clone() *Folder {
+	clone := *folder
+	clone.Labels = folder.Labels.Clone()
+	clone.Files = make(map[string]*File, len(folder.Files))
+	for name, file := range folder.Files {
+		clone.Files[name] = file.Clone()
+	}
+	return &clone
+}
+
+// fillTimes to default the modification and access times missing from records
+// saved before they existed to the creation time.
+func (folder *Folder) fillTimes() {
+	if folder.Sealed != nil {
+		return
+	}
+	folder.ModifiedAt, folder.AccessedAt = orTime(folder.ModifiedAt, folder.CreatedAt), orTime(folder.AccessedAt, folder.CreatedAt)
+	for _, file := range folder.Files {
+		if file.Sealed == nil {
+			file.ModifiedAt, file.AccessedAt = orTime(file.ModifiedAt, file.CreatedAt), orTime(file.AccessedAt, file.CreatedAt)
+		}
+	}
+}
+
+func orTime(t, fallback time.Time) time.Time {
+	if t.IsZero() {
+		return fallback
+	}
+	return t
+}
+
 func (folder *Folder) SetName(foldername string) {
 	folder.Name = foldername
 }
 
+func (folder *Folder) SetDescription(desc string) {
+	folder.Description = desc
+}
+
 func (folder *Folder) GetFile(filename string) *File {
 	for f := range folder.Files {
 		if f == filename {
@@ -51,10 +101,19 @@ func (folder *Folder) AddFile(filename string, file *File) {
 }
 
 func (folder *Folder) ToString() string {
-	return fmt.Sprintf("%s %s %s %s",
+	return folder.Format(DefaultTimeFormat, nil)
+}
+
+// Format renders the folder like ToString, with its creation time in the given layout and zone.
+func (folder *Folder) Format(layout string, loc *time.Location) string {
+	str := fmt.Sprintf("%s %s %s %s",
 		folder.Name,
 		folder.Description,
-		folder.CreatedAt.Format("2006-01-02 15:04:05"),
+		formatTime(folder.CreatedAt, layout, loc),
 		folder.UserName,
 	)
+	if labels := folder.Labels.ToString(); labels != "" {
+		str += " " + labels
+	}
+	return str
 }
@@ -0,0 +1,245 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	_ io.ReadSeekCloser = (*FileHandle)(nil)
+	_ io.ReaderAt       = (*FileHandle)(nil)
+	_ io.WriterAt       = (*FileHandle)(nil)
+)
+
+// FileHandle streams the content of a file, as returned by System.OpenFile.
+// Reads and writes lock the system for the time of each call only, so a file
+// of any size is read and written without holding it in memory, and a write
+// only rewrites the chunks it touches. A handle serves an HTTP Range request
+// through http.ServeContent.
+//
+// Writes appending to the end of the file are buffered up to the next chunk
+// boundary, so that a sequential writer stores each chunk once; they are
+// written by the next call of the handle which is not such a write, or Sync.
+//
+// The access time of the file is saved on Close when the handle was read.
+//
+// The file is looked up by name on each call: once it is deleted, or its
+// folder renamed, the handle fails with os.ErrNotExist.
+type FileHandle struct {
+	s        *System
+	username string
+	folder   string
+	name     string
+	offset   int64
+	written  bool
+	closed   bool
+	read     atomic.Bool
+
+	// mu guards the appended bytes not written yet, at pendingOff.
+	mu         sync.Mutex
+	pending    []byte
+	pendingOff int64
+}
+
+// OpenFile to open a file of a user for reading and writing.
+func (s *System) OpenFile(username, foldername, filename string) (*FileHandle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h := &FileHandle{s: s, username: username, folder: foldername, name: filename}
+	if _, err := h.file(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// file returns the file of the handle. The caller holds s.mu.
+func (h *FileHandle) file() (*File, error) {
+	if h.closed {
+		return nil, os.ErrClosed
+	}
+	if user := h.s.GetUser(h.username); user != nil {
+		if folder := user.GetFolder(h.folder); folder != nil {
+			if file := folder.GetFile(h.name); file != nil {
+				return file, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", joinPath(h.username, h.folder, h.name), os.ErrNotExist)
+}
+
+// Name returns the `user/folder/file` path of the handle.
+func (h *FileHandle) Name() string {
+	return joinPath(h.username, h.folder, h.name)
+}
+
+// Size returns the size of the content in bytes.
+func (h *FileHandle) Size() (int64, error) {
+	if err := h.Sync(); err != nil {
+		return 0, err
+	}
+	h.s.mu.RLock()
+	defer h.s.mu.RUnlock()
+	file, err := h.file()
+	if err != nil {
+		return 0, err
+	}
+	return file.Size, nil
+}
+
+func (h *FileHandle) ReadAt(p []byte, off int64) (int, error) {
+	if err := h.Sync(); err != nil {
+		return 0, err
+	}
+	h.s.mu.RLock()
+	defer h.s.mu.RUnlock()
+	file, err := h.file()
+	if err != nil {
+		return 0, err
+	}
+	h.read.Store(true)
+	return h.s.readAt(file, p, off)
+}
+
+func (h *FileHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.offset)
+	h.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (h *FileHandle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += h.offset
+	case io.SeekEnd:
+		size, err := h.Size()
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	h.offset = offset
+	return offset, nil
+}
+
+// WriteAt to write p at off, extending the file with zeros up to off if
+// needed. The change is published as a file.modified event on Close.
+func (h *FileHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	file, err := h.file()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(h.pending) > 0 && off != h.pendingOff+int64(len(h.pending)) {
+		if err := h.writePending(file); err != nil {
+			return 0, err
+		}
+	}
+	if len(h.pending) == 0 && off != file.Size {
+		return h.write(file, p, off)
+	}
+	if len(h.pending) == 0 {
+		h.pendingOff = off
+	}
+	h.pending = append(h.pending, p...)
+
+	// the chunks completed are written, the tail is kept for the next write
+	cs := file.ChunkSize
+	if cs == 0 {
+		cs = ChunkSize
+	}
+	end := h.pendingOff + int64(len(h.pending))
+	if boundary := end - end%cs; boundary > h.pendingOff {
+		n := boundary - h.pendingOff
+		if _, err := h.write(file, h.pending[:n], h.pendingOff); err != nil {
+			h.pending = nil
+			return 0, err
+		}
+		h.pending, h.pendingOff = append([]byte(nil), h.pending[n:]...), boundary
+	}
+	h.written = true
+	return len(p), nil
+}
+
+// write to write p at off. The caller holds s.mu.
+func (h *FileHandle) write(file *File, p []byte, off int64) (int, error) {
+	n, err := h.s.writeAt(file, p, off)
+	if n > 0 {
+		h.written = true
+		// a transaction begun before must not overwrite the change
+		h.s.version++
+	}
+	return n, err
+}
+
+// writePending to write the buffered bytes. The caller holds h.mu and s.mu.
+func (h *FileHandle) writePending(file *File) error {
+	p := h.pending
+	h.pending = nil
+	_, err := h.write(file, p, h.pendingOff)
+	return err
+}
+
+// Sync to write the appended bytes still buffered by the handle, so that
+// the other readers of the file see them.
+func (h *FileHandle) Sync() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.pending) == 0 {
+		return nil
+	}
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	file, err := h.file()
+	if err != nil {
+		h.pending = nil
+		return err
+	}
+	return h.writePending(file)
+}
+
+// Close to write the buffered bytes, publish the changes written through the
+// handle and write them to the store, with the access time of the file when
+// it was read.
+func (h *FileHandle) Close() error {
+	err := h.Sync()
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+	if h.closed {
+		return os.ErrClosed
+	}
+	file, ferr := h.file()
+	h.closed = true
+	if !h.written && !h.read.Load() {
+		return err
+	}
+	event := Event{Type: EventFileModified, Time: h.s.now(), UserName: h.username, FolderName: h.folder, FileName: h.name}
+	if h.read.Load() && ferr == nil {
+		// the access time is saved without publishing a change
+		file.AccessedAt = event.Time
+		h.s.markDirty(event)
+	}
+	if h.written {
+		h.s.publish(event)
+	}
+	if ferr := h.s.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
@@ -0,0 +1,495 @@
+package pkg
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Index is an in-memory inverted index over the names and descriptions of
+// folders and files, and the contents of files. It is kept up to date by the
+// System mutation methods, so a search never has to scan every entry.
+//
+// A content is tokenized by the next search after the file is added or
+// written, so that a file written in many pieces is read once.
+type Index struct {
+	postings map[string]map[string]int  // term -> doc key -> term frequency
+	docs     map[string]*indexDoc       // doc key -> doc
+	folders  map[string]map[string]bool // folder doc key -> file doc keys
+	stale    map[string]bool            // file doc keys whose content is to index
+
+	// Content returns a reader of the content of a file to index, nil when
+	// it cannot be read. Contents are not indexed without it.
+	Content func(username, foldername, filename string) io.Reader
+
+	// A staging index holds the changes of a transaction to base, see Stage.
+	base *Index
+	// lock guards base while it is read, to search the staged changes.
+	lock sync.Locker
+	ops  []func(idx *Index)
+	// view is base with the staged changes, made by the first search.
+	view *Index
+}
+
+type indexDoc struct {
+	UserName   string
+	FolderName string
+	FileName   string
+	Terms      []string
+	Content    []string
+}
+
+// SearchResult is a single ranked hit returned by Index.Search.
+type SearchResult struct {
+	UserName   string
+	FolderName string
+	FileName   string
+	Score      float64
+}
+
+func NewIndex() *Index {
+	return &Index{
+		postings: make(map[string]map[string]int, 0),
+		docs:     make(map[string]*indexDoc, 0),
+		folders:  make(map[string]map[string]bool, 0),
+		stale:    make(map[string]bool, 0),
+	}
+}
+
+// Stage returns an index staging changes to idx, applied by Apply, as a
+// transaction does. It is not filled until it is searched: idx is then
+// copied while lock is held, the staged changes applied to the copy.
+func (idx *Index) Stage(lock sync.Locker) *Index {
+	return &Index{base: idx, lock: lock}
+}
+
+// Apply to make the changes staged by staging, in their order.
+func (idx *Index) Apply(staging *Index) {
+	for _, op := range staging.ops {
+		op(idx)
+	}
+}
+
+// do to run op on the index, or stage it on a staging index.
+func (idx *Index) do(op func(idx *Index)) {
+	if idx.base == nil {
+		op(idx)
+		return
+	}
+	idx.ops = append(idx.ops, op)
+	if idx.view != nil {
+		op(idx.view)
+	}
+}
+
+// clone returns a copy of the index, whose docs can be changed apart.
+func (idx *Index) clone() *Index {
+	clone := NewIndex()
+	for term, postings := range idx.postings {
+		clone.postings[term] = make(map[string]int, len(postings))
+		for key, n := range postings {
+			clone.postings[term][key] = n
+		}
+	}
+	for key, doc := range idx.docs {
+		copied := *doc
+		clone.docs[key] = &copied
+	}
+	for folder, keys := range idx.folders {
+		clone.folders[folder] = make(map[string]bool, len(keys))
+		for key := range keys {
+			clone.folders[folder][key] = true
+		}
+	}
+	for key := range idx.stale {
+		clone.stale[key] = true
+	}
+	return clone
+}
+
+// Path returns the `user/folder[/file]` path of a search hit.
+func (r SearchResult) Path() string {
+	return docKey(r.UserName, r.FolderName, r.FileName)
+}
+
+func docKey(username, foldername, filename string) string {
+	if filename == "" {
+		return username + "/" + foldername
+	}
+	return username + "/" + foldername + "/" + filename
+}
+
+// Tokenize splits text into lowercase terms on every rune which is neither a
+// letter nor a digit, so `report_2024` yields `report` and `2024`.
+func Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !isTermRune(r)
+	})
+}
+
+func isTermRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// scanTerms is a bufio.SplitFunc yielding the terms of Tokenize, not lowercased.
+func scanTerms(data []byte, atEOF bool) (int, []byte, error) {
+	start := 0
+	for start < len(data) {
+		if !atEOF && !utf8.FullRune(data[start:]) {
+			return start, nil, nil
+		}
+		r, size := utf8.DecodeRune(data[start:])
+		if isTermRune(r) {
+			break
+		}
+		start += size
+	}
+	for i := start; i < len(data); {
+		if !atEOF && !utf8.FullRune(data[i:]) {
+			return start, nil, nil
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		if !isTermRune(r) {
+			return i + size, data[start:i], nil
+		}
+		i += size
+	}
+	if atEOF && start < len(data) {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil
+}
+
+// tokenizeReader returns the terms of what r reads, as Tokenize. A term
+// longer than the buffer of the scanner ends the terms.
+func tokenizeReader(r io.Reader) []string {
+	var terms []string
+	scanner := bufio.NewScanner(r)
+	scanner.Split(scanTerms)
+	for scanner.Scan() {
+		terms = append(terms, strings.ToLower(scanner.Text()))
+	}
+	return terms
+}
+
+func (idx *Index) add(username, foldername, filename, text string) {
+	key := docKey(username, foldername, filename)
+	doc := &indexDoc{
+		UserName:   username,
+		FolderName: foldername,
+		FileName:   filename,
+		Terms:      Tokenize(text),
+	}
+	// an edit of the name or description keeps the content indexed
+	if old, ok := idx.docs[key]; ok {
+		doc.Content = old.Content
+	} else if filename != "" {
+		idx.stale[key] = true
+	}
+	idx.remove(key)
+	idx.insert(key, doc)
+}
+
+// insert to add doc under key, with its postings.
+func (idx *Index) insert(key string, doc *indexDoc) {
+	idx.docs[key] = doc
+	if doc.FileName != "" {
+		folder := docKey(doc.UserName, doc.FolderName, "")
+		if idx.folders[folder] == nil {
+			idx.folders[folder] = make(map[string]bool, 0)
+		}
+		idx.folders[folder][key] = true
+	}
+	idx.post(key, doc.Terms)
+	idx.post(key, doc.Content)
+}
+
+func (idx *Index) post(key string, terms []string) {
+	for _, term := range terms {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[string]int, 0)
+		}
+		idx.postings[term][key]++
+	}
+}
+
+func (idx *Index) unpost(key string, terms []string) {
+	for _, term := range terms {
+		delete(idx.postings[term], key)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+}
+
+func (idx *Index) remove(key string) {
+	doc, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	idx.unpost(key, doc.Terms)
+	idx.unpost(key, doc.Content)
+	delete(idx.docs, key)
+	if doc.FileName != "" {
+		folder := docKey(doc.UserName, doc.FolderName, "")
+		delete(idx.folders[folder], key)
+		if len(idx.folders[folder]) == 0 {
+			delete(idx.folders, folder)
+		}
+	}
+}
+
+// refresh to index the contents of the files added or written since the
+// last search.
+func (idx *Index) refresh() {
+	for key := range idx.stale {
+		delete(idx.stale, key)
+		doc, ok := idx.docs[key]
+		if !ok || idx.Content == nil {
+			continue
+		}
+		idx.unpost(key, doc.Content)
+		doc.Content = nil
+		if r := idx.Content(doc.UserName, doc.FolderName, doc.FileName); r != nil {
+			doc.Content = tokenizeReader(r)
+		}
+		idx.post(key, doc.Content)
+	}
+}
+
+// AddFolder indexes the name and description of a folder.
+func (idx *Index) AddFolder(folder *Folder) {
+	username, foldername, text := folder.UserName, folder.Name, folder.Name+" "+folder.Description
+	idx.do(func(idx *Index) { idx.add(username, foldername, "", text) })
+}
+
+// AddFile indexes the name and description of a file under its parent
+// folder, and its content when it is not indexed yet.
+func (idx *Index) AddFile(folder *Folder, file *File) {
+	username, foldername, filename, text := folder.UserName, folder.Name, file.Name, file.Name+" "+file.Description
+	idx.do(func(idx *Index) { idx.add(username, foldername, filename, text) })
+}
+
+// UpdateContent to index the content of a file again, as it was written.
+func (idx *Index) UpdateContent(username, foldername, filename string) {
+	key := docKey(username, foldername, filename)
+	idx.do(func(idx *Index) {
+		if idx.docs[key] != nil {
+			idx.stale[key] = true
+		}
+	})
+}
+
+// RemoveFile drops a file from the index.
+func (idx *Index) RemoveFile(username, foldername, filename string) {
+	key := docKey(username, foldername, filename)
+	idx.do(func(idx *Index) { idx.remove(key) })
+}
+
+// RemoveFolder drops a folder and every file under it from the index.
+func (idx *Index) RemoveFolder(username, foldername string) {
+	idx.do(func(idx *Index) { idx.removeFolder(username, foldername) })
+}
+
+func (idx *Index) removeFolder(username, foldername string) {
+	folder := docKey(username, foldername, "")
+	for key := range idx.folders[folder] {
+		idx.remove(key)
+	}
+	idx.remove(folder)
+}
+
+// RenameFolder to move a folder and its files to a new name in the index,
+// keeping the contents indexed.
+func (idx *Index) RenameFolder(folder *Folder, oldName string) {
+	username, foldername, text := folder.UserName, folder.Name, folder.Name+" "+folder.Description
+	idx.do(func(idx *Index) {
+		keys := idx.folders[docKey(username, oldName, "")]
+		docs := make([]*indexDoc, 0, len(keys))
+		for key := range keys {
+			docs = append(docs, idx.docs[key])
+		}
+		idx.removeFolder(username, oldName)
+		idx.add(username, foldername, "", text)
+		for _, doc := range docs {
+			renamed := *doc
+			renamed.FolderName = foldername
+			key := docKey(renamed.UserName, renamed.FolderName, renamed.FileName)
+			if idx.stale[docKey(doc.UserName, oldName, doc.FileName)] {
+				delete(idx.stale, docKey(doc.UserName, oldName, doc.FileName))
+				idx.stale[key] = true
+			}
+			idx.insert(key, &renamed)
+		}
+	})
+}
+
+// Rebuild discards the index and re-indexes every folder and file of users.
+// Their contents are indexed by the next search. A staging index drops the
+// changes staged before.
+func (idx *Index) Rebuild(users map[string]*User) {
+	if idx.base != nil {
+		idx.ops = nil
+	}
+	idx.do(func(idx *Index) { idx.rebuild(users) })
+}
+
+func (idx *Index) rebuild(users map[string]*User) {
+	idx.postings = make(map[string]map[string]int, 0)
+	idx.docs = make(map[string]*indexDoc, 0)
+	idx.folders = make(map[string]map[string]bool, 0)
+	idx.stale = make(map[string]bool, 0)
+
+	for _, user := range users {
+		for _, folder := range user.Folders {
+			idx.add(folder.UserName, folder.Name, "", folder.Name+" "+folder.Description)
+			for _, file := range folder.Files {
+				idx.add(folder.UserName, folder.Name, file.Name, file.Name+" "+file.Description)
+			}
+		}
+	}
+}
+
+// Search runs query against the documents owned by username and returns the
+// hits ranked by TF-IDF score, best first.
+//
+// Each element of query is a term; an element made of several terms (e.g. a
+// quoted `"quarterly report"`) is a phrase which must appear contiguously.
+// Terms are ANDed, `OR` separates alternative groups and `AND` is accepted
+// but redundant, so `a b OR "c d"` matches (a AND b) OR (phrase "c d").
+func (idx *Index) Search(username string, query []string) []SearchResult {
+	if idx.base != nil {
+		if idx.view == nil {
+			idx.lock.Lock()
+			idx.view = idx.base.clone()
+			idx.lock.Unlock()
+			idx.view.Apply(idx)
+		}
+		idx.view.Content = idx.Content
+		return idx.view.Search(username, query)
+	}
+	idx.refresh()
+	scores := make(map[string]float64, 0)
+
+	for _, group := range parseQuery(query) {
+		for key, score := range idx.matchGroup(username, group) {
+			if score > scores[key] {
+				scores[key] = score
+			}
+		}
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for key, score := range scores {
+		doc := idx.docs[key]
+		results = append(results, SearchResult{
+			UserName:   doc.UserName,
+			FolderName: doc.FolderName,
+			FileName:   doc.FileName,
+			Score:      score,
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path() < results[j].Path()
+	})
+	return results
+}
+
+// parseQuery splits query into OR groups of clauses, each clause being the
+// tokens of a term or phrase.
+func parseQuery(query []string) [][][]string {
+	var groups [][][]string
+	var group [][]string
+
+	for _, q := range query {
+		switch q {
+		case "OR":
+			if len(group) > 0 {
+				groups = append(groups, group)
+			}
+			group = nil
+		case "AND":
+		default:
+			if terms := Tokenize(q); len(terms) > 0 {
+				group = append(group, terms)
+			}
+		}
+	}
+	if len(group) > 0 {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// matchGroup returns the scores of the docs of username matching every
+// clause of group.
+func (idx *Index) matchGroup(username string, group [][]string) map[string]float64 {
+	var matched map[string]float64
+
+	for _, clause := range group {
+		candidates := make(map[string]float64, 0)
+		for key := range idx.postings[clause[0]] {
+			doc := idx.docs[key]
+			if doc.UserName != username || !doc.hasPhrase(clause) {
+				continue
+			}
+			candidates[key] = idx.score(key, clause)
+		}
+
+		if matched == nil {
+			matched = candidates
+			continue
+		}
+		for key := range matched {
+			if score, ok := candidates[key]; ok {
+				matched[key] += score
+			} else {
+				delete(matched, key)
+			}
+		}
+	}
+	return matched
+}
+
+func (idx *Index) score(key string, terms []string) float64 {
+	total := float64(len(idx.docs))
+	score := 0.0
+	for _, term := range terms {
+		tf := float64(idx.postings[term][key])
+		df := float64(len(idx.postings[term]))
+		score += tf * math.Log(1+total/df)
+	}
+	doc := idx.docs[key]
+	return score / math.Sqrt(float64(len(doc.Terms)+len(doc.Content)))
+}
+
+// hasPhrase reports whether the name and description, or the content, of
+// doc contain phrase.
+func (doc *indexDoc) hasPhrase(phrase []string) bool {
+	return hasPhrase(doc.Terms, phrase) || hasPhrase(doc.Content, phrase)
+}
+
+func hasPhrase(terms, phrase []string) bool {
+	for i := 0; i+len(phrase) <= len(terms); i++ {
+		found := true
+		for j, term := range phrase {
+			if terms[i+j] != term {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package pkg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels holds the tags and key/value metadata shared by folders and files.
+type Labels struct {
+	Tags []string
+	Meta map[string]string
+}
+
+// Clone returns a copy of the labels sharing no memory with l.
+func (l Labels) Clone() Labels {
+	clone := Labels{Tags: append([]string(nil), l.Tags...)}
+	if l.Meta != nil {
+		clone.Meta = make(map[string]string, len(l.Meta))
+		for key, value := range l.Meta {
+			clone.Meta[key] = value
+		}
+	}
+	return clone
+}
+
+func (l *Labels) HasTag(tag string) bool {
+	for _, t := range l.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// HasTags reports whether every tag of tags is set.
+func (l *Labels) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		if !l.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *Labels) AddTag(tag string) {
+	if l.HasTag(tag) {
+		return
+	}
+	l.Tags = append(l.Tags, tag)
+	sort.Strings(l.Tags)
+}
+
+func (l *Labels) RemoveTag(tag string) {
+	for i, t := range l.Tags {
+		if t == tag {
+			l.Tags = append(l.Tags[:i], l.Tags[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *Labels) SetMeta(key, value string) {
+	if l.Meta == nil {
+		l.Meta = make(map[string]string, 0)
+	}
+	l.Meta[key] = value
+}
+
+func (l *Labels) GetMeta(key string) (string, bool) {
+	value, ok := l.Meta[key]
+	return value, ok
+}
+
+// MetaKeys returns the metadata keys in sorted order.
+func (l *Labels) MetaKeys() []string {
+	keys := make([]string, 0, len(l.Meta))
+	for key := range l.Meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ToString renders tags as `#tag` and metadata as `key=value`, or "" if both are empty.
+func (l *Labels) ToString() string {
+	var parts []string
+	for _, tag := range l.Tags {
+		parts = append(parts, "#"+tag)
+	}
+	for _, key := range l.MetaKeys() {
+		parts = append(parts, fmt.Sprintf("%s=%s", key, l.Meta[key]))
+	}
+	return strings.Join(parts, " ")
+}
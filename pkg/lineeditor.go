@@ -0,0 +1,439 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxHistory is the number of lines kept in the history of a LineEditor.
+var MaxHistory = 1000
+
+// ErrInterrupt is returned by LineEditor.ReadLine when the line is cancelled by Ctrl-C.
+var ErrInterrupt = errors.New("interrupt")
+
+// CompleteFunc returns the candidates completing the word which ends at the
+// end of line, and the byte offset where that word starts.
+type CompleteFunc func(line string) (candidates []string, start int)
+
+// LineEditor reads lines from a terminal in raw mode, with cursor movement,
+// history navigation, reverse history search (Ctrl-R) and tab completion.
+type LineEditor struct {
+	in       *bufio.Reader
+	out      io.Writer
+	History  []string
+	Complete CompleteFunc
+	// Redact, when set, rewrites a line before it enters the history, e.g. to
+	// hide its secret arguments.
+	Redact func(line string) string
+
+	historyFile string
+}
+
+func NewLineEditor(in io.Reader, out io.Writer) *LineEditor {
+	return &LineEditor{
+		in:  bufio.NewReader(in),
+		out: out,
+	}
+}
+
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyCtrlG     = 7
+	keyBackspace = 8
+	keyTab       = 9
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlR     = 18
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+
+	// Keys decoded from escape sequences, negative to never clash with a rune.
+	keyUp = -(iota + 1)
+	keyDown
+	keyRight
+	keyLeft
+	keyHome
+	keyEnd
+	keyDeleteForward
+	keyUnknown
+)
+
+// readKey reads one key, decoding the escape sequences of arrows, Home, End and Delete.
+func (e *LineEditor) readKey() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil || r != keyEscape {
+		return r, err
+	}
+
+	next, _, err := e.in.ReadRune()
+	if err != nil {
+		return keyEscape, nil
+	}
+	if next != '[' && next != 'O' {
+		return keyUnknown, nil
+	}
+
+	code, _, err := e.in.ReadRune()
+	if err != nil {
+		return keyUnknown, nil
+	}
+	switch code {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case 'C':
+		return keyRight, nil
+	case 'D':
+		return keyLeft, nil
+	case 'H':
+		return keyHome, nil
+	case 'F':
+		return keyEnd, nil
+	}
+
+	// `ESC [ n ~` sequences
+	seq := string(code)
+	for code >= '0' && code <= '9' {
+		if code, _, err = e.in.ReadRune(); err != nil {
+			return keyUnknown, nil
+		}
+		seq += string(code)
+	}
+	switch seq {
+	case "1~", "7~":
+		return keyHome, nil
+	case "4~", "8~":
+		return keyEnd, nil
+	case "3~":
+		return keyDeleteForward, nil
+	}
+	return keyUnknown, nil
+}
+
+// ReadLine to read one line with the given prompt. The terminal must already
+// be in raw mode. It returns io.EOF on Ctrl-D at an empty line and
+// ErrInterrupt on Ctrl-C.
+func (e *LineEditor) ReadLine(prompt string) (string, error) {
+	var line []rune
+	pos := 0
+	histPos := len(e.History)
+	saved := ""
+
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(line))
+		if back := len(line) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	setLine := func(s string) {
+		line = []rune(s)
+		pos = len(line)
+	}
+
+	redraw()
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return string(line), nil
+			}
+			return "", err
+		}
+
+		switch key {
+		case keyEnter, '\n':
+			fmt.Fprint(e.out, "\r\n")
+			e.AddHistory(string(line))
+			return string(line), nil
+
+		case keyCtrlC:
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", ErrInterrupt
+
+		case keyCtrlD:
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+
+		case keyDeleteForward:
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+
+		case keyBackspace, keyDelete:
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+
+		case keyCtrlA, keyHome:
+			pos = 0
+
+		case keyCtrlE, keyEnd:
+			pos = len(line)
+
+		case keyCtrlB, keyLeft:
+			if pos > 0 {
+				pos--
+			}
+
+		case keyCtrlF, keyRight:
+			if pos < len(line) {
+				pos++
+			}
+
+		case keyCtrlK:
+			line = line[:pos]
+
+		case keyCtrlU:
+			line = line[pos:]
+			pos = 0
+
+		case keyCtrlW:
+			start := pos
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+			line = append(line[:start], line[pos:]...)
+			pos = start
+
+		case keyCtrlL:
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+
+		case keyCtrlP, keyUp:
+			if histPos > 0 {
+				if histPos == len(e.History) {
+					saved = string(line)
+				}
+				histPos--
+				setLine(e.History[histPos])
+			}
+
+		case keyCtrlN, keyDown:
+			if histPos < len(e.History) {
+				histPos++
+				if histPos == len(e.History) {
+					setLine(saved)
+				} else {
+					setLine(e.History[histPos])
+				}
+			}
+
+		case keyCtrlR:
+			found, accept, err := e.reverseSearch()
+			if err != nil {
+				return "", err
+			}
+			if found != "" {
+				setLine(found)
+			}
+			if accept {
+				redraw()
+				fmt.Fprint(e.out, "\r\n")
+				e.AddHistory(string(line))
+				return string(line), nil
+			}
+
+		case keyTab:
+			line, pos = e.complete(line, pos)
+
+		default:
+			if key >= ' ' {
+				line = append(line[:pos], append([]rune{key}, line[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
+
+// reverseSearch runs an incremental search back through the history. It
+// returns the selected line and whether it must be run right away (Enter)
+// rather than edited.
+func (e *LineEditor) reverseSearch() (string, bool, error) {
+	query := ""
+	match := ""
+	from := len(e.History) - 1
+
+	search := func(start int) {
+		for i := start; i >= 0; i-- {
+			if strings.Contains(e.History[i], query) {
+				match, from = e.History[i], i
+				return
+			}
+		}
+	}
+
+	for {
+		fmt.Fprintf(e.out, "\r(reverse-i-search)`%s': %s\x1b[K", query, match)
+
+		key, err := e.readKey()
+		if err != nil {
+			return "", false, err
+		}
+		switch key {
+		case keyEnter, '\n':
+			return match, true, nil
+		case keyCtrlC, keyCtrlG:
+			return "", false, nil
+		case keyCtrlR:
+			search(from - 1)
+		case keyBackspace, keyDelete:
+			if query != "" {
+				_, size := utf8.DecodeLastRuneInString(query)
+				query = query[:len(query)-size]
+				from = len(e.History) - 1
+				match = ""
+				search(from)
+			}
+		default:
+			if key < ' ' {
+				return match, false, nil
+			}
+			query += string(key)
+			search(from)
+		}
+	}
+}
+
+// complete to expand the word before the cursor by the candidates of
+// Complete: the single candidate followed by a space, or the longest common
+// prefix of several, listing them when the prefix is already typed.
+func (e *LineEditor) complete(line []rune, pos int) ([]rune, int) {
+	if e.Complete == nil {
+		return line, pos
+	}
+
+	head := string(line[:pos])
+	candidates, start := e.Complete(head)
+	if len(candidates) == 0 {
+		return line, pos
+	}
+
+	word := head[start:]
+	completion := commonPrefix(candidates)
+	if len(candidates) == 1 && !strings.HasSuffix(completion, "/") {
+		completion += " "
+	}
+
+	if completion == word && len(candidates) > 1 {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+		return line, pos
+	}
+
+	if !strings.HasPrefix(completion, word) {
+		return line, pos
+	}
+	insert := []rune(completion[len(word):])
+	line = append(line[:pos], append(insert, line[pos:]...)...)
+	return line, pos + len(insert)
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// AddHistory to append line to the history, skipping blank lines and
+// repeats of the previous line. It is appended to the history file, if any,
+// which is rewritten when the history is truncated to MaxHistory.
+func (e *LineEditor) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if e.Redact != nil {
+		line = e.Redact(line)
+	}
+	if n := len(e.History); n > 0 && e.History[n-1] == line {
+		return
+	}
+
+	e.History = append(e.History, line)
+	if len(e.History) > MaxHistory {
+		e.History = e.History[len(e.History)-MaxHistory:]
+		e.writeHistory()
+		return
+	}
+
+	if e.historyFile != "" {
+		file, err := os.OpenFile(e.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return
+		}
+		defer file.Close()
+		fmt.Fprintln(file, line)
+	}
+}
+
+// writeHistory to replace the history file, if any, by the history.
+func (e *LineEditor) writeHistory() {
+	if e.historyFile == "" {
+		return
+	}
+	tmp := e.historyFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(e.History, "\n")+"\n"), 0600); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, e.historyFile); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// LoadHistory to read the history of previous sessions from path, which
+// further lines are then appended to.
+func (e *LineEditor) LoadHistory(path string) error {
+	e.historyFile = path
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			e.History = append(e.History, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(e.History) > MaxHistory {
+		e.History = e.History[len(e.History)-MaxHistory:]
+		e.writeHistory()
+	}
+	return nil
+}
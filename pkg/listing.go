@@ -0,0 +1,333 @@
+package pkg
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SortRow holds the sortable fields of a folder or file.
+type SortRow struct {
+	Name        string
+	Description string
+	CreatedAt   time.Time
+	ModifiedAt  time.Time
+	Seq         uint64
+	FileCount   int
+	// Size is the size of a file, or the total size of the files of a folder.
+	Size int64
+}
+
+func folderRow(folder *Folder) SortRow {
+	row := SortRow{
+		Name:        folder.Name,
+		Description: folder.Description,
+		CreatedAt:   folder.CreatedAt,
+		ModifiedAt:  folder.ModifiedAt,
+		Seq:         folder.Seq,
+		FileCount:   len(folder.Files),
+	}
+	for _, file := range folder.Files {
+		row.Size += file.Size
+	}
+	return row
+}
+
+func fileRow(file *File) SortRow {
+	return SortRow{
+		Name:        file.Name,
+		Description: file.Description,
+		CreatedAt:   file.CreatedAt,
+		ModifiedAt:  file.ModifiedAt,
+		Seq:         file.Seq,
+		Size:        file.Size,
+	}
+}
+
+// SortKeys are the keys accepted by `--sort`, with whether they apply to
+// folders and to files.
+var SortKeys = map[string]struct{ Folders, Files bool }{
+	"name":        {true, true},
+	"created":     {true, true},
+	"modified":    {true, true},
+	"description": {true, true},
+	"files":       {true, false},
+	"size":        {true, true},
+}
+
+// SortKey is one key of a multi-key sort, e.g. `created:desc`.
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSortKeys to parse a comma-separated list of keys, each optionally
+// suffixed by `:asc` or `:desc`. Keys without a suffix use order.
+func ParseSortKeys(spec, order string) ([]SortKey, bool) {
+	var keys []SortKey
+	for _, part := range strings.Split(spec, ",") {
+		field, dir, hasDir := strings.Cut(part, ":")
+		if _, ok := SortKeys[field]; !ok {
+			return nil, false
+		}
+		if !hasDir {
+			dir = order
+		}
+		if dir != "asc" && dir != "desc" {
+			return nil, false
+		}
+		keys = append(keys, SortKey{Field: field, Desc: dir == "desc"})
+	}
+	return keys, true
+}
+
+// compareNames to compare names byte-wise, case-insensitively or naturally
+// (digit runs compared by value, so `file2` < `file10`).
+func compareNames(a, b string, natural, ignoreCase bool) int {
+	if ignoreCase || natural {
+		a, b = strings.ToLower(a), strings.ToLower(b)
+	}
+	if !natural {
+		return strings.Compare(a, b)
+	}
+
+	for a != "" && b != "" {
+		ra, rb := rune(a[0]), rune(b[0])
+		if unicode.IsDigit(ra) && unicode.IsDigit(rb) {
+			da, db := digitPrefix(a), digitPrefix(b)
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) - len(nb)
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if ra != rb {
+			return int(ra) - int(rb)
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) - len(b)
+}
+
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// compareRows to compare two rows by keys, which must end with `name` for the
+// order to be total.
+func compareRows(a, b SortRow, keys []SortKey, opts ListOptions) int {
+	for _, key := range keys {
+		var c int
+		switch key.Field {
+		case "name":
+			c = compareNames(a.Name, b.Name, opts.Natural, opts.IgnoreCase)
+			if c == 0 {
+				c = strings.Compare(a.Name, b.Name)
+			}
+		case "description":
+			c = compareNames(a.Description, b.Description, opts.Natural, opts.IgnoreCase)
+		case "created":
+			c = a.CreatedAt.Compare(b.CreatedAt)
+			if c == 0 {
+				c = cmp.Compare(a.Seq, b.Seq)
+			}
+		case "modified":
+			c = a.ModifiedAt.Compare(b.ModifiedAt)
+		case "files":
+			c = a.FileCount - b.FileCount
+		case "size":
+			c = cmp.Compare(a.Size, b.Size)
+		}
+		if key.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// ParseSince to parse the value of `--created-since`/`--created-before`: a
+// duration back from now (`90m`, `36h`, `7d`, `2w`) or a date (`2024-08-01`).
+func ParseSince(value string, now time.Time) (time.Time, bool) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, true
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, true
+	}
+
+	if n := len(value); n > 1 && (value[n-1] == 'd' || value[n-1] == 'w') {
+		count, err := strconv.Atoi(value[:n-1])
+		if err != nil || count < 0 {
+			return time.Time{}, false
+		}
+		days := count
+		if value[n-1] == 'w' {
+			days *= 7
+		}
+		return now.AddDate(0, 0, -days), true
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return time.Time{}, false
+	}
+	return now.Add(-d), true
+}
+
+func encodeCursor(row SortRow) string {
+	data, _ := json.Marshal(row)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string) (SortRow, bool) {
+	var row SortRow
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return row, false
+	}
+	return row, json.Unmarshal(data, &row) == nil
+}
+
+// selectRows to filter, sort and paginate rows in place, returning the
+// indexes of the selected rows and the cursor of the next page, if any.
+func selectRows(rows []SortRow, opts ListOptions) ([]int, string, error) {
+	keys, ok := ParseSortKeys(opts.SortBy, opts.Order)
+	if !ok {
+		return nil, "", fmt.Errorf("invalid sort keys %q", opts.SortBy)
+	}
+	keys = append(keys, SortKey{Field: "name"})
+
+	var idx []int
+	for i, row := range rows {
+		if !opts.CreatedSince.IsZero() && row.CreatedAt.Before(opts.CreatedSince) {
+			continue
+		}
+		if !opts.CreatedBefore.IsZero() && !row.CreatedAt.Before(opts.CreatedBefore) {
+			continue
+		}
+		idx = append(idx, i)
+	}
+
+	sort.SliceStable(idx, func(i, j int) bool {
+		return compareRows(rows[idx[i]], rows[idx[j]], keys, opts) < 0
+	})
+
+	if opts.Cursor != "" {
+		after, ok := decodeCursor(opts.Cursor)
+		if !ok {
+			return nil, "", fmt.Errorf("invalid cursor %q", opts.Cursor)
+		}
+		start := sort.Search(len(idx), func(i int) bool {
+			return compareRows(rows[idx[i]], after, keys, opts) > 0
+		})
+		idx = idx[start:]
+	}
+
+	if opts.Offset > 0 {
+		if opts.Offset >= len(idx) {
+			return nil, "", nil
+		}
+		idx = idx[opts.Offset:]
+	}
+
+	next := ""
+	if opts.Limit > 0 && len(idx) > opts.Limit {
+		idx = idx[:opts.Limit]
+		next = encodeCursor(rows[idx[len(idx)-1]])
+	}
+	return idx, next, nil
+}
+
+// QueryFolders returns the folders of a user matching the tags and time
+// filters of opts, sorted and paginated, with the cursor of the next page.
+func (s *System) QueryFolders(username string, opts ListOptions) ([]*Folder, string, RespondType) {
+	user := s.GetUser(username)
+	if user == nil {
+		return nil, "", ErrNotExists
+	}
+
+	var folders []*Folder
+	var rows []SortRow
+	for _, folder := range user.GetFolders() {
+		if folder.HasTags(opts.Tags) {
+			folders = append(folders, folder)
+			rows = append(rows, folderRow(folder))
+		}
+	}
+	if !validSortKeys(opts.SortBy, true) {
+		return nil, "", ErrInvalidFlag
+	}
+
+	idx, next, err := selectRows(rows, opts)
+	if err != nil {
+		return nil, "", ErrInvalidFlag
+	}
+	selected := make([]*Folder, len(idx))
+	for i, j := range idx {
+		selected[i] = folders[j]
+	}
+	return selected, next, Succeed
+}
+
+// QueryFiles returns the files of a folder matching the tags and time filters
+// of opts, sorted and paginated, with the cursor of the next page.
+func (s *System) QueryFiles(username, foldername string, opts ListOptions) ([]*File, string, RespondType) {
+	user := s.GetUser(username)
+	if user == nil {
+		return nil, "", ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		return nil, "", ErrNotExists
+	}
+
+	var files []*File
+	var rows []SortRow
+	for _, file := range folder.GetFiles() {
+		if file.HasTags(opts.Tags) {
+			files = append(files, file)
+			rows = append(rows, fileRow(file))
+		}
+	}
+	if !validSortKeys(opts.SortBy, false) {
+		return nil, "", ErrInvalidFlag
+	}
+
+	idx, next, err := selectRows(rows, opts)
+	if err != nil {
+		return nil, "", ErrInvalidFlag
+	}
+	selected := make([]*File, len(idx))
+	for i, j := range idx {
+		selected[i] = files[j]
+	}
+	return selected, next, Succeed
+}
+
+func validSortKeys(spec string, folders bool) bool {
+	for _, part := range strings.Split(spec, ",") {
+		field, _, _ := strings.Cut(part, ":")
+		key, ok := SortKeys[field]
+		if !ok || (folders && !key.Folders) || (!folders && !key.Files) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,168 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	ManTitle   = "Virtual File System"
+	ManVersion = "Virtual File System 1.0"
+	ManDate    = "August 2024"
+
+	manSummary     = "a CLI file system."
+	manSynopsis    = "[-h | --help] [--store path] [-f script [--stop-on-error]] [command] [options]"
+	manDescription = "This is a pure CLI file system written in Go. The system is used to deal with three types of management: User, Folder, and File."
+
+	helpWidth = 117
+)
+
+// ManOption is a command-line option of the vfs program itself.
+type ManOption struct {
+	Usage   string
+	Summary string
+}
+
+// ManOptions are the program options listed in the OPTIONS section.
+var ManOptions = []ManOption{
+	{"-h, --help", "Show help options."},
+	{"gen-man [path]?", "Write this manual page to path (default ./vfs.1) and exit."},
+	{"--store [path]", "Load and save the state at path, and the file contents in the path.blobs directory. Defaults to $VFS_STORE, then ./vfs.json."},
+	{"--db [path]", "Keep the users, folders and files in an on-disk key/value store at path, written on every change; the --store snapshot then keeps the webhooks only, and its users are moved into the store once. Defaults to $VFS_DB."},
+	{"-f [script]", "Run the commands of script, one per line, instead of the interactive prompt. Blank lines and lines starting with # are skipped."},
+	{"--stop-on-error", "Stop a script at the first failing command."},
+	{"--audit [path]", "Append every command and every change made through the API to the audit log at path, rotated past 1 MiB. Defaults to $VFS_AUDIT, then ./vfs.audit.jsonl; empty disables it."},
+	{"[command] [options]", "Run a single command against the store and exit."},
+}
+
+// ManExitStatus describes the exit codes of the vfs program.
+var ManExitStatus = []ManOption{
+	{fmt.Sprint(ExitOK), "Success, including warnings such as an empty listing."},
+	{fmt.Sprint(ExitFailure), "Failure to load or save the store or to read a script, a wrong passphrase, a locked user or problems found by fsck."},
+	{fmt.Sprint(ExitUsage), "Usage error: unknown command, invalid flags, arguments or names."},
+	{fmt.Sprint(ExitNotFound), "A user, folder or file does not exist."},
+	{fmt.Sprint(ExitConflict), "A user, folder or file already exists, or a transaction cannot commit."},
+}
+
+// GenManPage renders the roff man page of the commands of r.
+func GenManPage(r *Registry) string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, ".TH %q 1 %q %q \"User Commands\"\n", ManTitle, ManDate, ManVersion)
+	sb.WriteString(".SH NAME\n")
+	fmt.Fprintf(&sb, "%s \\- %s\n", ManTitle, manSummary)
+	sb.WriteString(".SH SYNOPSIS\n")
+	sb.WriteString(".B vfs\n")
+	sb.WriteString(roffEscape(manSynopsis) + "\n")
+	sb.WriteString(".SH DESCRIPTION\n")
+	sb.WriteString(roffEscape(manDescription) + "\n")
+
+	sb.WriteString(".SH COMMANDS\n")
+	for _, cmd := range r.Commands() {
+		sb.WriteString(".TP\n")
+		sb.WriteString(".B " + roffEscape(cmd.Usage()) + "\n")
+		sb.WriteString(roffEscape(cmd.Summary()) + "\n")
+	}
+
+	sb.WriteString(".SH OPTIONS\n")
+	for _, opt := range ManOptions {
+		sb.WriteString(".TP\n")
+		sb.WriteString(".B " + roffEscape(opt.Usage) + "\n")
+		sb.WriteString(roffEscape(opt.Summary) + "\n")
+	}
+
+	sb.WriteString(".SH EXIT STATUS\n")
+	for _, status := range ManExitStatus {
+		sb.WriteString(".TP\n")
+		sb.WriteString(".B " + status.Usage + "\n")
+		sb.WriteString(roffEscape(status.Summary) + "\n")
+	}
+
+	return sb.String()
+}
+
+// roffEscape escapes backslashes and option dashes for roff.
+func roffEscape(text string) string {
+	text = strings.ReplaceAll(text, `\`, `\e`)
+	return strings.ReplaceAll(text, "-", `\-`)
+}
+
+// WriteManPage to write the man page of the default commands to path.
+func WriteManPage(path string) error {
+	return os.WriteFile(path, []byte(GenManPage(DefaultCommands())), 0644)
+}
+
+// GetHelpInfo renders the plain-text fallback of the man page.
+func GetHelpInfo() string {
+	var sb strings.Builder
+
+	title := ManTitle + "(1)"
+	sb.WriteString("\n" + spread(helpWidth, title, "User Commands", title) + "\n\n\n")
+
+	sb.WriteString("NAME\n")
+	sb.WriteString(indentWrap(ManTitle+" - "+manSummary, 7))
+	sb.WriteString("\nSYNOPSIS\n")
+	sb.WriteString(indentWrap("vfs "+manSynopsis, 7))
+	sb.WriteString("\nDESCRIPTION\n")
+	sb.WriteString(indentWrap(manDescription, 7))
+
+	sb.WriteString("\nCOMMANDS\n")
+	for i, cmd := range DefaultCommands().Commands() {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString("       " + cmd.Usage() + "\n")
+		sb.WriteString(indentWrap(cmd.Summary(), 14))
+	}
+
+	sb.WriteString("\nOPTIONS\n")
+	for i, opt := range ManOptions {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(indentWrap(opt.Usage, 7))
+		sb.WriteString(indentWrap(opt.Summary, 14))
+	}
+
+	sb.WriteString("\nEXIT STATUS\n")
+	for i, status := range ManExitStatus {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(indentWrap(status.Usage, 7))
+		sb.WriteString(indentWrap(status.Summary, 14))
+	}
+
+	sb.WriteString("\n" + spread(helpWidth, ManVersion, ManDate, title) + "\n")
+	return sb.String()
+}
+
+// indentWrap wraps text to helpWidth columns, indenting every line.
+func indentWrap(text string, indent int) string {
+	var sb strings.Builder
+	pad := strings.Repeat(" ", indent)
+
+	line := ""
+	for _, word := range strings.Fields(text) {
+		if line != "" && indent+len(line)+1+len(word) > helpWidth {
+			sb.WriteString(pad + line + "\n")
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	sb.WriteString(pad + line + "\n")
+	return sb.String()
+}
+
+// spread lays out left, center and right within width columns.
+func spread(width int, left, center, right string) string {
+	gap := width - len(left) - len(center) - len(right)
+	if gap < 2 {
+		gap = 2
+	}
+	return left + strings.Repeat(" ", gap/2) + center + strings.Repeat(" ", gap-gap/2) + right
+}
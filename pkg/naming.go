@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Rules of a NamingPolicy, as named by the errors of the names breaking them.
+const (
+	RuleEmpty     = "empty"
+	RuleSeparator = "separator"
+	RuleNFC       = "nfc"
+	RuleReserved  = "reserved"
+	RuleLength    = "max-length"
+	RuleChars     = "chars"
+	RuleLeading   = "leading"
+	RuleTrailing  = "trailing"
+)
+
+// Separators are the characters no name holds, whatever its policy: a name is
+// a single entry of a host directory on import and export.
+const Separators = "/\\\x00"
+
+// NamingPolicy is the rules the names of users, folders or files follow.
+type NamingPolicy struct {
+	// Letters and Digits allow the ASCII letters and digits, or with Unicode
+	// those of every script, letters coming with their combining marks.
+	// Chars lists the other allowed characters.
+	Letters bool
+	Digits  bool
+	Unicode bool
+	Chars   string
+	// MaxLength is the maximum number of characters, 0 for no limit.
+	MaxLength int
+	// Reserved are names which cannot be taken, whatever their case.
+	Reserved []string
+	// NoLeading and NoTrailing are characters a name cannot start or end with.
+	NoLeading  string
+	NoTrailing string
+	// NFC normalizes names to their composed form before they are checked, so
+	// that `é` typed as `e` and an accent names the same folder.
+	NFC bool
+}
+
+// DefaultNamingPolicy returns the policy of the names of CharsValidator:
+// ASCII letters, digits and _.
+func DefaultNamingPolicy() *NamingPolicy {
+	return &NamingPolicy{Letters: true, Digits: true, Chars: "_", Reserved: []string{".", ".."}}
+}
+
+// NameError is a name breaking a rule of a NamingPolicy.
+type NameError struct {
+	Name   string
+	Rule   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("%s breaks the %s rule: %s", e.Name, e.Rule, e.Reason)
+}
+
+// Normalize returns name in the form the policy stores it.
+func (p *NamingPolicy) Normalize(name string) string {
+	if p != nil && p.NFC {
+		return norm.NFC.String(name)
+	}
+	return name
+}
+
+// Check returns the first rule name breaks, nil when it follows the policy.
+func (p *NamingPolicy) Check(name string) *NameError {
+	fail := func(rule, format string, args ...any) *NameError {
+		return &NameError{Name: name, Rule: rule, Reason: fmt.Sprintf(format, args...)}
+	}
+	if name == "" {
+		return fail(RuleEmpty, "a name cannot be empty")
+	}
+	if i := strings.IndexAny(name, Separators); i >= 0 {
+		return fail(RuleSeparator, "%q separates paths", name[i])
+	}
+	if p.NFC && !norm.NFC.IsNormalString(name) {
+		return fail(RuleNFC, "it is not in NFC form")
+	}
+	for _, reserved := range p.Reserved {
+		if strings.EqualFold(name, reserved) {
+			return fail(RuleReserved, "%q is reserved", reserved)
+		}
+	}
+	if n := utf8.RuneCountInString(name); p.MaxLength > 0 && n > p.MaxLength {
+		return fail(RuleLength, "%d characters is more than %d", n, p.MaxLength)
+	}
+	for _, r := range name {
+		if !p.allows(r) {
+			return fail(RuleChars, "%q is not %s", r, p.allowed())
+		}
+	}
+	if first, _ := utf8.DecodeRuneInString(name); strings.ContainsRune(p.NoLeading, first) {
+		return fail(RuleLeading, "it cannot start with %q", first)
+	}
+	if last, _ := utf8.DecodeLastRuneInString(name); strings.ContainsRune(p.NoTrailing, last) {
+		return fail(RuleTrailing, "it cannot end with %q", last)
+	}
+	return nil
+}
+
+func (p *NamingPolicy) allows(r rune) bool {
+	switch {
+	case strings.ContainsRune(Separators, r):
+		return false
+	case strings.ContainsRune(p.Chars, r):
+		return true
+	case p.Unicode:
+		return (p.Letters && (unicode.IsLetter(r) || unicode.IsMark(r))) || (p.Digits && unicode.IsDigit(r))
+	default:
+		return (p.Letters && ('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')) || (p.Digits && '0' <= r && r <= '9')
+	}
+}
+
+// allowed describes the allowed characters, e.g. `a letter, a digit or one of _-`.
+func (p *NamingPolicy) allowed() string {
+	var classes []string
+	ascii := "an ASCII "
+	if p.Unicode {
+		ascii = "a "
+	}
+	if p.Letters {
+		classes = append(classes, ascii+"letter")
+	}
+	if p.Digits {
+		classes = append(classes, ascii+"digit")
+	}
+	if p.Chars != "" {
+		classes = append(classes, "one of "+p.Chars)
+	}
+	switch len(classes) {
+	case 0:
+		return "allowed"
+	case 1:
+		return classes[0]
+	}
+	return strings.Join(classes[:len(classes)-1], ", ") + " or " + classes[len(classes)-1]
+}
+
+// Sanitize returns name with the characters the policy does not allow
+// replaced by _, or dropped when _ is not allowed either, then trimmed of the
+// leading and trailing characters it forbids and cut to its maximum length.
+func (p *NamingPolicy) Sanitize(name string) string {
+	name = p.Normalize(name)
+	var sb strings.Builder
+	for _, r := range name {
+		if p.allows(r) {
+			sb.WriteRune(r)
+		} else if p.allows('_') {
+			sb.WriteRune('_')
+		}
+	}
+	name = strings.TrimLeft(sb.String(), p.NoLeading)
+	name = strings.TrimRight(name, p.NoTrailing)
+	if runes := []rune(name); p.MaxLength > 0 && len(runes) > p.MaxLength {
+		name = strings.TrimRight(string(runes[:p.MaxLength]), p.NoTrailing)
+	}
+	return name
+}
+
+// validName returns name normalized by policy, or the rule it breaks. Without
+// a policy, names follow CharsValidator.
+func (s *System) validName(policy *NamingPolicy, name string) (string, *NameError) {
+	if policy == nil {
+		if !s.CharsValidator.MatchString(name) {
+			return name, &NameError{Name: name, Rule: RuleChars, Reason: fmt.Sprintf("it does not match %s", s.CharsValidator)}
+		}
+		if i := strings.IndexAny(name, Separators); i >= 0 {
+			return name, &NameError{Name: name, Rule: RuleSeparator, Reason: fmt.Sprintf("%q separates paths", name[i])}
+		}
+		return name, nil
+	}
+	name = policy.Normalize(name)
+	return name, policy.Check(name)
+}
+
+// validateName to print on ew the rule name breaks, returning name normalized by policy.
+func (s *System) validateName(ew io.Writer, policy *NamingPolicy, name string) (string, RespondType) {
+	name, err := s.validName(policy, name)
+	if err != nil {
+		fmt.Fprintln(ew, ErrInvalidName.ToString(err.Error()))
+		return name, ErrInvalidName
+	}
+	return name, Succeed
+}
+
+// normalizeArgs returns args with the user, folder and file names normalized
+// by their policy, so that a command finds the records named in another form.
+func (s *System) normalizeArgs(cmd Command, args []string) []string {
+	var normalized []string
+	for spec, i := range bindArgIndexes(cmd.ArgSpec(), args) {
+		var name string
+		switch spec {
+		case "username":
+			name = s.UserPolicy.Normalize(args[i])
+		case "foldername", "new-folder-name", "dest-foldername":
+			name = s.FolderPolicy.Normalize(args[i])
+		case "filename":
+			name = s.FilePolicy.Normalize(args[i])
+		case "foldername[/filename]":
+			foldername, filename := SplitPath(args[i])
+			name = joinPath(s.FolderPolicy.Normalize(foldername), s.FilePolicy.Normalize(filename))
+		default:
+			continue
+		}
+		if name != args[i] {
+			if normalized == nil {
+				normalized = append([]string(nil), args...)
+			}
+			normalized[i] = name
+		}
+	}
+	if normalized == nil {
+		return args
+	}
+	return normalized
+}
@@ -0,0 +1,325 @@
+package pkg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const DefaultTimeFormat = "2006-01-02 15:04:05"
+
+// OutputFormats are the values accepted by `--output`. The empty format is the
+// historical space-separated output of ToString.
+var OutputFormats = []string{"table", "json", "csv", "tsv"}
+
+// TimeFormatAliases are the names accepted by `--time-format` besides a Go time layout.
+var TimeFormatAliases = map[string]string{
+	"rfc3339": time.RFC3339,
+	"iso8601": "2006-01-02T15:04:05Z07:00",
+	"date":    "2006-01-02",
+	"kitchen": time.Kitchen,
+}
+
+// OutputOptions holds how the listing commands render their rows.
+type OutputOptions struct {
+	Format     string
+	TimeFormat string
+	Location   *time.Location
+}
+
+// parseOutputFlag to consume an output flag and its value at args[i], returning
+// whether args[i] was one and the index of the last consumed argument.
+func parseOutputFlag(opts *OutputOptions, args []string, i int) (bool, int, string) {
+	switch args[i] {
+	case "--output", "--time-format", "--tz":
+	default:
+		return false, i, ""
+	}
+	if i+1 >= len(args) {
+		return true, i, ErrInvalidFlag.ToString()
+	}
+	value := args[i+1]
+
+	switch args[i] {
+	case "--output":
+		if !contains(OutputFormats, value) {
+			return true, i, ErrInvalidFlag.ToString()
+		}
+		opts.Format = value
+	case "--time-format":
+		if layout, ok := TimeFormatAliases[value]; ok {
+			value = layout
+		}
+		opts.TimeFormat = value
+	case "--tz":
+		loc, err := time.LoadLocation(value)
+		if err != nil {
+			return true, i, ErrInvalidFlag.ToString()
+		}
+		opts.Location = loc
+	}
+	return true, i + 1, ""
+}
+
+// ParseOutputArgs to extract [--output format] [--time-format layout] [--tz zone] from args, returning the other arguments.
+func ParseOutputArgs(args []string) (OutputOptions, []string, string) {
+	var opts OutputOptions
+	var rest []string
+
+	for i := 0; i < len(args); i++ {
+		ok, last, msg := parseOutputFlag(&opts, args, i)
+		if msg != "" {
+			return OutputOptions{}, nil, msg
+		}
+		if !ok {
+			rest = append(rest, args[i])
+		}
+		i = last
+	}
+	return opts, rest, ""
+}
+
+// OutputOptions returns the output flags bound in args, or the error message
+// of an invalid value.
+func (a *Args) OutputOptions() (OutputOptions, string) {
+	var opts OutputOptions
+	for _, name := range []string{"--output", "--time-format", "--tz"} {
+		for _, value := range a.flags[name] {
+			if _, _, msg := parseOutputFlag(&opts, []string{name, value}, 0); msg != "" {
+				return OutputOptions{}, msg
+			}
+		}
+	}
+	return opts, ""
+}
+
+func contains(words []string, word string) bool {
+	for _, w := range words {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+// timeSettings returns the time format and zone of opts, falling back to the
+// defaults of the system. A nil zone keeps the zone of each time.
+func (s *System) timeSettings(opts OutputOptions) (string, *time.Location) {
+	layout := opts.TimeFormat
+	if layout == "" {
+		layout = s.TimeFormat
+	}
+	if layout == "" {
+		layout = DefaultTimeFormat
+	}
+
+	loc := opts.Location
+	if loc == nil {
+		loc = s.Location
+	}
+	return layout, loc
+}
+
+// FormatTime to format t with the time format and zone of opts.
+func (s *System) FormatTime(t time.Time, opts OutputOptions) string {
+	layout, loc := s.timeSettings(opts)
+	return formatTime(t, layout, loc)
+}
+
+func formatTime(t time.Time, layout string, loc *time.Location) string {
+	if loc != nil {
+		t = t.In(loc)
+	}
+	return t.Format(layout)
+}
+
+// Column is one named field of the rows written by WriteRows.
+type Column struct {
+	Name  string
+	Value func(row any) any
+}
+
+// WriteRows to render rows in the format of opts. Values may be strings,
+// numbers, time.Time, tag lists ([]string) or metadata (map[string]string).
+// JSON objects use the column names as keys, in column order; the other
+// formats start with a header row.
+func (s *System) WriteRows(w io.Writer, opts OutputOptions, columns []Column, rows []any) error {
+	if opts.Format == "json" {
+		return s.writeJSON(w, opts, columns, rows)
+	}
+
+	records := make([][]string, 0, len(rows)+1)
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+	records = append(records, header)
+	for _, row := range rows {
+		record := make([]string, len(columns))
+		for i, col := range columns {
+			record[i] = s.formatValue(col.Value(row), opts)
+		}
+		records = append(records, record)
+	}
+
+	switch opts.Format {
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.WriteAll(records)
+		return cw.Error()
+
+	case "tsv":
+		escaper := strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r")
+		for _, record := range records {
+			for i := range record {
+				record[i] = escaper.Replace(record[i])
+			}
+			if _, err := fmt.Fprintln(w, strings.Join(record, "\t")); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		var sb strings.Builder
+		tw := tabwriter.NewWriter(&sb, 0, 0, 2, ' ', 0)
+		for i, record := range records {
+			if i == 0 {
+				for j := range record {
+					record[j] = strings.ToUpper(record[j])
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(record, "\t"))
+		}
+		tw.Flush()
+
+		for _, line := range strings.SplitAfter(sb.String(), "\n") {
+			if line == "" {
+				continue
+			}
+			if _, err := fmt.Fprintln(w, strings.TrimRight(line, " \n")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (s *System) formatValue(value any, opts OutputOptions) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case time.Time:
+		return s.FormatTime(v, opts)
+	case float64:
+		return fmt.Sprintf("%.3f", v)
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]string:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = key + "=" + v[key]
+		}
+		return strings.Join(pairs, ";")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func (s *System) writeJSON(w io.Writer, opts OutputOptions, columns []Column, rows []any) error {
+	if opts.TimeFormat == "" {
+		opts.TimeFormat = time.RFC3339
+	}
+
+	var sb strings.Builder
+	sb.WriteString("[")
+	for i, row := range rows {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString("\n  {")
+		for j, col := range columns {
+			value := col.Value(row)
+			switch v := value.(type) {
+			case time.Time:
+				value = s.FormatTime(v, opts)
+			case []string:
+				if v == nil {
+					value = []string{}
+				}
+			case map[string]string:
+				if v == nil {
+					value = map[string]string{}
+				}
+			}
+
+			key, _ := json.Marshal(col.Name)
+			data, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			sb.Write(key)
+			sb.WriteString(": ")
+			sb.Write(data)
+		}
+		sb.WriteString("}")
+	}
+	if len(rows) > 0 {
+		sb.WriteString("\n")
+	}
+	sb.WriteString("]\n")
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// FolderColumns are the fields of a folder in the listings.
+var FolderColumns = []Column{
+	{"name", func(row any) any { return row.(*Folder).Name }},
+	{"description", func(row any) any { return row.(*Folder).Description }},
+	{"created_at", func(row any) any { return row.(*Folder).CreatedAt }},
+	{"user", func(row any) any { return row.(*Folder).UserName }},
+	{"tags", func(row any) any { return row.(*Folder).Tags }},
+	{"meta", func(row any) any { return row.(*Folder).Meta }},
+}
+
+// FileColumns are the fields of a file in the listings.
+var FileColumns = []Column{
+	{"name", func(row any) any { return row.(*File).Name }},
+	{"description", func(row any) any { return row.(*File).Description }},
+	{"created_at", func(row any) any { return row.(*File).CreatedAt }},
+	{"folder", func(row any) any { return row.(*File).FolderName }},
+	{"user", func(row any) any { return row.(*File).UserName }},
+	{"size", func(row any) any { return row.(*File).Size }},
+	{"stored_size", func(row any) any { return row.(*File).StoredSize }},
+	{"tags", func(row any) any { return row.(*File).Tags }},
+	{"meta", func(row any) any { return row.(*File).Meta }},
+}
+
+// SearchColumns are the fields of a search hit.
+var SearchColumns = []Column{
+	{"path", func(row any) any { return row.(SearchResult).Path() }},
+	{"user", func(row any) any { return row.(SearchResult).UserName }},
+	{"folder", func(row any) any { return row.(SearchResult).FolderName }},
+	{"file", func(row any) any { return row.(SearchResult).FileName }},
+	{"score", func(row any) any { return row.(SearchResult).Score }},
+}
+
+// MetaColumns are the fields of a metadata entry.
+var MetaColumns = []Column{
+	{"key", func(row any) any { return row.([2]string)[0] }},
+	{"value", func(row any) any { return row.([2]string)[1] }},
+}
@@ -1,8 +1,24 @@
 package pkg
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -25,7 +41,7 @@ func TestUserFolders(t *testing.T) {
 	user := CreateUser(username)
 
 	foldername := "testfolder"
-	folder := CreateFolder(foldername, "", username)
+	folder := CreateFolder(foldername, "", username, testEpoch)
 
 	user.AddFolder(foldername, folder)
 
@@ -45,7 +61,7 @@ func TestFolder(t *testing.T) {
 	desc := "desc for test"
 	username := "testuser"
 
-	folder := CreateFolder(foldername, desc, username)
+	folder := CreateFolder(foldername, desc, username, testEpoch)
 	assert.Equal(t, folder.Name, foldername)
 	assert.Equal(t, len(folder.Files), 0)
 
@@ -59,12 +75,12 @@ func TestFolderFiles(t *testing.T) {
 	desc := "desc for test"
 	username := "testuser"
 
-	folder := CreateFolder(foldername, desc, username)
+	folder := CreateFolder(foldername, desc, username, testEpoch)
 
 	filename1 := "file1"
 	filename2 := "file2"
-	file1 := CreateFile(filename1, "", folder.Name, username)
-	file2 := CreateFile(filename1, "desc of file2", folder.Name, username)
+	file1 := CreateFile(filename1, "", folder.Name, username, testEpoch)
+	file2 := CreateFile(filename1, "desc of file2", folder.Name, username, testEpoch)
 	folder.AddFile(filename1, file1)
 	folder.AddFile(filename2, file2)
 
@@ -83,10 +99,10 @@ func TestUserFolderFile(t *testing.T) {
 
 	user := CreateUser(username)
 
-	folder := CreateFolder(foldername, desc, username)
+	folder := CreateFolder(foldername, desc, username, testEpoch)
 	user.AddFolder(foldername, folder)
 
-	file := CreateFile(filename, desc, foldername, username)
+	file := CreateFile(filename, desc, foldername, username, testEpoch)
 	folder.AddFile(filename, file)
 
 	userFolder := user.GetFolder(foldername)
@@ -113,8 +129,20 @@ func ResetBufs(outBuf, errBuf *bytes.Buffer) {
 	errBuf.Reset()
 }
 
-func TestRegister(t *testing.T) {
+// testEpoch is the time of the clock of the tests.
+var testEpoch = time.Date(2024, 8, 1, 9, 0, 0, 0, time.UTC)
+
+// SetupTestSystem returns the system with a FakeClock stopped at testEpoch,
+// so that the times it prints are known.
+func SetupTestSystem() *System {
 	sys := SetupSystem()
+	sys.Clock = NewFakeClock(testEpoch, 0)
+	sys.Actor = "tester"
+	return sys
+}
+
+func TestRegister(t *testing.T) {
+	sys := SetupTestSystem()
 	defer sys.Reset()
 	outBuf, errBuf := GetTestBufs()
 
@@ -131,12 +159,12 @@ func TestRegister(t *testing.T) {
 	ResetBufs(outBuf, errBuf)
 
 	sys.Register(outBuf, errBuf, "u$er")
-	assert.Equal(t, ErrInvalidChars.ToString("u$er")+"\n", errBuf.String())
+	assert.Equal(t, ErrInvalidName.ToString("u$er breaks the chars rule: '$' is not an ASCII letter, an ASCII digit or one of _")+"\n", errBuf.String())
 	ResetBufs(outBuf, errBuf)
 }
 
 func TestCreateFolder(t *testing.T) {
-	sys := SetupSystem()
+	sys := SetupTestSystem()
 	defer sys.Reset()
 	outBuf, errBuf := GetTestBufs()
 
@@ -151,7 +179,7 @@ func TestCreateFolder(t *testing.T) {
 	}{
 		{"user1", "folder1", "", "Create folder1 successfully.\n", ""},
 		{"user2", "folder1", "", "", ErrNotExists.ToString("user2") + "\n"},
-		{"user1", "fo[]er1", "", "", ErrInvalidChars.ToString("fo[]er1") + "\n"},
+		{"user1", "fo[]er1", "", "", ErrInvalidName.ToString("fo[]er1 breaks the chars rule: '[' is not an ASCII letter, an ASCII digit or one of _") + "\n"},
 	}
 
 	for _, tt := range tests {
@@ -164,7 +192,7 @@ func TestCreateFolder(t *testing.T) {
 }
 
 func TestDeleteFolder(t *testing.T) {
-	sys := SetupSystem()
+	sys := SetupTestSystem()
 	defer sys.Reset()
 	outBuf, errBuf := GetTestBufs()
 
@@ -191,7 +219,7 @@ func TestDeleteFolder(t *testing.T) {
 }
 
 func TestRenameFolder(t *testing.T) {
-	sys := SetupSystem()
+	sys := SetupTestSystem()
 	defer sys.Reset()
 	outBuf, errBuf := GetTestBufs()
 
@@ -208,7 +236,7 @@ func TestRenameFolder(t *testing.T) {
 		{"user1", "folder1", "folder2", "Rename folder1 to folder2 successfully.\n", ""},
 		{"user2", "folder2", "folder3", "", ErrNotExists.ToString("user2") + "\n"},
 		{"user1", "folder3", "folder4", "", WarnNoFolders.ToString("folder3") + "\n"},
-		{"user1", "folder2", "folder+", "", ErrInvalidChars.ToString("folder+") + "\n"},
+		{"user1", "folder2", "folder+", "", ErrInvalidName.ToString("folder+ breaks the chars rule: '+' is not an ASCII letter, an ASCII digit or one of _") + "\n"},
 	}
 
 	for _, tt := range tests {
@@ -218,10 +246,32 @@ func TestRenameFolder(t *testing.T) {
 		ResetBufs(outBuf, errBuf)
 	}
 
+	// the files follow their folder, in memory and in the store
+	sys.Execute("create-file user1 folder2 file1")
+	sys.Execute("rename-folder user1 folder2 folder3")
+	assert.Equal(t, "folder3", sys.GetUser("user1").GetFolder("folder3").GetFile("file1").FolderName)
+	assert.Empty(t, sys.Check().Problems)
+	assert.NoError(t, sys.Open(sys.Store))
+	assert.Equal(t, "folder3", sys.GetUser("user1").GetFolder("folder3").GetFile("file1").FolderName)
+	assert.Empty(t, sys.Check().Problems)
+
+	// a new name in another form of an existing one does not replace it
+	sys.FolderPolicy = &NamingPolicy{Letters: true, Unicode: true, NFC: true}
+	sys.Execute("create-folder user1 caf\u00e9")
+	sys.Execute("create-folder user1 menu")
+	res := sys.RenameFolder(outBuf, errBuf, "user1", "menu", "cafe\u0301")
+	assert.Equal(t, ErrAlreadyExists, res)
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("menu"))
+	assert.Equal(t, "caf\u00e9", sys.GetUser("user1").GetFolder("caf\u00e9").Name)
+	ResetBufs(outBuf, errBuf)
+	res = sys.RenameFolder(outBuf, errBuf, "user1", "menu", "menu")
+	assert.Equal(t, ErrAlreadyExists, res)
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("menu"))
+	ResetBufs(outBuf, errBuf)
 }
 
 func TestCreateFile(t *testing.T) {
-	sys := SetupSystem()
+	sys := SetupTestSystem()
 	defer sys.Reset()
 	outBuf, errBuf := GetTestBufs()
 
@@ -238,7 +288,7 @@ func TestCreateFile(t *testing.T) {
 		{"user1", "folder1", "file1", "Create file1 in user1/folder1 successfully.\n", ""},
 		{"user2", "folder1", "file1", "", ErrNotExists.ToString("user2") + "\n"},
 		{"user1", "folder2", "file1", "", ErrNotExists.ToString("folder2") + "\n"},
-		{"user1", "folder1", "f[]e1", "", ErrInvalidChars.ToString("f[]e1") + "\n"},
+		{"user1", "folder1", "f[]e1", "", ErrInvalidName.ToString("f[]e1 breaks the chars rule: '[' is not an ASCII letter, an ASCII digit or one of _") + "\n"},
 		{"user1", "folder1", "file1", "", ErrAlreadyExists.ToString("file1") + "\n"},
 	}
 
@@ -252,7 +302,7 @@ func TestCreateFile(t *testing.T) {
 }
 
 func TestDeleteFile(t *testing.T) {
-	sys := SetupSystem()
+	sys := SetupTestSystem()
 	defer sys.Reset()
 	outBuf, errBuf := GetTestBufs()
 
@@ -293,6 +343,7 @@ func TestParseArgs(t *testing.T) {
 
 		{[]string{"--sort-name"}, "name", "asc", ""},
 		{[]string{"--sort-created"}, "created", "asc", ""},
+		{[]string{"--sort-modified"}, "modified", "asc", ""},
 
 		{[]string{"asc"}, "name", "asc", ""},
 		{[]string{"desc"}, "name", "desc", ""},
@@ -324,7 +375,7 @@ func TestCharsValidator(t *testing.T) {
 	}
 
 	for _, tt := range tests {
-		sys := SetupSystem()
+		sys := SetupTestSystem()
 		isValid := sys.CharsValidator.MatchString(tt.input)
 
 		if isValid != tt.expectedValid {
@@ -332,3 +383,2701 @@ func TestCharsValidator(t *testing.T) {
 		}
 	}
 }
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"", nil},
+		{"register user1", []string{"register", "user1"}},
+		{"  create-folder   user1 folder1 ", []string{"create-folder", "user1", "folder1"}},
+		{`search user1 "quarterly report" tax`, []string{"search", "user1", "quarterly report", "tax"}},
+		{`create-file user1 folder1 file1 ""`, []string{"create-file", "user1", "folder1", "file1", ""}},
+		{`set-meta user1 folder1 note "say \"hi\" C:\\ \n"`, []string{"set-meta", "user1", "folder1", "note", `say "hi" C:\ \n`}},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, SplitArgs(tt.input))
+	}
+}
+
+func TestSearch(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	sys.Execute("register user1")
+	sys.Execute("register user2")
+	sys.Execute(`create-folder user1 finance "yearly tax papers"`)
+	sys.Execute(`create-file user1 finance report_2023 "quarterly report draft"`)
+	sys.Execute(`create-file user1 finance report_2024 "draft quarterly"`)
+	sys.Execute(`create-file user1 finance invoice "tax invoice"`)
+	sys.Execute(`create-folder user2 finance "tax"`)
+
+	tests := []struct {
+		query       []string
+		expectedOut []string
+		expectedErr string
+	}{
+		{[]string{"quarterly"}, []string{"user1/finance/report_2023", "user1/finance/report_2024"}, ""},
+		{[]string{"quarterly report"}, []string{"user1/finance/report_2023"}, ""},
+		{[]string{"draft", "2024"}, []string{"user1/finance/report_2024"}, ""},
+		{[]string{"tax"}, []string{"user1/finance", "user1/finance/invoice"}, ""},
+		{[]string{"invoice", "OR", "2023"}, []string{"user1/finance/invoice", "user1/finance/report_2023"}, ""},
+		{[]string{"missing"}, nil, WarnNoMatches.ToString() + "\n"},
+	}
+
+	for _, tt := range tests {
+		sys.Search(outBuf, errBuf, "user1", tt.query, OutputOptions{})
+
+		var paths []string
+		for _, line := range strings.Split(strings.TrimSpace(outBuf.String()), "\n") {
+			if line != "" {
+				paths = append(paths, strings.Fields(line)[0])
+			}
+		}
+		assert.ElementsMatch(t, tt.expectedOut, paths, tt.query)
+		assert.Equal(t, tt.expectedErr, errBuf.String())
+		ResetBufs(outBuf, errBuf)
+	}
+
+	sys.Execute("rename-folder user1 finance money")
+	sys.Execute("delete-file user1 money invoice")
+	sys.Execute(`set-description user1 money report_2024 "final"`)
+
+	results := sys.Index.Search("user1", []string{"quarterly"})
+	assert.Len(t, results, 1)
+	assert.Equal(t, "user1/money/report_2023", results[0].Path())
+	assert.Empty(t, sys.Index.Search("user1", []string{"invoice"}))
+
+	sys.Execute("delete-folder user1 money")
+	assert.Empty(t, sys.Index.Search("user1", []string{"report"}))
+
+	sys.Index.Rebuild(sys.UserTable)
+	assert.Len(t, sys.Index.Search("user2", []string{"tax"}), 1)
+
+	// contents are indexed once written, and follow their folder
+	sys.Execute("create-folder user1 notes")
+	sys.Execute("create-file user1 notes todo")
+	sys.Execute(`write-file user1 notes todo "Buy milk, then call Alice"`)
+	results = sys.Index.Search("user1", []string{"call alice"})
+	assert.Len(t, results, 1)
+	assert.Equal(t, "user1/notes/todo", results[0].Path())
+	sys.Execute(`write-file user1 notes todo "Call Bob"`)
+	assert.Empty(t, sys.Index.Search("user1", []string{"alice"}))
+	sys.Execute("rename-folder user1 notes later")
+	sys.Execute(`set-description user1 later todo "weekend"`)
+	results = sys.Index.Search("user1", []string{"bob", "weekend"})
+	assert.Len(t, results, 1)
+	assert.Equal(t, "user1/later/todo", results[0].Path())
+	sys.Execute("delete-folder user1 later")
+	assert.Empty(t, sys.Index.Search("user1", []string{"bob"}))
+	assert.Empty(t, sys.Index.folders)
+}
+
+func TestTokenizeReader(t *testing.T) {
+	for _, text := range []string{"", "  ", "report_2024", "Ünïcode, MIXED case!", "tail"} {
+		terms := tokenizeReader(iotest.OneByteReader(strings.NewReader(text)))
+		assert.Equal(t, strings.Join(Tokenize(text), " "), strings.Join(terms, " "), text)
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	idx := NewIndex()
+	folder := CreateFolder("docs", "", "user1", testEpoch)
+	idx.AddFile(folder, CreateFile("a", "go go go notes", "docs", "user1", testEpoch))
+	idx.AddFile(folder, CreateFile("b", "go notes", "docs", "user1", testEpoch))
+	idx.AddFile(folder, CreateFile("c", "rust notes", "docs", "user1", testEpoch))
+
+	results := idx.Search("user1", []string{"go"})
+	assert.Len(t, results, 2)
+	assert.Equal(t, "user1/docs/a", results[0].Path())
+	assert.Greater(t, results[0].Score, results[1].Score)
+}
+
+func TestParseListArgs(t *testing.T) {
+	opts, msg := ParseListArgs([]string{"--tag", "work", "--sort-created", "desc", "--tag", "urgent"}, testEpoch)
+	assert.Equal(t, "", msg)
+	assert.Equal(t, ListOptions{SortBy: "created", Order: "desc", Tags: []string{"work", "urgent"}}, opts)
+
+	_, msg = ParseListArgs([]string{"--tag"}, testEpoch)
+	assert.Equal(t, ErrInvalidFlag.ToString(), msg)
+}
+
+func TestLabels(t *testing.T) {
+	var labels Labels
+	assert.Equal(t, "", labels.ToString())
+
+	labels.AddTag("work")
+	labels.AddTag("alpha")
+	labels.AddTag("work")
+	assert.Equal(t, []string{"alpha", "work"}, labels.Tags)
+	assert.True(t, labels.HasTags([]string{"work", "alpha"}))
+	assert.False(t, labels.HasTags([]string{"work", "beta"}))
+
+	labels.SetMeta("owner", "bob")
+	labels.SetMeta("env", "prod")
+	assert.Equal(t, "#alpha #work env=prod owner=bob", labels.ToString())
+
+	labels.RemoveTag("alpha")
+	assert.Equal(t, []string{"work"}, labels.Tags)
+}
+
+func TestTagsAndMeta(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 folder1")
+	sys.Execute("create-folder user1 folder2")
+	sys.Execute("create-file user1 folder1 file1")
+	sys.Execute("create-file user1 folder1 file2")
+
+	sys.Tag(outBuf, errBuf, "user1", "folder1", []string{"work", "urgent"})
+	assert.Equal(t, "Tag user1/folder1 successfully.\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.Tag(outBuf, errBuf, "user1", "folder1/file2", []string{"work"})
+	sys.Tag(outBuf, errBuf, "user1", "folder1/file3", []string{"work"})
+	assert.Equal(t, ErrNotExists.ToString("file3")+"\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.Tag(outBuf, errBuf, "user1", "folder1", []string{"b@d"})
+	assert.Equal(t, ErrInvalidChars.ToString("b@d")+"\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.ListFolders(outBuf, errBuf, "user1", ListOptions{SortBy: "name", Order: "asc", Tags: []string{"work"}})
+	assert.Equal(t, 1, strings.Count(outBuf.String(), "\n"))
+	assert.True(t, strings.HasPrefix(outBuf.String(), "folder1 "))
+	assert.Contains(t, outBuf.String(), "#urgent #work")
+	ResetBufs(outBuf, errBuf)
+
+	sys.ListFiles(outBuf, errBuf, "user1", "folder1", ListOptions{SortBy: "name", Order: "asc", Tags: []string{"work"}})
+	assert.True(t, strings.HasPrefix(outBuf.String(), "file2 "))
+	assert.Equal(t, 1, strings.Count(outBuf.String(), "\n"))
+	ResetBufs(outBuf, errBuf)
+
+	sys.Untag(outBuf, errBuf, "user1", "folder1", []string{"urgent"})
+	assert.Equal(t, []string{"work"}, sys.UserTable["user1"].Folders["folder1"].Tags)
+	sys.Untag(outBuf, errBuf, "user1", "folder1", []string{"urgent"})
+	assert.Equal(t, ErrNotExists.ToString("urgent")+"\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.SetMeta(outBuf, errBuf, "user1", "folder1/file1", "owner", "bob")
+	assert.Equal(t, "Set owner of user1/folder1/file1 successfully.\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.GetMeta(outBuf, errBuf, "user1", "folder1/file1", "owner", OutputOptions{})
+	assert.Equal(t, "bob\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.GetMeta(outBuf, errBuf, "user1", "folder1/file1", "missing", OutputOptions{})
+	assert.Equal(t, ErrNotExists.ToString("missing")+"\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.Execute("set-meta user1 folder1/file1 env prod")
+	sys.GetMeta(outBuf, errBuf, "user1", "folder1/file1", "", OutputOptions{})
+	assert.Equal(t, "env=prod\nowner=bob\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+}
+
+func TestCommandRegistry(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	tests := []struct {
+		input       string
+		expectedOut string
+		expectedErr string
+		expectedRes RespondType
+	}{
+		{"", "", "", Succeed},
+		{"register user1", "Add user1 successfully.\n", "", Succeed},
+		{"register", "", ErrArgsLength.ToString("register [username]") + "\n", ErrArgsLength},
+		{"create-folder user1", "", ErrArgsLength.ToString("create-folder [username] [foldername] [description]?") + "\n", ErrArgsLength},
+		{"create-folder user1 folder1 desc extra", "", ErrArgsLength.ToString("create-folder [username] [foldername] [description]?") + "\n", ErrArgsLength},
+		{"create-folder user2 folder1", "", ErrNotExists.ToString("user2") + "\n", ErrNotExists},
+		{"list-folders user1 --sort-size", "", ErrInvalidFlag.ToString() + "\n", ErrInvalidFlag},
+		{"unknown", "", ErrUnknownCmd.ToString() + "\n", ErrUnknownCmd},
+		{"help register", "       register [username]\n              Register a new user.\n", "", Succeed},
+		{"help unknown", "", ErrUnknownCmd.ToString() + "\n", ErrUnknownCmd},
+	}
+
+	for _, tt := range tests {
+		res := sys.Run(outBuf, errBuf, tt.input)
+		assert.Equal(t, tt.expectedRes, res, tt.input)
+		assert.Equal(t, tt.expectedOut, outBuf.String(), tt.input)
+		assert.Equal(t, tt.expectedErr, errBuf.String(), tt.input)
+		ResetBufs(outBuf, errBuf)
+	}
+
+	sys.Commands.Register(&CommandDef{
+		CmdName:    "whoami",
+		CmdSummary: "Print the given names.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "others", Repeated: true}},
+		Handler: func(s *System, w io.Writer, ew io.Writer, args []string) RespondType {
+			fmt.Fprintln(w, strings.Join(args, ","))
+			return Succeed
+		},
+	})
+	cmd := sys.Commands.Lookup("whoami")
+	assert.Equal(t, "whoami [username] [others...]", cmd.Usage())
+	assert.Equal(t, 2, cmd.MinArgs())
+	assert.Equal(t, -1, cmd.MaxArgs())
+
+	sys.Run(outBuf, errBuf, "whoami a b c")
+	assert.Equal(t, "a,b,c\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// the flags of a bound command are taken wherever they are given
+	sys.Commands.Register(&CommandDef{
+		CmdName:    "greet",
+		CmdSummary: "Greet a user.",
+		Args:       []ArgSpec{{Name: "username"}, {Name: "--title title", Flag: true}, {Name: "greeting", Optional: true}, {Name: "--loud", Flag: true}},
+		Bind: func(s *System, w io.Writer, ew io.Writer, args *Args) RespondType {
+			fmt.Fprintf(w, "%s|%s|%s|%t\n", args.Get("greeting"), args.Flag("--title"), args.Get("username"), args.Has("--loud"))
+			return Succeed
+		},
+	})
+	bindTests := []struct {
+		input       string
+		expectedOut string
+		expectedRes RespondType
+	}{
+		{"greet user1", "||user1|false\n", Succeed},
+		{"greet --title Dr user1 hello --loud", "hello|Dr|user1|true\n", Succeed},
+		{"greet user1 --title Dr --title Pr", "|Pr|user1|false\n", Succeed},
+		{"greet user1 --title", "", ErrInvalidFlag},
+		{"greet user1 hello --quiet", "", ErrInvalidFlag},
+		{"greet user1 hello there", "", ErrArgsLength},
+		{"greet --loud", "", ErrArgsLength},
+	}
+	for _, tt := range bindTests {
+		res := sys.Run(outBuf, errBuf, tt.input)
+		assert.Equal(t, tt.expectedRes, res, tt.input)
+		assert.Equal(t, tt.expectedOut, outBuf.String(), tt.input)
+		ResetBufs(outBuf, errBuf)
+	}
+	sys.Run(outBuf, errBuf, "greet --loud")
+	assert.Equal(t, ErrArgsLength.ToString("greet [username] [--title title] [greeting]? [--loud]")+"\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	sys.Run(outBuf, errBuf, "help")
+	assert.Contains(t, outBuf.String(), "list-files [username] [foldername] [--sort-name|--sort-created|--sort-modified] [--sort key[:asc|:desc],...] [asc|desc] [--natural] [--ignore-case] [--tag tag]...")
+	assert.Contains(t, outBuf.String(), "whoami [username] [others...]\n")
+}
+
+func TestManPageUpToDate(t *testing.T) {
+	checkedIn, err := os.ReadFile("../vfs.1")
+	assert.NoError(t, err)
+	assert.Equal(t, GenManPage(DefaultCommands()), string(checkedIn),
+		"vfs.1 is stale, run `go run main.go gen-man` to regenerate it")
+}
+
+func TestGetHelpInfo(t *testing.T) {
+	help := GetHelpInfo()
+	for _, cmd := range DefaultCommands().Commands() {
+		assert.Contains(t, help, "       "+cmd.Usage()+"\n")
+	}
+	for _, opt := range ManOptions {
+		assert.Contains(t, help, "       "+opt.Usage+"\n")
+	}
+	assert.Contains(t, help, "       create-folder [username] [foldername] [description]?\n")
+}
+
+func TestSnapshot(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	path := t.TempDir() + "/vfs.json"
+
+	assert.NoError(t, sys.Load(path))
+	assert.Empty(t, sys.UserTable)
+
+	sys.Execute("register user1")
+	sys.Execute(`create-folder user1 folder1 "quarterly reports"`)
+	sys.Execute("create-file user1 folder1 file1")
+	sys.Execute("tag user1 folder1/file1 work")
+	assert.NoError(t, sys.Save(path))
+
+	sys.Reset()
+	sys = SetupTestSystem()
+	assert.NoError(t, sys.Load(path))
+
+	file := sys.GetUser("user1").GetFolder("folder1").GetFile("file1")
+	assert.NotNil(t, file)
+	assert.Equal(t, []string{"work"}, file.Tags)
+	assert.Len(t, sys.Index.Search("user1", []string{"quarterly"}), 1)
+
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0644))
+	assert.Error(t, sys.Load(path))
+}
+
+func TestRunScript(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	script := "register user1\n# comment\n\ncreate-folder user2 folder1\nregister user1\ncreate-folder user1 folder1\n"
+
+	res := sys.RunScript(strings.NewReader(script), "setup.vfs", outBuf, errBuf, false)
+	assert.Equal(t, ErrNotExists, res)
+	assert.Equal(t, "Add user1 successfully.\nCreate folder1 successfully.\n", outBuf.String())
+	assert.Equal(t, "setup.vfs:4: "+ErrNotExists.ToString("user2")+"\n"+
+		"setup.vfs:5: "+ErrAlreadyExists.ToString("user1")+"\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.RunScript(strings.NewReader("list-folders user1\nregister user1\nregister user3\n"), "s.vfs", outBuf, errBuf, true)
+	assert.Equal(t, ErrAlreadyExists, res)
+	assert.Nil(t, sys.GetUser("user3"))
+	ResetBufs(outBuf, errBuf)
+
+	// exit ends the script
+	res = sys.RunScript(strings.NewReader("register user4\nexit\nregister user5\n"), "s.vfs", outBuf, errBuf, false)
+	assert.Equal(t, Succeed, res)
+	assert.NotNil(t, sys.GetUser("user4"))
+	assert.Nil(t, sys.GetUser("user5"))
+}
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, ExitOK, Succeed.ExitCode())
+	assert.Equal(t, ExitOK, WarnEmptyFolder.ExitCode())
+	assert.Equal(t, ExitUsage, ErrArgsLength.ExitCode())
+	assert.Equal(t, ExitUsage, ErrUnknownCmd.ExitCode())
+	assert.Equal(t, ExitNotFound, ErrNotExists.ExitCode())
+	assert.Equal(t, ExitConflict, ErrAlreadyExists.ExitCode())
+	assert.Equal(t, ExitFailure, ErrIO.ExitCode())
+}
+
+func TestLineEditor(t *testing.T) {
+	tests := []struct {
+		keys     string
+		history  []string
+		expected string
+	}{
+		{"register user1\r", nil, "register user1"},
+		{"regster\x1b[D\x1b[D\x1b[D\x1b[Di\r", nil, "register"},
+		{"abc\x7f\x7fx\r", nil, "ax"},
+		{"world\x01hello \r", nil, "hello world"},
+		{"one two\x17\x17three\r", nil, "three"},
+		{"\x1b[A\x1b[A\r", []string{"first", "second"}, "first"},
+		{"\x1b[A\x1b[A\x1b[B\r", []string{"first", "second"}, "second"},
+		{"\x12fir\r", []string{"first", "second"}, "first"},
+		{"\x12s\x12\r", []string{"second", "log", "save"}, "second"},
+		{"\x12sec\x1b[C!\r", []string{"second", "first"}, "second!"},
+		{"unfinished", nil, "unfinished"},
+	}
+
+	for _, tt := range tests {
+		editor := NewLineEditor(strings.NewReader(tt.keys), io.Discard)
+		editor.History = tt.history
+
+		line, err := editor.ReadLine("$ ")
+		assert.NoError(t, err, tt.keys)
+		assert.Equal(t, tt.expected, line, tt.keys)
+	}
+
+	editor := NewLineEditor(strings.NewReader("\x04"), io.Discard)
+	_, err := editor.ReadLine("$ ")
+	assert.Equal(t, io.EOF, err)
+
+	editor = NewLineEditor(strings.NewReader("abc\x03"), io.Discard)
+	_, err = editor.ReadLine("$ ")
+	assert.Equal(t, ErrInterrupt, err)
+}
+
+func TestLineEditorHistoryFile(t *testing.T) {
+	path := t.TempDir() + "/history"
+
+	editor := NewLineEditor(strings.NewReader("register user1\r\rregister user1\rlist-folders user1\r"), io.Discard)
+	assert.NoError(t, editor.LoadHistory(path))
+	for i := 0; i < 4; i++ {
+		_, err := editor.ReadLine("$ ")
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"register user1", "list-folders user1"}, editor.History)
+
+	editor = NewLineEditor(strings.NewReader("\x1b[A\r"), io.Discard)
+	assert.NoError(t, editor.LoadHistory(path))
+	line, err := editor.ReadLine("$ ")
+	assert.NoError(t, err)
+	assert.Equal(t, "list-folders user1", line)
+
+	// the file is rewritten when the history is truncated
+	defer func(max int) { MaxHistory = max }(MaxHistory)
+	MaxHistory = 2
+	editor.AddHistory("register user2")
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "list-folders user1\nregister user2\n", string(data))
+}
+
+func TestHistoryRedact(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	path := t.TempDir() + "/history"
+
+	editor := NewLineEditor(strings.NewReader(""), io.Discard)
+	editor.Redact = sys.RedactLine
+	assert.NoError(t, editor.LoadHistory(path))
+	editor.AddHistory("unlock user1 hunter2")
+	editor.AddHistory("unlock user1")
+	editor.AddHistory(`webhooks add user1 http://localhost --secret "s3 cret" --folder "my docs"`)
+	editor.AddHistory("encrypt-user")
+	assert.Equal(t, []string{
+		"unlock user1 ***",
+		"unlock user1",
+		`webhooks add user1 http://localhost --secret *** --folder "my docs"`,
+		"encrypt-user",
+	}, editor.History)
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(data), "hunter2")
+	assert.NotContains(t, string(data), "s3 cret")
+}
+
+func TestComplete(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+
+	sys.Execute("register user1")
+	sys.Execute("register user2")
+	sys.Execute("register admin")
+	sys.Execute("create-folder user1 docs")
+	sys.Execute("create-folder user1 drafts")
+	sys.Execute("create-file user1 docs report")
+	sys.Execute("create-file user1 docs readme")
+
+	tests := []struct {
+		line          string
+		expected      []string
+		expectedStart int
+	}{
+		{"reg", []string{"register"}, 0},
+		{"list-f", []string{"list-folders", "list-files"}, 0},
+		{"create-folder u", []string{"user1", "user2"}, 14},
+		{"delete-folder user1 d", []string{"docs", "drafts"}, 20},
+		{"delete-file user1 docs re", []string{"readme", "report"}, 23},
+		{"list-files user1 docs --sort", []string{"--sort-name", "--sort-created", "--sort-modified", "--sort"}, 22},
+		{"list-folders user1 --c", []string{"--created-since", "--created-before", "--cursor"}, 19},
+		{"list-folders user1 --output t", []string{"table", "tsv"}, 28},
+		{"tag user1 dr", []string{"drafts/"}, 10},
+		{"tag user1 docs/rea", []string{"docs/readme"}, 10},
+		{"help cr", []string{"create-folder", "create-file"}, 5},
+		{"rename-folder user1 docs ", nil, 25},
+		{"move-file user1 docs report d", []string{"docs", "drafts"}, 28},
+		{"list-folders user1 --limit ", nil, 27},
+		{"archive user1 --format t", []string{"tar", "tar.gz"}, 23},
+		{"webhooks add user1 --folder dr", []string{"drafts"}, 28},
+		{"unknown u", nil, 8},
+	}
+
+	for _, tt := range tests {
+		candidates, start := sys.Complete(tt.line)
+		assert.Equal(t, tt.expected, candidates, tt.line)
+		assert.Equal(t, tt.expectedStart, start, tt.line)
+	}
+
+	editor := NewLineEditor(strings.NewReader("delete-folder user1 dr\t\r"), io.Discard)
+	editor.Complete = sys.Complete
+	line, err := editor.ReadLine("$ ")
+	assert.NoError(t, err)
+	assert.Equal(t, "delete-folder user1 drafts ", line)
+}
+
+func TestOutputFormats(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	sys.Clock = NewFakeClock(time.Date(2024, 8, 1, 9, 30, 0, 0, time.UTC), 0)
+	sys.Execute("register user1")
+	sys.Execute(`create-folder user1 folder1 "my, \"quoted\" docs"`)
+	sys.Execute("create-folder user1 folder2")
+	sys.Execute("tag user1 folder1 work")
+
+	tests := []struct {
+		args        string
+		expectedOut string
+	}{
+		{"--output csv --tz UTC",
+			"name,description,created_at,user,tags,meta\n" +
+				"folder1,\"my, \"\"quoted\"\" docs\",2024-08-01 09:30:00,user1,work,\n" +
+				"folder2,,2024-08-01 09:30:00,user1,,\n"},
+		{"--output tsv --time-format date --tag work",
+			"name\tdescription\tcreated_at\tuser\ttags\tmeta\n" +
+				"folder1\tmy, \"quoted\" docs\t2024-08-01\tuser1\twork\t\n"},
+		{"--output table --tz Asia/Tokyo --sort-name desc",
+			"NAME     DESCRIPTION        CREATED_AT           USER   TAGS  META\n" +
+				"folder2                     2024-08-01 18:30:00  user1\n" +
+				"folder1  my, \"quoted\" docs  2024-08-01 18:30:00  user1  work\n"},
+		{"--output json --tag work",
+			"[\n  {\"name\": \"folder1\", \"description\": \"my, \\\"quoted\\\" docs\", \"created_at\": \"2024-08-01T09:30:00Z\", " +
+				"\"user\": \"user1\", \"tags\": [\"work\"], \"meta\": {}}\n]\n"},
+		{"--output json --tag none", "[]\n"},
+		{"--time-format 15:04 --tz UTC --tag work", "folder1 my, \"quoted\" docs 09:30 user1 #work\n"},
+	}
+
+	for _, tt := range tests {
+		sys.Run(outBuf, errBuf, "list-folders user1 "+tt.args)
+		assert.Equal(t, tt.expectedOut, outBuf.String(), tt.args)
+		assert.Equal(t, "", errBuf.String(), tt.args)
+		ResetBufs(outBuf, errBuf)
+	}
+
+	res := sys.Run(outBuf, errBuf, "list-folders user1 --output xml")
+	assert.Equal(t, ErrInvalidFlag, res)
+	res = sys.Run(outBuf, errBuf, "list-folders user1 --tz Nowhere/City")
+	assert.Equal(t, ErrInvalidFlag, res)
+	ResetBufs(outBuf, errBuf)
+
+	sys.Run(outBuf, errBuf, "search user1 docs --output csv")
+	assert.True(t, strings.HasPrefix(outBuf.String(), "path,user,folder,file,score\nuser1/folder1,user1,folder1,,"))
+	ResetBufs(outBuf, errBuf)
+
+	sys.Run(outBuf, errBuf, "set-meta user1 folder1 owner bob")
+	ResetBufs(outBuf, errBuf)
+	sys.Run(outBuf, errBuf, "get-meta user1 folder1 --output json")
+	assert.Equal(t, "[\n  {\"key\": \"owner\", \"value\": \"bob\"}\n]\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "get-meta user1 --output json")
+	assert.Equal(t, ErrArgsLength, res)
+}
+
+func TestListingQuery(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	sys.Execute("register user1")
+	base := time.Date(2024, 8, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(base, 0)
+	sys.Clock = clock
+	for i, name := range []string{"file10", "File2", "file1", "notes"} {
+		clock.Set(base.Add(time.Duration(i/2) * time.Hour))
+		sys.Execute("create-folder user1 " + name)
+	}
+	sys.Execute("create-file user1 notes a")
+	sys.Execute("create-file user1 file1 a")
+	sys.Execute("create-file user1 file1 b")
+	sys.Execute("write-file user1 notes a 12345")
+	sys.Execute("write-file user1 file1 a 12")
+	sys.Execute("write-file user1 file1 b 12")
+
+	names := func(opts ListOptions) []string {
+		folders, _, res := sys.QueryFolders("user1", opts)
+		assert.Equal(t, Succeed, res)
+		var out []string
+		for _, folder := range folders {
+			out = append(out, folder.Name)
+		}
+		return out
+	}
+	parse := func(args string) ListOptions {
+		opts, msg := ParseListArgs(SplitArgs(args), testEpoch)
+		assert.Equal(t, "", msg, args)
+		return opts
+	}
+
+	tests := []struct {
+		args     string
+		expected []string
+	}{
+		{"", []string{"File2", "file1", "file10", "notes"}},
+		{"--ignore-case", []string{"file1", "file10", "File2", "notes"}},
+		{"--natural", []string{"file1", "File2", "file10", "notes"}},
+		// notes was created after file1 at the same time
+		{"--sort created:desc,name", []string{"notes", "file1", "File2", "file10"}},
+		{"--sort created --natural desc", []string{"notes", "file1", "File2", "file10"}},
+		{"--sort files:desc", []string{"file1", "notes", "File2", "file10"}},
+		{"--sort size:desc", []string{"notes", "file1", "File2", "file10"}},
+		{"--sort-created desc", []string{"notes", "file1", "File2", "file10"}},
+		{"--natural --offset 1 --limit 2", []string{"File2", "file10"}},
+		{"--natural --offset 9", nil},
+		{"--created-since " + base.Add(time.Hour).Format(time.RFC3339), []string{"file1", "notes"}},
+		{"--created-before 2024-07-01", nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, names(parse(tt.args)), tt.args)
+	}
+
+	// walk the pages with the cursor
+	opts := parse("--natural --limit 3")
+	var pages [][]string
+	for {
+		folders, next, _ := sys.QueryFolders("user1", opts)
+		var page []string
+		for _, folder := range folders {
+			page = append(page, folder.Name)
+		}
+		pages = append(pages, page)
+		if next == "" {
+			break
+		}
+		opts.Cursor = next
+	}
+	assert.Equal(t, [][]string{{"file1", "File2", "file10"}, {"notes"}}, pages)
+
+	sys.Run(outBuf, errBuf, "list-folders user1 --natural --limit 1")
+	assert.Equal(t, 1, strings.Count(outBuf.String(), "\n"))
+	assert.True(t, strings.HasPrefix(errBuf.String(), "Next page: --cursor "))
+	cursor := strings.TrimSpace(strings.TrimPrefix(errBuf.String(), "Next page: --cursor "))
+	ResetBufs(outBuf, errBuf)
+	sys.Run(outBuf, errBuf, "list-folders user1 --natural --limit 1 --cursor "+cursor)
+	assert.True(t, strings.HasPrefix(outBuf.String(), "File2 "))
+	ResetBufs(outBuf, errBuf)
+
+	for _, args := range []string{"--sort weight", "--sort name:up", "--limit -1", "--cursor !", "--created-since soon"} {
+		res := sys.Run(outBuf, errBuf, "list-folders user1 "+args)
+		assert.Equal(t, ErrInvalidFlag, res, args)
+	}
+	res := sys.Run(outBuf, errBuf, "list-files user1 notes --sort files")
+	assert.Equal(t, ErrInvalidFlag, res)
+	ResetBufs(outBuf, errBuf)
+
+	files, _, res := sys.QueryFiles("user1", "file1", parse("--sort size,name:desc"))
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "b", files[0].Name)
+	sys.Execute("write-file user1 file1 b 1")
+	files, _, _ = sys.QueryFiles("user1", "file1", parse("--sort size"))
+	assert.Equal(t, []string{"b", "a"}, []string{files[0].Name, files[1].Name})
+
+	// a relative time counts from the clock of the system
+	clock.Set(base.Add(90 * time.Minute))
+	sys.Run(outBuf, errBuf, "list-folders user1 --created-since 1h")
+	assert.Equal(t, 2, strings.Count(outBuf.String(), "\n"))
+	assert.Contains(t, outBuf.String(), "notes ")
+	ResetBufs(outBuf, errBuf)
+}
+
+func TestAuditLog(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	audit, err := OpenAuditLog(t.TempDir() + "/audit.jsonl")
+	assert.NoError(t, err)
+	defer audit.Close()
+	sys.Audit = audit
+
+	sys.Run(outBuf, errBuf, "register user1")
+	sys.Run(outBuf, errBuf, "create-folder user1 folder1")
+	sys.Run(outBuf, errBuf, "create-file user1 folder1 file1")
+	sys.Run(outBuf, errBuf, "set-description user1 folder1 notes")
+	sys.Run(outBuf, errBuf, "delete-file user1 folder1 file1")
+	sys.Run(outBuf, errBuf, "delete-folder user1 folder2")
+	sys.Run(outBuf, errBuf, "bogus")
+	ResetBufs(outBuf, errBuf)
+
+	entries, err := audit.Query(AuditFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 7)
+	assert.Equal(t, "user1/folder1", entries[3].Target)
+	assert.Equal(t, []string{"user1", "folder1", "notes"}, entries[3].Args)
+	assert.Equal(t, "", entries[6].User)
+	assert.Equal(t, "ErrUnknownCmd", entries[6].Outcome)
+
+	entries, _ = audit.Query(AuditFilter{User: "user1", Op: "delete-*"})
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "user1/folder1/file1", entries[0].Target)
+	assert.Equal(t, "Succeed", entries[0].Outcome)
+	assert.Equal(t, "ErrNotExists", entries[1].Outcome)
+
+	entries, _ = audit.Query(AuditFilter{Since: testEpoch.Add(time.Hour)})
+	assert.Len(t, entries, 0)
+
+	res := sys.Run(outBuf, errBuf, "audit --op delete-folder --output csv --time-format date")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "time,actor,user,op,target,args,outcome\n"+
+		"2024-08-01,tester,user1,delete-folder,user1/folder2,\"user1,folder2\",ErrNotExists\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// the changes made through the API are recorded by event, the actor apart from the owner
+	sys.Actor = "admin"
+	assert.Equal(t, Succeed, sys.RenameFolder(outBuf, errBuf, "user1", "folder1", "folder3"))
+	assert.NoError(t, sys.Tx(errBuf, func(tx *Tx) error {
+		tx.CreateFolder(io.Discard, io.Discard, "user1", "folder4", "")
+		tx.Run(io.Discard, io.Discard, "create-folder user1 folder5")
+		return nil
+	}))
+	ResetBufs(outBuf, errBuf)
+	entries, _ = audit.Query(AuditFilter{Actor: "admin"})
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, AuditEntry{Time: testEpoch, Actor: "admin", User: "user1", Op: "folder.renamed",
+			Target: "user1/folder3", Args: []string{"folder1"}, Outcome: "Succeed"}, entries[0])
+		assert.Equal(t, "create-folder", entries[1].Op)
+		assert.Equal(t, "folder.created", entries[2].Op)
+		assert.Equal(t, "user1/folder4", entries[2].Target)
+	}
+	res = sys.Run(outBuf, errBuf, "audit --actor admin --op folder.*")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "2024-08-01 09:00:00 admin folder.renamed user1/folder3 Succeed folder1\n"+
+		"2024-08-01 09:00:00 admin folder.created user1/folder4 Succeed\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "audit --user nobody")
+	assert.Equal(t, WarnNoMatches, res)
+	res = sys.Run(outBuf, errBuf, "audit --since")
+	assert.Equal(t, ErrInvalidFlag, res)
+	ResetBufs(outBuf, errBuf)
+
+	// the audit command is recorded too
+	entries, _ = audit.Query(AuditFilter{Op: "audit"})
+	assert.Len(t, entries, 4)
+
+	// exit is recorded before the caller leaves
+	res = sys.Run(outBuf, errBuf, "exit")
+	assert.Equal(t, Exited, res)
+	assert.Equal(t, ExitOK, res.ExitCode())
+	assert.Equal(t, "See you.\n", outBuf.String())
+	entries, _ = audit.Query(AuditFilter{Op: "exit"})
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "Exited", entries[0].Outcome)
+	}
+	ResetBufs(outBuf, errBuf)
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := t.TempDir() + "/audit.jsonl"
+	audit, err := OpenAuditLog(path)
+	assert.NoError(t, err)
+	defer audit.Close()
+	audit.MaxSize = 200
+	audit.MaxBackups = 2
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, audit.Record(AuditEntry{Time: time.Now(), Op: fmt.Sprintf("op%02d", i), Args: []string{}}))
+	}
+
+	_, err = os.Stat(path + ".2")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := audit.Query(AuditFilter{})
+	assert.NoError(t, err)
+	assert.Less(t, len(entries), 20)
+	assert.Equal(t, "op19", entries[len(entries)-1].Op)
+	for i := 1; i < len(entries); i++ {
+		assert.Less(t, entries[i-1].Op, entries[i].Op)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	all, cancelAll := sys.Subscribe(EventFilter{})
+	defer cancelAll()
+	docs, cancelDocs := sys.Subscribe(EventFilter{UserName: "user1", FolderName: "docs"})
+	files, cancelFiles := sys.Subscribe(EventFilter{Types: []EventType{EventFileCreated, EventFileDeleted}})
+	defer cancelFiles()
+
+	sys.Run(outBuf, errBuf, "register user1")
+	sys.Run(outBuf, errBuf, "create-folder user1 docs")
+	sys.Run(outBuf, errBuf, "create-folder user1 tmp")
+	sys.Run(outBuf, errBuf, "create-file user1 docs a")
+	sys.Run(outBuf, errBuf, "create-file user1 docs a")
+	sys.Run(outBuf, errBuf, "tag user1 docs/a work")
+	sys.Run(outBuf, errBuf, "rename-folder user1 docs notes")
+	sys.Run(outBuf, errBuf, "delete-file user1 notes a")
+	sys.Run(outBuf, errBuf, "delete-folder user1 tmp")
+	ResetBufs(outBuf, errBuf)
+
+	drain := func(ch <-chan Event) []string {
+		var out []string
+		for {
+			select {
+			case event := <-ch:
+				out = append(out, event.ToString())
+			default:
+				return out
+			}
+		}
+	}
+	assert.Equal(t, []string{
+		"user.registered user1",
+		"folder.created user1/docs",
+		"folder.created user1/tmp",
+		"file.created user1/docs/a",
+		"file.modified user1/docs/a",
+		"folder.renamed user1/notes (from docs)",
+		"file.deleted user1/notes/a",
+		"folder.deleted user1/tmp",
+	}, drain(all))
+	assert.Equal(t, []string{
+		"folder.created user1/docs",
+		"file.created user1/docs/a",
+		"file.modified user1/docs/a",
+		"folder.renamed user1/notes (from docs)",
+	}, drain(docs))
+	assert.Equal(t, []string{"file.created user1/docs/a", "file.deleted user1/notes/a"}, drain(files))
+
+	cancelDocs()
+	cancelDocs()
+	_, ok := <-docs
+	assert.False(t, ok)
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	defer func(size int) { EventBufferSize = size }(EventBufferSize)
+	EventBufferSize = 3
+
+	bus := NewEventBus()
+	events, cancel := bus.Subscribe(EventFilter{})
+	defer cancel()
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: EventFolderCreated, UserName: "user1", FolderName: fmt.Sprint("folder", i)})
+	}
+
+	var names []string
+	var dropped []int
+	for i := 0; i < 3; i++ {
+		event := <-events
+		names = append(names, event.FolderName)
+		dropped = append(dropped, event.Dropped)
+	}
+	assert.Equal(t, []string{"folder2", "folder3", "folder4"}, names)
+	assert.Equal(t, []int{0, 1, 2}, dropped)
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 docs")
+
+	var watchBuf syncBuffer
+	res := sys.Run(&watchBuf, errBuf, "watch user1 docs")
+	assert.Equal(t, Succeed, res)
+	res = sys.Run(outBuf, errBuf, "watch user2")
+	assert.Equal(t, ErrNotExists, res)
+	ResetBufs(outBuf, errBuf)
+
+	sys.Run(outBuf, errBuf, "create-folder user1 other")
+	sys.Run(outBuf, errBuf, "create-file user1 docs a")
+	sys.Run(outBuf, errBuf, "watch --stop")
+	assert.Equal(t, "Stop 1 watches successfully.\n", strings.Split(outBuf.String(), "\n")[2]+"\n")
+	sys.Run(outBuf, errBuf, "create-file user1 docs b")
+
+	lines := strings.Split(strings.TrimSpace(watchBuf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "Watch user1/docs successfully.", lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], "] file.created user1/docs/a"), lines[1])
+}
+
+func TestWebhooks(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Webhooks.BaseDelay = time.Millisecond
+	sys.Webhooks.MaxAttempts = 3
+
+	var mu sync.Mutex
+	var received []WebhookPayload
+	failures := 2
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("X-VFS-Signature") != Signature("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+		received = append(received, payload)
+	}))
+	defer server.Close()
+
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 docs")
+	sys.Execute("create-folder user1 tmp")
+
+	res := sys.Run(outBuf, errBuf, "webhooks add user1 "+server.URL+" --folder docs --secret s3cret")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Add webhook 1 for user1/docs successfully.\n", outBuf.String())
+	res = sys.Run(outBuf, errBuf, "webhooks add user1 ftp://example.com")
+	assert.Equal(t, ErrInvalidURL, res)
+	assert.Equal(t, ErrInvalidURL.ToString("ftp://example.com")+"\n", errBuf.String())
+	res = sys.Run(outBuf, errBuf, "webhooks add user2 "+server.URL)
+	assert.Equal(t, ErrNotExists, res)
+	ResetBufs(outBuf, errBuf)
+
+	sys.Execute("create-file user1 docs a")
+	sys.Execute("create-file user1 tmp b")
+	sys.Webhooks.Wait()
+
+	mu.Lock()
+	assert.Len(t, received, 1)
+	assert.Equal(t, EventFileCreated, received[0].Type)
+	assert.Equal(t, "user1/docs/a", received[0].Path)
+	mu.Unlock()
+	assert.Empty(t, sys.Webhooks.DeadLetters())
+
+	// the events of a webhook arrive in order, a retry holding back the next
+	mu.Lock()
+	failures, received = 1, nil
+	mu.Unlock()
+	for _, name := range []string{"e1", "e2", "e3", "e4"} {
+		sys.Execute("create-file user1 docs " + name)
+	}
+	sys.Webhooks.Wait()
+	mu.Lock()
+	var paths []string
+	for _, payload := range received {
+		paths = append(paths, payload.Path)
+	}
+	assert.Equal(t, []string{"user1/docs/e1", "user1/docs/e2", "user1/docs/e3", "user1/docs/e4"}, paths)
+	mu.Unlock()
+
+	// a wrong secret is refused on every attempt
+	sys.Run(outBuf, errBuf, "webhooks add user1 "+server.URL+" --secret other")
+	sys.Execute("create-file user1 tmp c")
+	sys.Webhooks.Wait()
+	letters := sys.Webhooks.DeadLetters()
+	assert.Len(t, letters, 1)
+	assert.Equal(t, 2, letters[0].WebhookID)
+	assert.Equal(t, 3, letters[0].Attempts)
+	assert.Equal(t, "user1/tmp/c", letters[0].Event.Path())
+	assert.Contains(t, letters[0].LastError, "401")
+	assert.Equal(t, testEpoch, letters[0].FailedAt)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "webhooks dead --output csv")
+	assert.Equal(t, Succeed, res)
+	assert.Contains(t, outBuf.String(), ",2,"+server.URL+",file.created,user1/tmp/c,3,unexpected status 401 Unauthorized\n")
+	ResetBufs(outBuf, errBuf)
+
+	sys.Run(outBuf, errBuf, "webhooks")
+	assert.Equal(t, "ID  USER   FOLDER  URL\n"+
+		"1   user1  docs    "+server.URL+"\n"+
+		"2   user1          "+server.URL+"\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	assert.Equal(t, Succeed, sys.Run(outBuf, errBuf, "webhooks remove 2"))
+	assert.Equal(t, ErrNotExists, sys.Run(outBuf, errBuf, "webhooks remove 2"))
+	assert.Len(t, sys.Webhooks.Hooks(), 1)
+
+	// webhooks and dead letters are kept in the snapshot
+	path := t.TempDir() + "/vfs.json"
+	assert.NoError(t, sys.Save(path))
+	sys.Webhooks.Restore(nil, nil)
+	assert.NoError(t, sys.Load(path))
+	assert.Len(t, sys.Webhooks.Hooks(), 1)
+	assert.Len(t, sys.Webhooks.DeadLetters(), 1)
+	ResetBufs(outBuf, errBuf)
+	sys.Run(outBuf, errBuf, "webhooks add user1 "+server.URL)
+	assert.True(t, strings.HasPrefix(outBuf.String(), "Add webhook 2 for user1 successfully.\nGenerated secret: "))
+
+	// a given secret is redacted from the audit log
+	args := []string{"add", "user1", server.URL, "--secret", "s3cret", "--folder", "docs"}
+	entry := auditEntry(sys.Commands.Lookup("webhooks"), "webhooks", args, Succeed, testEpoch)
+	assert.Equal(t, []string{"add", "user1", server.URL, "--secret", "***", "--folder", "docs"}, entry.Args)
+	assert.Equal(t, "s3cret", args[4])
+}
+
+func TestWebhookLifecycle(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Webhooks.BaseDelay = time.Hour
+	sys.Webhooks.MaxDelay = time.Hour
+
+	var mu sync.Mutex
+	var paths []string
+	fail := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		json.NewDecoder(r.Body).Decode(&payload)
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		paths = append(paths, payload.Path)
+	}))
+	defer server.Close()
+
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 docs")
+	sys.Run(outBuf, errBuf, "webhooks add user1 "+server.URL+" --folder docs --secret s3cret")
+
+	// the webhook of a folder follows its renames
+	sys.Execute("rename-folder user1 docs papers")
+	sys.Execute("create-file user1 papers a")
+	sys.Webhooks.Wait()
+	assert.Equal(t, "papers", sys.Webhooks.Hooks()[0].FolderName)
+	mu.Lock()
+	assert.Equal(t, []string{"user1/papers", "user1/papers/a"}, paths)
+	fail = true
+	mu.Unlock()
+
+	// removing a webhook cancels its retries and drops its events
+	sys.Execute("create-file user1 papers b")
+	sys.Execute("create-file user1 papers c")
+	assert.Equal(t, Succeed, sys.Run(outBuf, errBuf, "webhooks remove 1"))
+	sys.Webhooks.Wait()
+	assert.Empty(t, sys.Webhooks.DeadLetters())
+
+	// shutting down gives up on the pending events, kept as dead letters
+	sys.Run(outBuf, errBuf, "webhooks add user1 "+server.URL+" --secret s3cret")
+	sys.Execute("create-file user1 papers d")
+	sys.Execute("create-file user1 papers e")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, sys.Webhooks.Shutdown(ctx), context.DeadlineExceeded)
+	letters := sys.Webhooks.DeadLetters()
+	assert.Len(t, letters, 2)
+	assert.Equal(t, "user1/papers/d", letters[0].Event.Path())
+	assert.Equal(t, 1, letters[0].Attempts)
+	assert.Equal(t, "user1/papers/e", letters[1].Event.Path())
+	assert.Equal(t, 0, letters[1].Attempts)
+	assert.Equal(t, ErrNotDelivered.Error(), letters[1].LastError)
+	assert.NoError(t, sys.Webhooks.Shutdown(context.Background()))
+}
+
+func TestImportExport(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("register user2")
+
+	root := t.TempDir() + "/project"
+	old := time.Date(2024, 8, 1, 9, 30, 0, 0, time.UTC)
+	for _, path := range []string{"src/main.go", "src/util", "docs/readme", "docs/nested/x", "bad name/a", "top"} {
+		path = root + "/" + path
+		assert.NoError(t, os.MkdirAll(path[:strings.LastIndex(path, "/")], 0755))
+		assert.NoError(t, os.WriteFile(path, nil, 0644))
+		assert.NoError(t, os.Chtimes(path, old, old))
+	}
+
+	res := sys.Run(outBuf, errBuf, "import user1 "+root)
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Import 3 folders and 3 files from "+root+" successfully.\n", outBuf.String())
+	assert.Equal(t, "Warning: Skip "+root+"/bad name, the name breaks the chars rule: ' ' is not an ASCII letter, an ASCII digit or one of _.\n"+
+		"Warning: Skip "+root+"/docs/nested, nested directories are not supported.\n"+
+		"Warning: Skip "+root+"/src/main.go, the name breaks the chars rule: '.' is not an ASCII letter, an ASCII digit or one of _.\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	user := sys.GetUser("user1")
+	assert.NotNil(t, user.GetFolder("project").GetFile("top"))
+	assert.NotNil(t, user.GetFolder("docs").GetFile("readme"))
+	assert.True(t, old.Equal(user.GetFolder("src").GetFile("util").CreatedAt))
+
+	// a second run only adds what was skipped
+	res = sys.Run(outBuf, errBuf, "import user1 "+root+" --sanitize")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Import 1 folders and 2 files from "+root+" successfully.\n", outBuf.String())
+	assert.NotNil(t, user.GetFolder("src").GetFile("main_go"))
+	assert.NotNil(t, user.GetFolder("bad_name").GetFile("a"))
+	ResetBufs(outBuf, errBuf)
+
+	// export then import back keeps descriptions, times and labels
+	sys.Clock.(*FakeClock).Set(old.Add(time.Hour))
+	sys.Execute(`set-description user1 docs readme "read me first"`)
+	sys.Execute("tag user1 docs/readme doc")
+	sys.Execute("set-meta user1 docs owner alice")
+	out := t.TempDir()
+	res = sys.Run(outBuf, errBuf, "export user1 docs "+out)
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Export user1/docs to "+out+"/docs successfully.\n", outBuf.String())
+	info, err := os.Stat(out + "/docs/readme")
+	assert.NoError(t, err)
+	// the description changed the file since its creation
+	readme := user.GetFolder("docs").GetFile("readme")
+	assert.True(t, old.Add(time.Hour).Equal(readme.ModifiedAt))
+	assert.True(t, readme.ModifiedAt.Equal(info.ModTime()))
+	_, err = os.Stat(out + "/docs/" + ManifestName)
+	assert.NoError(t, err)
+
+	res = sys.Run(outBuf, errBuf, "export user1 docs "+out)
+	assert.Equal(t, ErrIO, res)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "import user2 "+out)
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "", errBuf.String())
+	folder := sys.GetUser("user2").GetFolder("docs")
+	assert.Equal(t, map[string]string{"owner": "alice"}, folder.Meta)
+	file := folder.GetFile("readme")
+	assert.Equal(t, "read me first", file.Description)
+	assert.Equal(t, []string{"doc"}, file.Tags)
+	assert.True(t, old.Equal(file.CreatedAt))
+	assert.True(t, readme.ModifiedAt.Equal(file.ModifiedAt))
+	assert.False(t, file.AccessedAt.IsZero())
+	ResetBufs(outBuf, errBuf)
+
+	// a clash is found before anything is written
+	sys.Execute("create-folder user1 pair")
+	sys.Execute("create-file user1 pair a")
+	sys.Execute("create-file user1 pair b")
+	assert.NoError(t, os.MkdirAll(out+"/pair", 0755))
+	assert.NoError(t, os.WriteFile(out+"/pair/b", []byte("mine"), 0644))
+	res = sys.Run(outBuf, errBuf, "export user1 pair "+out)
+	assert.Equal(t, ErrIO, res)
+	assert.Contains(t, errBuf.String(), out+"/pair/b already exists")
+	entries, _ := os.ReadDir(out + "/pair")
+	assert.Len(t, entries, 1)
+	ResetBufs(outBuf, errBuf)
+
+	assert.Equal(t, ErrIO, sys.Run(outBuf, errBuf, "import user1 "+root+"/missing"))
+	assert.Equal(t, ErrInvalidFlag, sys.Run(outBuf, errBuf, "import user1 "+root+" --force"))
+	ResetBufs(outBuf, errBuf)
+
+	// a name holding a path, as an older store may, is not exported out of the directory
+	folder.Files["../escape"] = CreateFile("../escape", "", "docs", "user2", testEpoch)
+	out = t.TempDir() + "/out"
+	res = sys.Run(outBuf, errBuf, "export user2 docs "+out)
+	assert.Equal(t, ErrIO, res)
+	assert.Contains(t, errBuf.String(), "../escape cannot name a host file")
+	_, err = os.Stat(out + "/escape")
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(out)
+	assert.True(t, os.IsNotExist(err))
+	ResetBufs(outBuf, errBuf)
+}
+
+func TestArchive(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("register user2")
+	sys.Execute(`create-folder user1 docs "my docs"`)
+	sys.Execute("create-folder user1 empty")
+	sys.Execute(`create-file user1 docs a "first file"`)
+	sys.Execute("create-file user1 docs b")
+	sys.Execute("tag user1 docs/a work")
+	sys.Execute("set-meta user1 docs owner alice")
+	sys.Execute("write-file user1 docs a hello")
+	created := time.Date(2024, 8, 1, 9, 30, 0, 123456789, time.UTC)
+	sys.GetUser("user1").GetFolder("docs").GetFile("a").CreatedAt = created
+
+	dir := t.TempDir()
+	for i, name := range []string{"out.tar", "out.tar.gz", "out.zip", "plain.bin"} {
+		user := fmt.Sprint("copy", i)
+		sys.Execute("register " + user)
+		out := dir + "/" + name
+
+		res := sys.Run(outBuf, errBuf, "archive user1 "+out)
+		assert.Equal(t, Succeed, res, name)
+		assert.Equal(t, "Archive user1 to "+out+" successfully.\n", outBuf.String())
+		ResetBufs(outBuf, errBuf)
+
+		res = sys.Run(outBuf, errBuf, "unarchive "+user+" "+out)
+		assert.Equal(t, Succeed, res, name)
+		assert.Equal(t, "Unarchive 2 folders and 2 files from "+out+" successfully.\n", outBuf.String(), name)
+		ResetBufs(outBuf, errBuf)
+
+		folder := sys.GetUser(user).GetFolder("docs")
+		assert.Equal(t, "my docs", folder.Description, name)
+		assert.Equal(t, map[string]string{"owner": "alice"}, folder.Meta, name)
+		file := folder.GetFile("a")
+		assert.Equal(t, "first file", file.Description, name)
+		assert.Equal(t, []string{"work"}, file.Tags, name)
+		assert.Equal(t, "hello", string(sys.Content(file)), name)
+		if name == "out.zip" {
+			assert.True(t, created.Truncate(time.Second).Equal(file.CreatedAt.Truncate(time.Second)), name)
+		} else {
+			assert.True(t, created.Equal(file.CreatedAt), name)
+		}
+		assert.NotNil(t, sys.GetUser(user).GetFolder("empty"), name)
+
+		// nothing is created twice
+		res = sys.Run(outBuf, errBuf, "unarchive "+user+" "+out)
+		assert.Equal(t, ErrIO, res, name)
+		ResetBufs(outBuf, errBuf)
+	}
+
+	res := sys.Run(outBuf, errBuf, "archive user1 --format rar "+dir+"/x")
+	assert.Equal(t, ErrInvalidFlag, res)
+	ResetBufs(outBuf, errBuf)
+
+	// a folder entry after its files still gives the folder its metadata
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "late/a", Typeflag: tar.TypeReg, Size: 2, ModTime: created})
+	tw.Write([]byte("hi"))
+	tw.WriteHeader(&tar.Header{Name: "late/", Typeflag: tar.TypeDir, ModTime: created, Format: tar.FormatPAX,
+		PAXRecords: map[string]string{paxDescription: "late folder"}})
+	tw.Close()
+	path := dir + "/late.tar"
+	assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+	res = sys.Run(outBuf, errBuf, "unarchive user2 "+path)
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Unarchive 1 folders and 1 files from "+path+" successfully.\n", outBuf.String())
+	folder := sys.GetUser("user2").GetFolder("late")
+	assert.Equal(t, "late folder", folder.Description)
+	assert.True(t, created.Truncate(time.Second).Equal(folder.CreatedAt.Truncate(time.Second)))
+	assert.Equal(t, "hi", string(sys.Content(folder.GetFile("a"))))
+	ResetBufs(outBuf, errBuf)
+}
+
+func TestUnarchiveUnsafe(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	dir := t.TempDir()
+
+	writeTarFile := func(name string, headers ...*tar.Header) string {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, hdr := range headers {
+			assert.NoError(t, tw.WriteHeader(hdr))
+			if hdr.Size > 0 {
+				tw.Write(make([]byte, hdr.Size))
+			}
+		}
+		tw.Close()
+		path := dir + "/" + name
+		assert.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+		return path
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{writeTarFile("dotdot.tar", &tar.Header{Name: "../evil", Typeflag: tar.TypeReg}), `unsafe archive: path "../evil"`},
+		{writeTarFile("abs.tar", &tar.Header{Name: "/etc/passwd", Typeflag: tar.TypeReg}), `unsafe archive: path "/etc/passwd"`},
+		{writeTarFile("deep.tar", &tar.Header{Name: "a/b/c", Typeflag: tar.TypeReg}), `unsafe archive: path "a/b/c" is nested too deep`},
+		{writeTarFile("link.tar", &tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: "/etc"}), `unsafe archive: "a/b" is not a regular file or directory`},
+		{writeTarFile("name.tar", &tar.Header{Name: "a/b.c", Typeflag: tar.TypeReg}), `unsafe archive: invalid name "a/b.c", it breaks the chars rule: '.' is not an ASCII letter, an ASCII digit or one of _`},
+		{writeTarFile("partial.tar",
+			&tar.Header{Name: "good/", Typeflag: tar.TypeDir},
+			&tar.Header{Name: "good/../../x", Typeflag: tar.TypeReg}), `unsafe archive: path "good/../../x"`},
+	}
+
+	// a zip whose only entry inflates far beyond its compressed size
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("bomb/zeros")
+	f.Write(make([]byte, 1<<20))
+	zw.Close()
+	os.WriteFile(dir+"/bomb.zip", buf.Bytes(), 0644)
+	tests = append(tests, struct {
+		path     string
+		expected string
+	}{dir + "/bomb.zip", `unsafe archive: "bomb/zeros" is too large`})
+
+	for _, tt := range tests {
+		res := sys.Run(outBuf, errBuf, "unarchive user1 "+tt.path)
+		assert.Equal(t, ErrIO, res, tt.path)
+		assert.Equal(t, ErrIO.ToString("cannot unarchive "+tt.path, tt.expected)+"\n", errBuf.String())
+		ResetBufs(outBuf, errBuf)
+	}
+	assert.Empty(t, sys.GetUser("user1").Folders)
+
+	defer func(size int64) { MaxArchiveSize = size }(MaxArchiveSize)
+	MaxArchiveSize = 1000
+	path := writeTarFile("big.tar", &tar.Header{Name: "a/b", Typeflag: tar.TypeReg, Size: 4096})
+	res := sys.Run(outBuf, errBuf, "unarchive user1 "+path)
+	assert.Equal(t, ErrIO, res)
+	assert.Contains(t, errBuf.String(), "too much data after decompression")
+}
+
+func TestBulkOperations(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 src")
+	sys.Execute("create-folder user1 dst")
+	for _, name := range []string{"tmp_1", "tmp_2", "report_2023", "report_2024", "report_20245", "keep"} {
+		sys.Execute("create-file user1 src " + name)
+	}
+	sys.Execute("tag user1 src/report_2023 work")
+
+	files := func(foldername string) []string {
+		var names []string
+		for name := range sys.GetUser("user1").GetFolder(foldername).Files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	res := sys.Run(outBuf, errBuf, "delete-file user1 src tmp_* --dry-run")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Would delete user1/src/tmp_1\nWould delete user1/src/tmp_2\n", outBuf.String())
+	assert.Len(t, files("src"), 6)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "delete-file user1 src tmp_*")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Delete tmp_1 in user1/src successfully.\nDelete tmp_2 in user1/src successfully.\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "copy-file user1 src report_202? dst")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, []string{"report_2023", "report_2024"}, files("dst"))
+	copied := sys.GetUser("user1").GetFolder("dst").GetFile("report_2023")
+	assert.Equal(t, "dst", copied.FolderName)
+	assert.Equal(t, []string{"work"}, copied.Tags)
+	ResetBufs(outBuf, errBuf)
+
+	// one conflict cancels the whole batch
+	res = sys.Run(outBuf, errBuf, "move-file user1 src report_* dst")
+	assert.Equal(t, ErrAlreadyExists, res)
+	assert.Equal(t, "", outBuf.String())
+	assert.Equal(t, []string{"keep", "report_2023", "report_2024", "report_20245"}, files("src"))
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "move-file user1 src report_2024? dst")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Move report_20245 from user1/src to user1/dst successfully.\n", outBuf.String())
+	assert.Equal(t, "dst", sys.GetUser("user1").GetFolder("dst").GetFile("report_20245").FolderName)
+	assert.Equal(t, []string{"keep", "report_2023", "report_2024"}, files("src"))
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "delete-file user1 src nothing_*")
+	assert.Equal(t, ErrNotExists, res)
+	res = sys.Run(outBuf, errBuf, "delete-file user1 src [")
+	assert.Equal(t, ErrInvalidChars, res)
+	ResetBufs(outBuf, errBuf)
+
+	// above the threshold, --yes is needed
+	defer func(n int) { BulkConfirmThreshold = n }(BulkConfirmThreshold)
+	BulkConfirmThreshold = 2
+	res = sys.Run(outBuf, errBuf, "delete-file user1 src *")
+	assert.Equal(t, ErrNeedConfirm, res)
+	assert.Equal(t, ErrNeedConfirm.ToString("3")+"\n", errBuf.String())
+	assert.Len(t, files("src"), 3)
+	res = sys.Run(outBuf, errBuf, "delete-file user1 src * --yes")
+	assert.Equal(t, Succeed, res)
+	assert.Len(t, files("src"), 0)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "delete-folder user1 * --dry-run")
+	assert.Equal(t, "Would delete user1/dst\nWould delete user1/src\n", outBuf.String())
+	res = sys.Run(outBuf, errBuf, "delete-folder user1 s*")
+	assert.Equal(t, Succeed, res)
+	assert.Nil(t, sys.GetUser("user1").GetFolder("src"))
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("dst"))
+}
+
+func TestTransaction(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+
+	events, cancel := sys.Subscribe(EventFilter{})
+	defer cancel()
+
+	res := sys.Run(outBuf, errBuf, "begin")
+	assert.Equal(t, Succeed, res)
+	assert.True(t, sys.InTx())
+	sys.Run(outBuf, errBuf, "create-folder user1 staged")
+	sys.Run(outBuf, errBuf, "create-file user1 staged file1")
+	assert.Nil(t, sys.GetUser("user1").GetFolder("staged"))
+	assert.NotNil(t, sys.session.Load().GetUser("user1").GetFolder("staged").GetFile("file1"))
+	assert.Len(t, events, 0)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "rollback")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Rollback 2 changes successfully.\n", outBuf.String())
+	assert.False(t, sys.InTx())
+	assert.Nil(t, sys.GetUser("user1").GetFolder("staged"))
+	ResetBufs(outBuf, errBuf)
+
+	sys.Run(outBuf, errBuf, "begin")
+	sys.Run(outBuf, errBuf, "create-folder user1 staged")
+	sys.Run(outBuf, errBuf, "rename-folder user1 staged done")
+	path := t.TempDir() + "/vfs.json"
+	assert.NoError(t, sys.Save(path))
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "commit")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Commit 2 changes successfully.\n", outBuf.String())
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("done"))
+	assert.Len(t, sys.Index.Search("user1", []string{"done"}), 1)
+	assert.Equal(t, EventFolderCreated, (<-events).Type)
+	assert.Equal(t, EventFolderRenamed, (<-events).Type)
+
+	// the snapshot saved during the transaction only holds committed state
+	saved := &System{Index: NewIndex(), Blobs: NewBlobStore(), Webhooks: NewWebhookDispatcher()}
+	assert.NoError(t, saved.Load(path))
+	assert.NotNil(t, saved.GetUser("user1"))
+	assert.Nil(t, saved.GetUser("user1").GetFolder("done"))
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "commit")
+	assert.Equal(t, ErrTransaction, res)
+	assert.Equal(t, ErrTransaction.ToString("no transaction is open")+"\n", errBuf.String())
+}
+
+func TestTransactionSessionRace(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	sys.Execute("register user1")
+
+	// the session is read by the prompt and the completion while commands
+	// open and close it, see go test -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			sys.InTx()
+			sys.Complete("list-folders us")
+			sys.Run(io.Discard, io.Discard, "list-folders user1")
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		sys.Run(io.Discard, io.Discard, "begin")
+		sys.Run(io.Discard, io.Discard, "rollback")
+	}
+	<-done
+	assert.False(t, sys.InTx())
+}
+
+func TestTransactionAPI(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+
+	err := sys.Tx(errBuf, func(tx *Tx) error {
+		tx.CreateFolder(outBuf, errBuf, "user1", "folder1", "")
+		if res := tx.Run(outBuf, errBuf, "create-file user1 nofolder file1"); res != Succeed {
+			return fmt.Errorf("create-file: %s", res.Name())
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "create-file: ErrNotExists")
+	assert.Nil(t, sys.GetUser("user1").GetFolder("folder1"))
+
+	err = sys.Tx(errBuf, func(tx *Tx) error {
+		tx.CreateFolder(outBuf, errBuf, "user1", "folder1", "")
+		tx.CreateFile(outBuf, errBuf, "user1", "folder1", "file1", "")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("folder1").GetFile("file1"))
+
+	// a transaction copies the users it uses only, and stages the changes
+	// to the index and the blobs until the commit
+	sys.Execute("register user2")
+	err = sys.Tx(errBuf, func(tx *Tx) error {
+		tx.CreateFile(outBuf, errBuf, "user1", "folder1", "staged", "draft")
+		tx.WriteFile(outBuf, errBuf, "user1", "folder1", "staged", []byte("pending review"))
+		assert.Len(t, tx.Index.Search("user1", []string{"draft", "review"}), 1)
+		assert.Empty(t, sys.Index.Search("user1", []string{"draft"}))
+		count, _ := sys.Blobs.Stats()
+		assert.Equal(t, 0, count)
+		assert.True(t, tx.owned["user1"])
+		assert.False(t, tx.owned["user2"])
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Len(t, sys.Index.Search("user1", []string{"draft", "review"}), 1)
+	count, _ := sys.Blobs.Stats()
+	assert.Equal(t, 1, count)
+
+	// a concurrent writer makes the commit fail
+	var wg sync.WaitGroup
+	err = sys.Tx(errBuf, func(tx *Tx) error {
+		tx.DeleteFolder(outBuf, errBuf, "user1", "folder1")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sys.Run(outBuf, errBuf, "create-folder user1 folder2")
+		}()
+		wg.Wait()
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrTxConflict)
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("folder1"))
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("folder2"))
+}
+
+func TestTransactionScript(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+
+	script := "register user1\nbegin\ncreate-folder user1 folder1\ncreate-file user1 nofolder file1\ncreate-folder user1 folder2\ncommit\n"
+	res := sys.RunScript(strings.NewReader(script), "s.vfs", outBuf, errBuf, false)
+	assert.Equal(t, ErrNotExists, res)
+	assert.Empty(t, sys.GetUser("user1").Folders)
+	assert.Contains(t, errBuf.String(), "s.vfs:6: "+ErrTransaction.ToString("a command of the transaction failed, it is rolled back"))
+	assert.False(t, sys.InTx())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.RunScript(strings.NewReader("begin\ncreate-folder user1 folder1\n"), "s.vfs", outBuf, errBuf, false)
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "s.vfs: Warning: The transaction left open is rolled back.\n", errBuf.String())
+	assert.Empty(t, sys.GetUser("user1").Folders)
+}
+
+func TestDiskStore(t *testing.T) {
+	path := t.TempDir() + "/vfs.db"
+	store, err := OpenDiskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.PutUser(CreateUser("user1")))
+	assert.NoError(t, store.PutFolder("user1", CreateFolder("docs", "v1", "user1", testEpoch)))
+	assert.NoError(t, store.PutFolder("user1", CreateFolder("docs", "v2", "user1", testEpoch)))
+	assert.NoError(t, store.Close())
+
+	// a torn record at the end is dropped on open
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.Write(encodeDiskRecord(diskKey(diskUser, "user2"), []byte(`{"Name":"user2"}`), false)[:20])
+	f.Close()
+
+	store, err = OpenDiskStore(path)
+	assert.NoError(t, err)
+	folder, _ := store.GetFolder("user1", "docs")
+	assert.Equal(t, "v2", folder.Description)
+	users, _ := store.ListUsers()
+	assert.Len(t, users, 1)
+	assert.NoError(t, store.PutUser(CreateUser("user3")))
+	users, _ = store.ListUsers()
+	assert.Len(t, users, 2)
+
+	// compaction keeps the live records only
+	defer func(n int64) { DiskCompactSize = n }(DiskCompactSize)
+	DiskCompactSize = 1 << 10
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, store.PutFolder("user1", CreateFolder("docs", fmt.Sprint("v", i), "user1", testEpoch)))
+	}
+	assert.Less(t, store.Size(), int64(2<<10))
+	assert.NoError(t, store.Close())
+	store, err = OpenDiskStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	folder, _ = store.GetFolder("user1", "docs")
+	assert.Equal(t, "v99", folder.Description)
+
+	// a damaged record before the end is reported
+	data, _ := os.ReadFile(path)
+	data[12] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0644))
+	_, err = OpenDiskStore(path)
+	assert.ErrorIs(t, err, ErrCorruptStore)
+}
+
+func TestSystemStore(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	path := t.TempDir() + "/vfs.db"
+
+	store, err := OpenDiskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, sys.Open(store))
+	sys.Run(outBuf, errBuf, "register user1")
+	sys.Run(outBuf, errBuf, "create-folder user1 docs reports")
+	sys.Run(outBuf, errBuf, "create-file user1 docs a")
+	sys.Run(outBuf, errBuf, "create-file user1 docs b")
+	sys.Run(outBuf, errBuf, "tag user1 docs/a work")
+	sys.Run(outBuf, errBuf, "create-folder user1 tmp")
+	sys.Run(outBuf, errBuf, "delete-folder user1 tmp")
+	sys.Run(outBuf, errBuf, "delete-file user1 docs b")
+	sys.Run(outBuf, errBuf, "rename-folder user1 docs papers")
+	assert.NoError(t, sys.Tx(errBuf, func(tx *Tx) error {
+		tx.CreateFile(outBuf, errBuf, "user1", "papers", "c", "")
+		return nil
+	}))
+	assert.Empty(t, errBuf.String())
+
+	folders, _ := store.ListFolders("user1")
+	assert.Len(t, folders, 1)
+	assert.Equal(t, "papers", folders[0].Name)
+	files, _ := store.ListFiles("user1", "papers")
+	assert.Len(t, files, 2)
+	assert.Equal(t, []string{"work"}, files[0].Tags)
+
+	// the methods called directly write each change to the store, and those
+	// making several as they return
+	sys.CreateFolder(outBuf, errBuf, "user1", "direct", "")
+	sys.CreateFile(outBuf, errBuf, "user1", "direct", "d", "")
+	sys.WriteFile(outBuf, errBuf, "user1", "direct", "d", []byte("content"))
+	record, _ := store.GetFile("user1", "direct", "d")
+	assert.Equal(t, int64(7), record.Size)
+	root := t.TempDir()
+	assert.NoError(t, os.Mkdir(root+"/imported", 0755))
+	assert.NoError(t, os.WriteFile(root+"/imported/x", []byte("host"), 0644))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(root+"/imported/x", mtime, mtime))
+	assert.Equal(t, Succeed, sys.Import(outBuf, errBuf, "user1", root, false))
+	record, _ = store.GetFile("user1", "imported", "x")
+	assert.Equal(t, int64(4), record.Size)
+	assert.True(t, mtime.Equal(record.ModifiedAt))
+	assert.Empty(t, errBuf.String())
+	assert.NoError(t, store.Close())
+
+	// the snapshot leaves the users to the store
+	snapshot := t.TempDir() + "/vfs.json"
+	assert.NoError(t, sys.Save(snapshot))
+	data, _ := os.ReadFile(snapshot)
+	assert.NotContains(t, string(data), "papers")
+
+	store, err = OpenDiskStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, sys.Open(store))
+	assert.NoError(t, sys.Load(snapshot))
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("papers").GetFile("c"))
+	assert.Len(t, sys.Index.Search("user1", []string{"reports"}), 1)
+}
+
+func TestBlobStore(t *testing.T) {
+	blobs := NewBlobStore()
+	blobs.SetSource(NewMemoryStore())
+	hash := blobs.Put([]byte("hello"))
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", hash)
+	assert.Equal(t, hash, blobs.Put([]byte("hello")))
+	blobs.Ref(hash)
+	assert.Equal(t, 3, blobs.Refs(hash))
+	count, size := blobs.Stats()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, int64(5), size)
+
+	// a staging store copies the blobs it uses, and applies its changes
+	staging := blobs.Stage()
+	staging.Release(hash)
+	other := staging.Put([]byte("world"))
+	assert.Equal(t, 2, staging.Refs(hash))
+	assert.Equal(t, 3, blobs.Refs(hash))
+	assert.Equal(t, 0, blobs.Refs(other))
+	count, _ = staging.Stats()
+	assert.Equal(t, 2, count)
+	staging.Release(other)
+	blobs.Apply(staging)
+	assert.Equal(t, 2, blobs.Refs(hash))
+	count, _ = blobs.Stats()
+	assert.Equal(t, 1, count)
+
+	for i := 0; i < 2; i++ {
+		blobs.Release(hash)
+	}
+	_, ok := blobs.Get(hash)
+	assert.False(t, ok)
+	added, removed := blobs.pending()
+	assert.Empty(t, added)
+	assert.ElementsMatch(t, []string{hash, other}, removed)
+}
+
+func TestFileContent(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("register user2")
+	sys.Execute("create-folder user1 docs")
+	sys.Execute("create-folder user1 backup")
+	sys.Execute("create-folder user2 docs")
+	sys.Execute("create-file user1 docs a")
+	sys.Execute("create-file user2 docs b")
+
+	res := sys.Run(outBuf, errBuf, "write-file user1 docs a hello")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Write 5 bytes to user1/docs/a successfully.\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	host := t.TempDir() + "/hello.txt"
+	assert.NoError(t, os.WriteFile(host, []byte("hello"), 0644))
+	res = sys.Run(outBuf, errBuf, "write-file user2 docs b --from "+host)
+	assert.Equal(t, Succeed, res)
+	res = sys.Run(outBuf, errBuf, "write-file user1 docs missing x")
+	assert.Equal(t, ErrNotExists, res)
+	res = sys.Run(outBuf, errBuf, "write-file user1 docs a x --from "+host)
+	assert.Equal(t, ErrArgsLength, res)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "read-file user2 docs b")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "hello", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// copies and identical contents share one blob
+	sys.Run(outBuf, errBuf, "copy-file user1 docs a backup")
+	hash := sys.GetUser("user1").GetFolder("docs").GetFile("a").Chunks[0]
+	assert.Equal(t, hash, sys.GetUser("user1").GetFolder("backup").GetFile("a").Chunks[0])
+	assert.Equal(t, 3, sys.Blobs.Refs(hash))
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "du")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "user1 2 files 10 logical 5 physical\nuser2 1 files 5 logical 5 physical\ntotal 3 files 15 logical 5 physical\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+	res = sys.Run(outBuf, errBuf, "du user2 --output csv")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "user,files,logical,physical\nuser2,1,5,5\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// a rolled back transaction leaves the references as they were
+	sys.Run(outBuf, errBuf, "begin")
+	sys.Run(outBuf, errBuf, "delete-folder user1 backup")
+	sys.Run(outBuf, errBuf, "rollback")
+	assert.Equal(t, 3, sys.Blobs.Refs(hash))
+	ResetBufs(outBuf, errBuf)
+
+	// the blob is collected with its last reference
+	sys.Run(outBuf, errBuf, "delete-folder user1 backup")
+	sys.Run(outBuf, errBuf, "write-file user1 docs a bye")
+	assert.Equal(t, 1, sys.Blobs.Refs(hash))
+	sys.Run(outBuf, errBuf, "delete-file user2 docs b")
+	_, ok := sys.Blobs.Get(hash)
+	assert.False(t, ok)
+	count, size := sys.Blobs.Stats()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, int64(3), size)
+	assert.Empty(t, errBuf.String())
+}
+
+func TestFileContentStore(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	path := t.TempDir() + "/vfs.db"
+
+	store, err := OpenDiskStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, sys.Open(store))
+	sys.Run(outBuf, errBuf, "register user1")
+	sys.Run(outBuf, errBuf, "create-folder user1 docs")
+	sys.Run(outBuf, errBuf, "create-file user1 docs a")
+	sys.Run(outBuf, errBuf, "create-file user1 docs b")
+	sys.Run(outBuf, errBuf, "write-file user1 docs a hello")
+	sys.Run(outBuf, errBuf, "write-file user1 docs b hello")
+	sys.Run(outBuf, errBuf, "write-file user1 docs b other")
+	sys.Run(outBuf, errBuf, "write-file user1 docs b bye")
+	assert.Empty(t, errBuf.String())
+	hashes, _ := store.ListBlobs()
+	assert.Len(t, hashes, 2)
+	assert.NoError(t, store.Close())
+
+	store, err = OpenDiskStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	assert.NoError(t, sys.Open(store))
+	file := sys.GetUser("user1").GetFolder("docs").GetFile("a")
+	assert.Equal(t, "hello", string(sys.Content(file)))
+	assert.Equal(t, int64(5), file.Size)
+	assert.Equal(t, 1, sys.Blobs.Refs(file.Chunks[0]))
+	count, size := sys.Blobs.Stats()
+	assert.Equal(t, 2, count)
+	assert.Equal(t, int64(8), size)
+
+	// the snapshot of the memory store carries the contents
+	snapshot := t.TempDir() + "/vfs.json"
+	sys.Store = NewMemoryStore()
+	assert.NoError(t, sys.Save(snapshot))
+	saved := &System{Index: NewIndex(), Blobs: NewBlobStore(), Webhooks: NewWebhookDispatcher()}
+	assert.NoError(t, saved.Load(snapshot))
+	file = saved.GetUser("user1").GetFolder("docs").GetFile("b")
+	assert.Equal(t, "bye", string(saved.Content(file)))
+}
+
+func TestBlobDir(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	path := t.TempDir() + "/vfs.json"
+
+	dir, err := OpenBlobDir(path + ".blobs")
+	assert.NoError(t, err)
+	sys.Blobs.SetSource(dir)
+	sys.Run(outBuf, errBuf, "register user1")
+	sys.Run(outBuf, errBuf, "create-folder user1 docs")
+	sys.Run(outBuf, errBuf, "create-file user1 docs a")
+	sys.Run(outBuf, errBuf, "create-file user1 docs b")
+	sys.Run(outBuf, errBuf, "write-file user1 docs a hello")
+	sys.Run(outBuf, errBuf, "write-file user1 docs b hello")
+	assert.Empty(t, errBuf.String())
+
+	// a blob is written once, after its command, and no longer held in memory
+	hash := HashContent([]byte("hello"))
+	hashes, err := dir.ListBlobs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{hash}, hashes)
+	assert.Nil(t, sys.Blobs.blobs[hash].data)
+	file := sys.GetUser("user1").GetFolder("docs").GetFile("a")
+	assert.Equal(t, "hello", string(sys.Content(file)))
+	count, size := sys.Blobs.Stats()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, int64(5), size)
+
+	// the snapshot holds the users only
+	assert.NoError(t, sys.Save(path))
+	data, _ := os.ReadFile(path)
+	assert.NotContains(t, string(data), "Blobs")
+
+	// a dropped blob is deleted once the snapshot no longer refers to it
+	sys.Run(outBuf, errBuf, "write-file user1 docs a bye")
+	sys.Run(outBuf, errBuf, "write-file user1 docs b bye")
+	hashes, _ = dir.ListBlobs()
+	assert.Len(t, hashes, 2)
+	assert.NoError(t, sys.Save(path))
+	hashes, _ = dir.ListBlobs()
+	assert.Equal(t, []string{HashContent([]byte("bye"))}, hashes)
+
+	// the blobs are read on demand once loaded
+	loaded := &System{Index: NewIndex(), Blobs: NewBlobStore(), Webhooks: NewWebhookDispatcher()}
+	loaded.Blobs.SetSource(dir)
+	assert.NoError(t, loaded.Load(path))
+	file = loaded.GetUser("user1").GetFolder("docs").GetFile("b")
+	assert.Equal(t, "bye", string(loaded.Content(file)))
+	assert.Equal(t, 2, loaded.Blobs.Refs(file.Chunks[0]))
+	count, size = loaded.Blobs.Stats()
+	assert.Equal(t, 1, count)
+	assert.Equal(t, int64(3), size)
+
+	// the blobs embedded in an older snapshot are moved to the directory
+	hash = HashContent([]byte("embedded"))
+	user := CreateUser("user2")
+	folder := CreateFolder("docs", "", "user2", testEpoch)
+	file = CreateFile("c", "", "docs", "user2", testEpoch)
+	file.Chunks, file.ChunkSize, file.Size, file.StoredSize = []string{hash}, ChunkSize, 8, 8
+	folder.AddFile("c", file)
+	user.AddFolder("docs", folder)
+	data, _ = json.Marshal(Snapshot{
+		Version: SnapshotVersion,
+		Users:   map[string]*User{"user2": user},
+		Blobs:   map[string][]byte{hash: []byte("embedded")},
+	})
+	old := t.TempDir() + "/old.json"
+	assert.NoError(t, os.WriteFile(old, data, 0644))
+	assert.NoError(t, loaded.Load(old))
+	file = loaded.GetUser("user2").GetFolder("docs").GetFile("c")
+	assert.Equal(t, "embedded", string(loaded.Content(file)))
+	assert.NoError(t, loaded.Save(old))
+	hashes, _ = dir.ListBlobs()
+	assert.Equal(t, []string{hash}, hashes)
+
+	// names which are not hashes never leave the directory
+	assert.Error(t, dir.PutBlob("../escape", []byte("x")))
+	got, err := dir.GetBlob("../vfs.json")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestChunkedContent(t *testing.T) {
+	defer func(n int64) { ChunkSize = n }(ChunkSize)
+	ChunkSize = 4
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 docs")
+	sys.Execute("create-file user1 docs a")
+	sys.Execute("write-file user1 docs a abcdefghij")
+	file := sys.GetUser("user1").GetFolder("docs").GetFile("a")
+	assert.Len(t, file.Chunks, 3)
+	before := append([]string(nil), file.Chunks...)
+
+	_, err := sys.OpenFile("user1", "docs", "missing")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	h, err := sys.OpenFile("user1", "docs", "a")
+	assert.NoError(t, err)
+	events, cancel := sys.Subscribe(EventFilter{UserName: "user1"})
+	defer cancel()
+
+	// a write only rewrites the chunks it touches
+	n, err := h.WriteAt([]byte("XY"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	file = sys.GetUser("user1").GetFolder("docs").GetFile("a")
+	assert.Equal(t, before[0], file.Chunks[0])
+	assert.NotEqual(t, before[1], file.Chunks[1])
+	assert.Equal(t, before[2], file.Chunks[2])
+	_, ok := sys.Blobs.Get(before[1])
+	assert.False(t, ok)
+
+	// a write past the end fills the gap with zeros
+	_, err = h.WriteAt([]byte("Z"), 14)
+	assert.NoError(t, err)
+	size, _ := h.Size()
+	assert.Equal(t, int64(15), size)
+
+	_, err = h.Seek(3, io.SeekStart)
+	assert.NoError(t, err)
+	data, err := io.ReadAll(h)
+	assert.NoError(t, err)
+	assert.Equal(t, "deXYhij\x00\x00\x00\x00Z", string(data))
+	buf := make([]byte, 4)
+	n, err = h.ReadAt(buf, 12)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "\x00\x00Z", string(buf[:n]))
+
+	assert.Empty(t, events)
+	assert.NoError(t, h.Close())
+	event := <-events
+	assert.Equal(t, EventFileModified, event.Type)
+	assert.ErrorIs(t, h.Close(), os.ErrClosed)
+
+	// ranged reads
+	res := sys.Run(outBuf, errBuf, "read-file user1 docs a --range 2-5")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "cdeX", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+	sys.Run(outBuf, errBuf, "read-file user1 docs a --range -1")
+	assert.Equal(t, "Z", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+	res = sys.Run(outBuf, errBuf, "read-file user1 docs a --range 20-")
+	assert.Equal(t, ErrInvalidFlag, res)
+	ResetBufs(outBuf, errBuf)
+
+	h, _ = sys.OpenFile("user1", "docs", "a")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, h.Name(), file.CreatedAt, h)
+	}))
+	defer server.Close()
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Range", "bytes=1-3")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bcd", string(body))
+
+	// the handle fails once the file is deleted
+	sys.Execute("delete-file user1 docs a")
+	_, err = h.Read(buf)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	count, _ := sys.Blobs.Stats()
+	assert.Equal(t, 0, count)
+
+	// appended bytes are kept until their chunk is complete
+	sys.Execute("create-file user1 docs b")
+	file = sys.GetUser("user1").GetFolder("docs").GetFile("b")
+	h, _ = sys.OpenFile("user1", "docs", "b")
+	for i, piece := range []string{"ab", "cd", "ef"} {
+		_, err = h.WriteAt([]byte(piece), int64(2*i))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, "abcd", string(sys.Content(file)))
+	size, _ = h.Size()
+	assert.Equal(t, int64(6), size)
+	assert.Equal(t, "abcdef", string(sys.Content(file)))
+	_, err = h.WriteAt([]byte("gh"), 6)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Close())
+	assert.Equal(t, "abcdefgh", string(sys.Content(file)))
+	assert.Len(t, file.Chunks, 2)
+
+	// and a stream is appended a chunk at a time
+	n64, err := sys.appendContent(file, iotest.OneByteReader(strings.NewReader("ijklmn")))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), n64)
+	assert.Equal(t, "abcdefghijklmn", string(sys.Content(file)))
+	assert.Len(t, file.Chunks, 4)
+
+	// reading through a handle saves the access time on Close, unpublished
+	sys.Clock.(*FakeClock).Advance(time.Hour)
+	modified := file.ModifiedAt
+	for len(events) > 0 {
+		<-events
+	}
+	h, _ = sys.OpenFile("user1", "docs", "b")
+	_, err = io.Copy(io.Discard, h)
+	assert.NoError(t, err)
+	assert.Equal(t, testEpoch, file.AccessedAt)
+	assert.NoError(t, h.Close())
+	assert.Equal(t, testEpoch.Add(time.Hour), file.AccessedAt)
+	assert.Equal(t, modified, file.ModifiedAt)
+	record, _ := sys.Store.GetFile("user1", "docs", "b")
+	assert.Equal(t, testEpoch.Add(time.Hour), record.AccessedAt)
+	select {
+	case event := <-events:
+		assert.Fail(t, "unexpected event", event)
+	default:
+	}
+}
+
+// logContent returns n bytes of log lines, which compress well.
+func logContent(n int) []byte {
+	var buf bytes.Buffer
+	for i := 0; buf.Len() < n; i++ {
+		fmt.Fprintf(&buf, "2024-08-01 09:30:%02d INFO request %d served in %dms\n", i%60, i, i%250)
+	}
+	return buf.Bytes()[:n]
+}
+
+func TestCompression(t *testing.T) {
+	defer func(n int64) { ChunkSize = n }(ChunkSize)
+	ChunkSize = 256
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 logs")
+	sys.Execute("create-folder user1 plain")
+	sys.Execute("create-file user1 logs old")
+	content := logContent(4000)
+	sys.WriteFile(outBuf, errBuf, "user1", "logs", "old", content)
+	ResetBufs(outBuf, errBuf)
+
+	res := sys.Run(outBuf, errBuf, "compress-folder user1 logs gzip")
+	assert.Equal(t, Succeed, res)
+	old := sys.GetUser("user1").GetFolder("logs").GetFile("old")
+	assert.Equal(t, "gzip", old.Compression)
+	assert.Equal(t, fmt.Sprintf("Compress user1/logs with gzip successfully, 4000 bytes stored in %d.\n", old.StoredSize), outBuf.String())
+	assert.Less(t, old.StoredSize, old.Size/2)
+	ResetBufs(outBuf, errBuf)
+
+	// new files take the policy of their folder
+	sys.Execute("create-file user1 logs new")
+	sys.WriteFile(outBuf, errBuf, "user1", "logs", "new", content)
+	file := sys.GetUser("user1").GetFolder("logs").GetFile("new")
+	assert.Equal(t, "gzip", file.Compression)
+	assert.Equal(t, old.Chunks, file.Chunks)
+	ResetBufs(outBuf, errBuf)
+
+	h, err := sys.OpenFile("user1", "logs", "new")
+	assert.NoError(t, err)
+	_, err = h.WriteAt([]byte("PATCHED"), 1000)
+	assert.NoError(t, err)
+	assert.NoError(t, h.Close())
+	expected := append([]byte(nil), content...)
+	copy(expected[1000:], "PATCHED")
+	assert.Equal(t, expected, sys.Content(file))
+
+	for _, compression := range []string{"zlib", "flate", "none"} {
+		res = sys.Run(outBuf, errBuf, "compress-folder user1 logs "+compression)
+		assert.Equal(t, Succeed, res, compression)
+		assert.Equal(t, expected, sys.Content(file), compression)
+		assert.Equal(t, content, sys.Content(old), compression)
+		ResetBufs(outBuf, errBuf)
+	}
+	assert.Equal(t, "", file.Compression)
+	assert.Equal(t, file.Size, file.StoredSize)
+
+	res = sys.Run(outBuf, errBuf, "compress-folder user1 logs lz4")
+	assert.Equal(t, ErrInvalidFlag, res)
+	ResetBufs(outBuf, errBuf)
+
+	// a copied file keeps its compression
+	sys.Run(outBuf, errBuf, "compress-folder user1 logs flate")
+	sys.Run(outBuf, errBuf, "copy-file user1 logs old plain")
+	copied := sys.GetUser("user1").GetFolder("plain").GetFile("old")
+	assert.Equal(t, "flate", copied.Compression)
+	assert.Equal(t, content, sys.Content(copied))
+	assert.Empty(t, errBuf.String())
+}
+
+func TestPBKDF2(t *testing.T) {
+	// test vectors of RFC 7914
+	assert.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783",
+		hex.EncodeToString(pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)))
+	assert.Equal(t, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d",
+		hex.EncodeToString(pbkdf2([]byte("Password"), []byte("NaCl"), 80000, 64)))
+	assert.Equal(t, "c5e478d59288c841aa530db6845c4c8d962893a0",
+		hex.EncodeToString(pbkdf2([]byte("password"), []byte("salt"), 4096, 20)))
+}
+
+func TestEncryption(t *testing.T) {
+	defer func(n int) { KDFIterations = n }(KDFIterations)
+	KDFIterations = 1000
+	defer func(n int64) { ChunkSize = n }(ChunkSize)
+	ChunkSize = 4
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 docs secret-plans")
+	sys.Execute("create-file user1 docs notes top-secret")
+	content := []byte("attack at dawn")
+	sys.WriteFile(io.Discard, io.Discard, "user1", "docs", "notes", content)
+
+	res := sys.Run(outBuf, errBuf, "encrypt-user user1 hunter2")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Encrypt user1 successfully.\n", outBuf.String())
+	file := sys.GetUser("user1").GetFolder("docs").GetFile("notes")
+	assert.Equal(t, 1, file.KeyVersion)
+	assert.Equal(t, content, sys.Content(file))
+	for i, hash := range file.Chunks {
+		stored, _ := sys.Blobs.Get(hash)
+		assert.False(t, bytes.Contains(stored, content[i*4:min(i*4+4, len(content))]))
+	}
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "encrypt-user user1 hunter2")
+	assert.Equal(t, ErrAlreadyExists, res)
+	assert.Equal(t, "Error: The [key of user1] has already existed.\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// a file failing to be encrypted leaves the user as it was
+	sys.Execute("register user2")
+	sys.Execute("create-folder user2 docs")
+	sys.Execute("create-file user2 docs a")
+	sys.Execute("create-file user2 docs b")
+	sys.WriteFile(io.Discard, io.Discard, "user2", "docs", "a", []byte("first file"))
+	sys.WriteFile(io.Discard, io.Discard, "user2", "docs", "b", []byte("second file"))
+	a, b := sys.GetUser("user2").GetFolder("docs").GetFile("a"), sys.GetUser("user2").GetFolder("docs").GetFile("b")
+	sys.Blobs.drop(b.Chunks[0])
+	version := sys.version
+	res = sys.Run(outBuf, errBuf, "encrypt-user user2 hunter2")
+	assert.Equal(t, ErrIO, res)
+	assert.False(t, sys.GetUser("user2").Encrypted())
+	assert.Nil(t, sys.GetUser("user2").keys)
+	assert.Equal(t, 0, a.KeyVersion)
+	assert.Equal(t, []byte("first file"), sys.Content(a))
+	assert.Equal(t, version, sys.version)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "unlock user2 hunter2")
+	assert.Equal(t, ErrNotExists, res)
+	assert.Equal(t, "Error: The [key of user2] doesn't exist.\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// the records are sealed in the store and the snapshot, names aside
+	store := NewMemoryStore()
+	blobs, err := sys.Blobs.Data()
+	assert.NoError(t, err)
+	sys.Store = store
+	sys.Blobs.SetSource(store)
+	assert.NoError(t, sys.Blobs.Restore(blobs, sys.UserTable))
+	assert.NoError(t, sys.writeAll())
+	record, _ := store.GetFolder("user1", "docs")
+	assert.Empty(t, record.Description)
+	assert.NotEmpty(t, record.Sealed)
+	path := t.TempDir() + "/vfs.json"
+	assert.NoError(t, sys.Save(path))
+	data, _ := os.ReadFile(path)
+	assert.NotContains(t, string(data), "secret-plans")
+	assert.NotContains(t, string(data), "top-secret")
+	assert.Contains(t, string(data), "notes")
+
+	// a reopened user is locked until unlocked with the passphrase
+	assert.NoError(t, sys.Open(store))
+	assert.True(t, sys.GetUser("user1").Locked())
+	res = sys.Run(outBuf, errBuf, "list-files user1 docs")
+	assert.Equal(t, ErrLocked, res)
+	assert.Equal(t, "Error: The [user1] is locked. Check `unlock` to load its keys.\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "unlock user1 hunter3")
+	assert.Equal(t, ErrWrongKey, res)
+	assert.Equal(t, "Error: The passphrase of [user1] is wrong.\n", errBuf.String())
+	assert.Equal(t, ExitFailure, res.ExitCode())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "unlock user1 hunter2")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Unlock user1 successfully.\n", outBuf.String())
+	folder := sys.GetUser("user1").GetFolder("docs")
+	assert.Equal(t, "secret-plans", folder.Description)
+	file = folder.GetFile("notes")
+	assert.Equal(t, "top-secret", file.Description)
+	assert.Equal(t, content, sys.Content(file))
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "search user1 dawn OR secret")
+	assert.Equal(t, Succeed, res)
+	assert.Contains(t, outBuf.String(), "user1/docs/notes")
+	ResetBufs(outBuf, errBuf)
+
+	// the content is encrypted with a rotated key once written
+	res = sys.Run(outBuf, errBuf, "rotate-key user1 hunter2")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Rotate the key of user1 to version 2 successfully.\n", outBuf.String())
+	assert.Equal(t, 1, file.KeyVersion)
+	assert.Equal(t, content, sys.Content(file))
+	sys.Run(outBuf, errBuf, "write-file user1 docs notes retreat")
+	assert.Equal(t, 2, file.KeyVersion)
+	assert.Equal(t, "retreat", string(sys.Content(file)))
+	assert.Empty(t, errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// a snapshot opened with the wrong passphrase fails
+	sys.Store = nil
+	sys.Run(outBuf, errBuf, "webhooks add user1 http://localhost --secret hook-s3cret")
+	ResetBufs(outBuf, errBuf)
+	assert.NoError(t, sys.Save(path))
+	data, _ = os.ReadFile(path)
+	assert.NotContains(t, string(data), "hook-s3cret")
+	assert.NoError(t, sys.Load(path))
+	assert.Empty(t, sys.Webhooks.Hooks()[0].Secret)
+	assert.ErrorIs(t, sys.UnlockAll("hunter3"), ErrWrongPassphrase)
+	assert.True(t, sys.GetUser("user1").Locked())
+
+	// the sealed secret of a locked user is kept as it is
+	assert.NoError(t, sys.Save(path))
+	assert.NoError(t, sys.Load(path))
+	assert.NoError(t, sys.UnlockAll("hunter2"))
+	file = sys.GetUser("user1").GetFolder("docs").GetFile("notes")
+	assert.Equal(t, "retreat", string(sys.Content(file)))
+	assert.Equal(t, "hook-s3cret", sys.Webhooks.Hooks()[0].Secret)
+	assert.Nil(t, sys.Webhooks.Hooks()[0].Sealed)
+	sys.Webhooks.Restore(nil, nil)
+
+	// the passphrase is not written to the audit log
+	entry := auditEntry(sys.Commands.Lookup("unlock"), "unlock", []string{"user1", "hunter2"}, Succeed, testEpoch)
+	assert.Equal(t, []string{"user1", "***"}, entry.Args)
+	entry = auditEntry(sys.Commands.Lookup("unlock"), "unlock", []string{"user1"}, Succeed, testEpoch)
+	assert.Equal(t, []string{"user1"}, entry.Args)
+
+	// the audit log of an encrypted user keeps the names only
+	audit, err := OpenAuditLog(t.TempDir() + "/audit.jsonl")
+	assert.NoError(t, err)
+	defer audit.Close()
+	sys.Audit = audit
+	sys.Run(outBuf, errBuf, "create-file user1 docs plans top-secret")
+	sys.Run(outBuf, errBuf, "write-file user1 docs plans retreat")
+	sys.Run(outBuf, errBuf, "tag user1 docs/plans urgent")
+	sys.Run(outBuf, errBuf, "register user2")
+	sys.Run(outBuf, errBuf, "create-folder user2 docs public")
+	sys.Audit = nil
+	entries, err := audit.Query(AuditFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 5)
+	assert.Equal(t, []string{"user1", "docs", "plans", "***"}, entries[0].Args)
+	assert.Equal(t, []string{"user1", "docs", "plans", "***"}, entries[1].Args)
+	assert.Equal(t, []string{"user1", "docs/plans", "***"}, entries[2].Args)
+	assert.Equal(t, []string{"user2", "docs", "public"}, entries[4].Args)
+}
+
+func TestCheck(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 docs")
+	sys.Execute("create-folder user1 logs")
+	sys.Execute("create-file user1 docs a")
+	sys.Execute("create-file user1 docs b")
+	sys.WriteFile(io.Discard, io.Discard, "user1", "docs", "a", []byte("hello"))
+	sys.WriteFile(io.Discard, io.Discard, "user1", "docs", "b", []byte("world"))
+
+	res := sys.Run(outBuf, errBuf, "fsck")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "names: ok\nreferences: ok\nuniqueness: ok\ntimestamps: ok\ncontent: ok\n"+
+		"Check 1 users, 2 folders, 2 files and 2 blobs: 0 problems, 0 repaired.\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// a folder name left stale, as by older versions of rename-folder
+	sys.Execute("rename-folder user1 docs papers")
+	folder := sys.GetUser("user1").GetFolder("papers")
+	folder.Files["a"].FolderName = "docs"
+	folder.Files["b"].FolderName = "docs"
+	folder.Files["b"].Name = "a"
+	folder.Files["a"].CreatedAt = time.Time{}
+	folder.Files["a"].ModifiedAt = time.Time{}
+	folder.Files["b"].AccessedAt = testEpoch.Add(time.Hour)
+	sys.GetUser("user1").Folders["bad name"] = CreateFolder("bad name", "", "user1", testEpoch)
+	sys.Blobs.Ref(folder.Files["a"].Chunks[0])
+
+	report := sys.Check()
+	assert.Equal(t, 8, report.Unrepaired())
+	res = sys.Run(outBuf, errBuf, "fsck")
+	assert.Equal(t, ErrCheckFailed, res)
+	assert.Equal(t, `names: 1 problems
+  user1/bad name: name "bad name" breaks the chars rule: ' ' is not an ASCII letter, an ASCII digit or one of _
+references: 2 problems
+  user1/papers/a: folder name is docs, expected papers (repairable)
+  user1/papers/b: folder name is docs, expected papers (repairable)
+uniqueness: 1 problems
+  user1/papers/b: file name a is taken by another file (repairable)
+timestamps: 3 problems
+  user1/papers/a: creation time is not set (repairable)
+  user1/papers/a: modification time is not set (repairable)
+  user1/papers/b: access time 2024-08-01T10:00:00Z is in the future (repairable)
+content: 1 problems
+  `+folder.Files["a"].Chunks[0]+`: blob has 2 references, expected 1 (repairable)
+Check 1 users, 3 folders, 2 files and 2 blobs: 8 problems, 0 repaired.
+`, outBuf.String())
+	assert.Equal(t, "Error: 8 problems are left. Check `fsck --repair` to fix those it can.\n", errBuf.String())
+	assert.Equal(t, ExitFailure, res.ExitCode())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "fsck --repair --output csv")
+	assert.Equal(t, ErrCheckFailed, res)
+	assert.Contains(t, outBuf.String(), "category,path,problem,repairable,repaired\n")
+	assert.Contains(t, outBuf.String(), "references,user1/papers/a,\"folder name is docs, expected papers\",true,true\n")
+	assert.Equal(t, "Error: 1 problems are left. Check `fsck --repair` to fix those it can.\n", errBuf.String())
+	assert.Equal(t, "papers", folder.Files["a"].FolderName)
+	assert.Equal(t, "b", folder.Files["b"].Name)
+	assert.False(t, folder.Files["a"].CreatedAt.IsZero())
+	assert.False(t, folder.Files["a"].ModifiedAt.IsZero())
+	assert.Equal(t, testEpoch, folder.Files["b"].AccessedAt)
+	assert.Equal(t, 1, sys.Blobs.Refs(folder.Files["a"].Chunks[0]))
+	ResetBufs(outBuf, errBuf)
+
+	// a damaged content cannot be repaired
+	delete(sys.GetUser("user1").Folders, "bad name")
+	sys.Blobs.blobs[folder.Files["b"].Chunks[0]].data = []byte("w0rld")
+	report = sys.Check()
+	assert.Len(t, report.Problems, 1)
+	assert.Equal(t, &Problem{Category: CheckContent, Path: "user1/papers/b", Message: "chunk 0 does not match its checksum"}, report.Problems[0])
+	assert.False(t, report.Problems[0].Repairable())
+}
+
+func TestTimestamps(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute("create-folder user1 docs")
+	sys.Execute("create-file user1 docs a")
+
+	folder := sys.GetUser("user1").GetFolder("docs")
+	file := folder.GetFile("a")
+	assert.Equal(t, folder.CreatedAt, folder.AccessedAt)
+	assert.Equal(t, file.CreatedAt, file.ModifiedAt)
+	assert.Equal(t, file.CreatedAt, file.AccessedAt)
+
+	past := testEpoch.Add(-time.Hour)
+	age := func() {
+		folder.ModifiedAt, folder.AccessedAt = past, past
+		file.ModifiedAt, file.AccessedAt = past, past
+	}
+
+	age()
+	sys.Execute("set-description user1 docs a notes")
+	assert.True(t, file.ModifiedAt.After(past))
+	assert.Equal(t, past, folder.ModifiedAt)
+
+	age()
+	sys.Execute("create-file user1 docs b")
+	assert.True(t, folder.ModifiedAt.After(past))
+	age()
+	sys.Execute("delete-file user1 docs b")
+	assert.True(t, folder.ModifiedAt.After(past))
+	age()
+	sys.Execute("rename-folder user1 docs papers")
+	assert.True(t, folder.ModifiedAt.After(past))
+
+	age()
+	res := sys.Run(outBuf, errBuf, "read-file user1 papers a")
+	assert.Equal(t, Succeed, res)
+	assert.True(t, file.AccessedAt.After(past))
+	assert.Equal(t, past, file.ModifiedAt)
+	ResetBufs(outBuf, errBuf)
+
+	age()
+	res = sys.Run(outBuf, errBuf, "touch user1 papers a")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Touch user1/papers/a successfully.\n", outBuf.String())
+	assert.True(t, file.AccessedAt.After(past))
+	assert.Equal(t, file.AccessedAt, file.ModifiedAt)
+	assert.Equal(t, past, folder.ModifiedAt)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "touch user1 papers")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Touch user1/papers successfully.\n", outBuf.String())
+	assert.Equal(t, folder.AccessedAt, folder.ModifiedAt)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "touch user1 papers c")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Create c in user1/papers successfully.\n", outBuf.String())
+	assert.NotNil(t, folder.GetFile("c"))
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "touch user1 nothing")
+	assert.Equal(t, ErrNotExists, res)
+	ResetBufs(outBuf, errBuf)
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	file.CreatedAt, file.ModifiedAt, file.AccessedAt = created, created.Add(time.Hour), created.Add(2*time.Hour)
+	res = sys.Run(outBuf, errBuf, "stat user1 papers a --tz UTC")
+	assert.Equal(t, Succeed, res)
+	assert.Contains(t, outBuf.String(), "created_at: 2024-01-02 03:04:05\n"+
+		"modified_at: 2024-01-02 04:04:05\naccessed_at: 2024-01-02 05:04:05\n")
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "stat user1 papers a --output csv --tz UTC")
+	assert.Equal(t, Succeed, res)
+	assert.Contains(t, outBuf.String(), ",2024-01-02 03:04:05,2024-01-02 04:04:05,2024-01-02 05:04:05\n")
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "stat user1 papers missing")
+	assert.Equal(t, ErrNotExists, res)
+	ResetBufs(outBuf, errBuf)
+
+	// the most recently modified first
+	folder.GetFile("c").ModifiedAt = created
+	file.ModifiedAt = created.Add(time.Hour)
+	res = sys.Run(outBuf, errBuf, "list-files user1 papers --sort-modified desc")
+	assert.Equal(t, Succeed, res)
+	assert.Regexp(t, `(?s)^a .*\nc `, outBuf.String())
+}
+
+func TestClock(t *testing.T) {
+	clock := NewFakeClock(testEpoch, time.Minute)
+	assert.Equal(t, testEpoch, clock.Now())
+	assert.Equal(t, testEpoch.Add(time.Minute), clock.Now())
+	clock.Advance(time.Hour)
+	assert.Equal(t, testEpoch.Add(time.Hour+2*time.Minute), clock.Now())
+	clock.Set(testEpoch)
+	assert.Equal(t, testEpoch, clock.Now())
+
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	for _, name := range []string{"b", "a", "c"} {
+		sys.Execute("create-folder user1 " + name)
+	}
+
+	// created at the same time, in the order they were created
+	res := sys.Run(outBuf, errBuf, "list-folders user1 --sort-created --tz UTC")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "b  2024-08-01 09:00:00 user1\na  2024-08-01 09:00:00 user1\nc  2024-08-01 09:00:00 user1\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	names := func(args string) []string {
+		opts, _ := ParseListArgs(SplitArgs(args), testEpoch)
+		folders, _, _ := sys.QueryFolders("user1", opts)
+		var out []string
+		for _, folder := range folders {
+			out = append(out, folder.Name)
+		}
+		return out
+	}
+	assert.Equal(t, []string{"c", "a", "b"}, names("--sort-created desc"))
+
+	// the sequence goes on in a transaction and after a reload
+	assert.NoError(t, sys.Tx(errBuf, func(tx *Tx) error {
+		tx.CreateFolder(io.Discard, io.Discard, "user1", "e", "")
+		return nil
+	}))
+	path := t.TempDir() + "/vfs.json"
+	assert.NoError(t, sys.Save(path))
+	sys.Reset()
+	sys = SetupTestSystem()
+	assert.NoError(t, sys.Load(path))
+	sys.Execute("create-folder user1 d")
+	assert.Equal(t, []string{"b", "a", "c", "e", "d"}, names("--sort-created"))
+}
+
+func TestTree(t *testing.T) {
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.Execute("register user1")
+	sys.Execute(`create-folder user1 docs "my docs"`)
+	sys.Execute("create-folder user1 empty")
+	sys.Execute(`create-file user1 docs b "second file"`)
+	sys.Execute("create-file user1 docs a")
+	sys.Execute("write-file user1 docs a hello")
+	sys.Execute("tag user1 docs work")
+
+	res := sys.Run(outBuf, errBuf, "tree user1")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, `user1 (2 folders, 2 files)
+├── docs (2 files)
+│   ├── a
+│   └── b
+└── empty (0 files)
+`, outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "tree user1 --sort-created desc --show-desc")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, `user1 (2 folders, 2 files)
+├── empty (0 files)
+└── docs (2 files): my docs
+    ├── a
+    └── b: second file
+`, outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// files cannot be sorted by files, so they fall back to their name
+	res = sys.Run(outBuf, errBuf, "tree user1 --sort files:desc --depth 1 --show-dates --time-format date")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, `user1 (2 folders, 2 files)
+├── docs (2 files) [created 2024-08-01, modified 2024-08-01]
+└── empty (0 files) [created 2024-08-01, modified 2024-08-01]
+`, outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	for _, args := range []string{"--depth 0", "--depth", "--limit 1", "--output json", "--sort weight"} {
+		res = sys.Run(outBuf, errBuf, "tree user1 "+args)
+		assert.Equal(t, ErrInvalidFlag, res, args)
+		ResetBufs(outBuf, errBuf)
+	}
+	res = sys.Run(outBuf, errBuf, "tree nobody")
+	assert.Equal(t, ErrNotExists, res)
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "stat user1 docs --tz UTC")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, `path: user1/docs
+type: folder
+owner: user1
+description: my docs
+files: 2
+size: 5
+stored_size: 5
+compression: none
+tags: work
+meta:
+created_at: 2024-08-01 09:00:00
+modified_at: 2024-08-01 09:00:00
+accessed_at: 2024-08-01 09:00:00
+`, outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "stat user1 docs a --output json")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, `[
+  {"path": "user1/docs/a", "type": "file", "owner": "user1", "description": "", "chunks": 1, "size": 5, "stored_size": 5, `+
+		`"compression": "none", "key_version": 0, "tags": [], "meta": {}, "created_at": "2024-08-01T09:00:00Z", `+
+		`"modified_at": "2024-08-01T09:00:00Z", "accessed_at": "2024-08-01T09:00:00Z"}
+]
+`, outBuf.String())
+}
+
+func TestNamingPolicy(t *testing.T) {
+	policy := &NamingPolicy{Letters: true, Digits: true, Unicode: true, Chars: "_-.", MaxLength: 8,
+		Reserved: []string{".", ".."}, NoLeading: "-.", NoTrailing: ".", NFC: true}
+	tests := []struct {
+		name string
+		rule string
+	}{
+		{"café-2", ""},
+		{"日本語", ""},
+		{"", RuleEmpty},
+		{"a/b", RuleSeparator},
+		{"..\\b", RuleSeparator},
+		{"a\x00", RuleSeparator},
+		{"cafe\u0301", RuleNFC},
+		{"..", RuleReserved},
+		{"too_long_name", RuleLength},
+		{"a b", RuleChars},
+		{"-a", RuleLeading},
+		{".hidden", RuleLeading},
+		{"a.", RuleTrailing},
+	}
+	for _, tt := range tests {
+		err := policy.Check(tt.name)
+		if tt.rule == "" {
+			assert.Nil(t, err, tt.name)
+		} else if assert.NotNil(t, err, tt.name) {
+			assert.Equal(t, tt.rule, err.Rule, tt.name)
+		}
+	}
+	assert.Equal(t, "a b breaks the chars rule: ' ' is not a letter, a digit or one of _-.", policy.Check("a b").Error())
+	assert.Equal(t, "café", policy.Normalize("cafe\u0301"))
+	assert.Equal(t, "a_b_c", policy.Sanitize("-a b/c."))
+	assert.Equal(t, "abcdefgh", policy.Sanitize("abcdefghij"))
+
+	// no policy allows the path separators
+	loose := &NamingPolicy{Letters: true, Chars: "_/\\"}
+	assert.Equal(t, "a/b breaks the separator rule: '/' separates paths", loose.Check("a/b").Error())
+	assert.Equal(t, RuleSeparator, DefaultNamingPolicy().Check("a\\b").Rule)
+	assert.Equal(t, "a_b_c", loose.Sanitize("a/b\\c"))
+
+	sys := SetupTestSystem()
+	defer sys.Reset()
+	outBuf, errBuf := GetTestBufs()
+	sys.FolderPolicy = policy
+	sys.Execute("register user1")
+
+	res := sys.Run(outBuf, errBuf, "create-folder user1 cafe\u0301")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Create café successfully.\n", outBuf.String())
+	assert.NotNil(t, sys.GetUser("user1").GetFolder("café"))
+	ResetBufs(outBuf, errBuf)
+
+	// the commands find it by any form of its name
+	res = sys.Run(outBuf, errBuf, "create-file user1 cafe\u0301 menu")
+	assert.Equal(t, Succeed, res)
+	assert.Equal(t, "Create menu in user1/café successfully.\n", outBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	res = sys.Run(outBuf, errBuf, "create-folder user1 ..")
+	assert.Equal(t, ErrInvalidName, res)
+	assert.Equal(t, "Error: The name .. breaks the reserved rule: \"..\" is reserved.\n", errBuf.String())
+	assert.Equal(t, ExitUsage, res.ExitCode())
+	ResetBufs(outBuf, errBuf)
+
+	// users and files keep the default policy
+	res = sys.Run(outBuf, errBuf, "create-file user1 café menu-2")
+	assert.Equal(t, ErrInvalidName, res)
+	assert.Equal(t, "Error: The name menu-2 breaks the chars rule: '-' is not an ASCII letter, an ASCII digit or one of _.\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+
+	// a policy applies to the names already taken
+	user := sys.GetUser("user1")
+	user.Folders["cafe\u0301s"] = CreateFolder("cafe\u0301s", "", "user1", testEpoch)
+	report := sys.Check()
+	assert.Len(t, report.Problems, 1)
+	assert.Equal(t, "name \"cafe\u0301s\" breaks the nfc rule: it is not in NFC form", report.Problems[0].Message)
+
+	// without a policy, names follow CharsValidator
+	sys.FolderPolicy = nil
+	res = sys.Run(outBuf, errBuf, "create-folder user1 café")
+	assert.Equal(t, ErrInvalidName, res)
+	assert.Equal(t, "Error: The name café breaks the chars rule: it does not match ^[a-zA-Z0-9_]+$.\n", errBuf.String())
+	ResetBufs(outBuf, errBuf)
+	sys.CharsValidator = regexp.MustCompile(`^.+$`)
+	res = sys.Run(outBuf, errBuf, "create-folder user1 ../up")
+	assert.Equal(t, ErrInvalidName, res)
+	assert.Equal(t, "Error: The name ../up breaks the separator rule: '/' separates paths.\n", errBuf.String())
+	assert.Equal(t, "a_b", sys.SanitizeName("a/b"))
+}
+
+func benchmarkCompression(b *testing.B, read bool) {
+	content := logContent(4 << 20)
+	for _, compression := range Compressions {
+		b.Run(compression, func(b *testing.B) {
+			sys := SetupTestSystem()
+			defer sys.Reset()
+			sys.Run(io.Discard, io.Discard, "register user1")
+			sys.Run(io.Discard, io.Discard, "create-folder user1 logs")
+			sys.Run(io.Discard, io.Discard, "compress-folder user1 logs "+compression)
+			sys.Run(io.Discard, io.Discard, "create-file user1 logs a")
+			sys.WriteFile(io.Discard, io.Discard, "user1", "logs", "a", content)
+			file := sys.GetUser("user1").GetFolder("logs").GetFile("a")
+			b.SetBytes(int64(len(content)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if read {
+					io.Copy(io.Discard, sys.contentSection(file, 0, file.Size))
+				} else {
+					sys.WriteFile(io.Discard, io.Discard, "user1", "logs", "a", content)
+				}
+			}
+			b.ReportMetric(float64(file.Size)/float64(file.StoredSize), "ratio")
+		})
+	}
+}
+
+func BenchmarkCompressionWrite(b *testing.B) {
+	benchmarkCompression(b, false)
+}
+
+func BenchmarkCompressionRead(b *testing.B) {
+	benchmarkCompression(b, true)
+}
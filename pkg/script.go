@@ -0,0 +1,60 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// RunScript to run the commands of a script, one per line. Blank lines and
+// lines starting with `#` are skipped, and every error is prefixed with the
+// script name and line number. A failing command aborts the transaction it
+// runs in, whose commit then rolls it back, and a transaction left open at the
+// end is rolled back. An `exit` line ends the script. It returns the outcome
+// of the first failing command, or Succeed.
+func (s *System) RunScript(r io.Reader, name string, w io.Writer, ew io.Writer, stopOnError bool) RespondType {
+	result := Succeed
+	scanner := bufio.NewScanner(r)
+
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var errBuf bytes.Buffer
+		res := s.Run(w, &errBuf, line)
+		for _, msg := range strings.Split(strings.TrimRight(errBuf.String(), "\n"), "\n") {
+			if msg != "" {
+				fmt.Fprintf(ew, "%s:%d: %s\n", name, lineNo, msg)
+			}
+		}
+
+		if res == Exited {
+			return result
+		}
+		if res.ExitCode() != 0 {
+			if tx := s.session.Load(); tx != nil {
+				tx.aborted = true
+			}
+			if result == Succeed {
+				result = res
+			}
+			if stopOnError {
+				return result
+			}
+		}
+	}
+
+	if s.InTx() {
+		s.Rollback(io.Discard, ew)
+		fmt.Fprintf(ew, "%s: Warning: The transaction left open is rolled back.\n", name)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(ew, "%s: %v\n", name, err)
+		return ErrIO
+	}
+	return result
+}
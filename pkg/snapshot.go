@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const SnapshotVersion = 1
+
+// Snapshot is the on-disk form of the state of a System.
+type Snapshot struct {
+	Version int
+	// Users is omitted when the system keeps them in a persistent Store.
+	Users map[string]*User `json:",omitempty"`
+	// Blobs are the contents of the files by hash, saved along the users
+	// unless they are kept in a BlobDir.
+	Blobs       map[string][]byte `json:",omitempty"`
+	Webhooks    []*Webhook        `json:",omitempty"`
+	DeadLetters []DeadLetter      `json:",omitempty"`
+}
+
+// Save to write the users of the system to path as a JSON snapshot. The file
+// is replaced atomically, so a crash never leaves a half-written snapshot, and
+// only committed transactions are saved. The folders, files and webhook
+// secrets of encrypted users are saved sealed, and loaded locked until Unlock.
+func (s *System) Save(path string) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hooks, err := s.sealedWebhooks()
+	if err != nil {
+		return err
+	}
+	snap := Snapshot{
+		Version:     SnapshotVersion,
+		Webhooks:    hooks,
+		DeadLetters: s.Webhooks.DeadLetters(),
+	}
+	if s.snapshotted() {
+		users, err := s.sealedUsers()
+		if err != nil {
+			return err
+		}
+		snap.Users = users
+		if s.Blobs.Embedded() {
+			if snap.Blobs, err = s.Blobs.Data(); err != nil {
+				return err
+			}
+		} else {
+			// the blobs the snapshot refers to are written before it
+			added, _ := s.Blobs.pending()
+			if err := s.Blobs.write(added); err != nil {
+				return err
+			}
+		}
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// the blobs collected since the last save are only deleted once no saved
+	// file refers to them, see flush
+	if s.snapshotted() && !s.Blobs.Embedded() {
+		_, removed := s.Blobs.pending()
+		return s.Blobs.collect(removed)
+	}
+	return nil
+}
+
+// snapshotted reports whether the users are saved in the snapshot, the store
+// not keeping them on disk.
+func (s *System) snapshotted() bool {
+	_, ok := s.Store.(*MemoryStore)
+	return ok || s.Store == nil
+}
+
+// Load to replace the users of the system by the snapshot at path, writing
+// them to the store, then rebuild the search index. A missing file leaves the
+// system empty, and a snapshot without users leaves those of the store.
+func (s *System) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("cannot parse snapshot %s: %w", path, err)
+	}
+	if snap.Version != SnapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d in %s", snap.Version, path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Webhooks.Restore(snap.Webhooks, snap.DeadLetters)
+	if snap.Users == nil {
+		return nil
+	}
+
+	users := snap.Users
+	for _, user := range users {
+		if user.Folders == nil {
+			user.Folders = make(map[string]*Folder, 0)
+		}
+		for _, folder := range user.Folders {
+			if folder.Files == nil {
+				folder.Files = make(map[string]*File, 0)
+			}
+			folder.fillTimes()
+		}
+	}
+
+	if err := s.Blobs.Restore(snap.Blobs, users); err != nil {
+		return err
+	}
+	s.UserTable = users
+	s.restoreSeq()
+	s.Index.Rebuild(s.UserTable)
+	s.version++
+	return s.writeAll()
+}
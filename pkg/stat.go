@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FolderStat is a folder with the totals of its files, as printed by `stat`.
+type FolderStat struct {
+	*Folder
+	Path       string
+	FileCount  int
+	Size       int64
+	StoredSize int64
+}
+
+// FileStat is a file as printed by `stat`.
+type FileStat struct {
+	*File
+	Path string
+}
+
+// FolderStatColumns are the fields of a folder printed by `stat`, one per line.
+var FolderStatColumns = []Column{
+	{"path", func(row any) any { return row.(FolderStat).Path }},
+	{"type", func(row any) any { return "folder" }},
+	{"owner", func(row any) any { return row.(FolderStat).UserName }},
+	{"description", func(row any) any { return row.(FolderStat).Description }},
+	{"files", func(row any) any { return row.(FolderStat).FileCount }},
+	{"size", func(row any) any { return row.(FolderStat).Size }},
+	{"stored_size", func(row any) any { return row.(FolderStat).StoredSize }},
+	{"compression", func(row any) any { return compressionName(row.(FolderStat).Compression) }},
+	{"tags", func(row any) any { return row.(FolderStat).Tags }},
+	{"meta", func(row any) any { return row.(FolderStat).Meta }},
+	{"created_at", func(row any) any { return row.(FolderStat).CreatedAt }},
+	{"modified_at", func(row any) any { return row.(FolderStat).ModifiedAt }},
+	{"accessed_at", func(row any) any { return row.(FolderStat).AccessedAt }},
+}
+
+// FileStatColumns are the fields of a file printed by `stat`, one per line.
+var FileStatColumns = []Column{
+	{"path", func(row any) any { return row.(FileStat).Path }},
+	{"type", func(row any) any { return "file" }},
+	{"owner", func(row any) any { return row.(FileStat).UserName }},
+	{"description", func(row any) any { return row.(FileStat).Description }},
+	{"chunks", func(row any) any { return len(row.(FileStat).Chunks) }},
+	{"size", func(row any) any { return row.(FileStat).Size }},
+	{"stored_size", func(row any) any { return row.(FileStat).StoredSize }},
+	{"compression", func(row any) any { return compressionName(row.(FileStat).Compression) }},
+	{"key_version", func(row any) any { return row.(FileStat).KeyVersion }},
+	{"tags", func(row any) any { return row.(FileStat).Tags }},
+	{"meta", func(row any) any { return row.(FileStat).Meta }},
+	{"created_at", func(row any) any { return row.(FileStat).CreatedAt }},
+	{"modified_at", func(row any) any { return row.(FileStat).ModifiedAt }},
+	{"accessed_at", func(row any) any { return row.(FileStat).AccessedAt }},
+}
+
+func compressionName(compression string) string {
+	if compression == "" {
+		return "none"
+	}
+	return compression
+}
+
+// Stat to print the fields of a folder of a user with the number and total
+// size of its files, or the fields of a file when filename is given
+func (s *System) Stat(w io.Writer, ew io.Writer, username, foldername, filename string, opts OutputOptions) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
+
+	var row any
+	columns := FolderStatColumns
+	if filename == "" {
+		stat := FolderStat{Folder: folder, Path: joinPath(username, foldername)}
+		for _, file := range folder.GetFiles() {
+			stat.FileCount++
+			stat.Size += file.Size
+			stat.StoredSize += file.StoredSize
+		}
+		row = stat
+	} else {
+		file := folder.GetFile(filename)
+		if file == nil {
+			fmt.Fprintln(ew, ErrNotExists.ToString(filename))
+			return ErrNotExists
+		}
+		row, columns = FileStat{File: file, Path: joinPath(username, foldername, filename)}, FileStatColumns
+	}
+
+	if opts.Format != "" {
+		return s.writeRows(w, ew, opts, columns, []any{row})
+	}
+	for _, column := range columns {
+		fmt.Fprintln(w, strings.TrimRight(column.Name+": "+s.formatValue(column.Value(row), opts), " "))
+	}
+	return Succeed
+}
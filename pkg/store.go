@@ -0,0 +1,505 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Store keeps the users, folders and files of a System. Records are returned
+// without their children: the Folders of a User and the Files of a Folder are
+// empty and listed by ListFolders and ListFiles, sorted by name. A missing
+// record is returned as nil without error. A store keeps copies, so changing a
+// record after Put or Get does not change the stored one.
+//
+// The System writes its changes to the store, a store is never read back but
+// when it is opened. A command run by Run is written as it returns, and a
+// transaction as it commits. A method of System called directly writes each
+// change as it is made, and a method making several, such as Import, as it
+// returns. A write failing leaves the changes to be written by the next one,
+// or by Flush, which returns the error.
+type Store interface {
+	GetUser(username string) (*User, error)
+	PutUser(user *User) error
+	// DeleteUser removes the user with their folders and files.
+	DeleteUser(username string) error
+	ListUsers() ([]*User, error)
+
+	GetFolder(username, foldername string) (*Folder, error)
+	PutFolder(username string, folder *Folder) error
+	// DeleteFolder removes the folder with its files.
+	DeleteFolder(username, foldername string) error
+	ListFolders(username string) ([]*Folder, error)
+
+	GetFile(username, foldername, filename string) (*File, error)
+	PutFile(username, foldername string, file *File) error
+	DeleteFile(username, foldername, filename string) error
+	ListFiles(username, foldername string) ([]*File, error)
+
+	// Blobs are the contents of the files by hash, see BlobStore. They are
+	// read on demand, not when the store is opened.
+	BlobSource
+
+	Close() error
+}
+
+func userRecord(user *User) *User {
+	record := *user
+	record.Folders = make(map[string]*Folder, 0)
+	record.keys = nil
+	return &record
+}
+
+func folderRecord(folder *Folder) *Folder {
+	record := *folder
+	record.Labels = folder.Labels.Clone()
+	record.Files = make(map[string]*File, 0)
+	return &record
+}
+
+// MemoryStore is a Store holding its records in maps, lost when the process
+// exits unless the system is saved as a snapshot.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	users   map[string]*User
+	folders map[string]map[string]*Folder
+	files   map[string]map[string]map[string]*File
+	// blobs are shared with the BlobStore as their data is never modified.
+	blobs map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:   make(map[string]*User, 0),
+		folders: make(map[string]map[string]*Folder, 0),
+		files:   make(map[string]map[string]map[string]*File, 0),
+		blobs:   make(map[string][]byte, 0),
+	}
+}
+
+func (m *MemoryStore) GetUser(username string) (*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if user, ok := m.users[username]; ok {
+		return userRecord(user), nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) PutUser(user *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[user.Name] = userRecord(user)
+	return nil
+}
+
+func (m *MemoryStore) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, username)
+	delete(m.folders, username)
+	delete(m.files, username)
+	return nil
+}
+
+func (m *MemoryStore) ListUsers() ([]*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := make([]*User, 0, len(m.users))
+	for _, name := range sortedKeys(m.users) {
+		users = append(users, userRecord(m.users[name]))
+	}
+	return users, nil
+}
+
+func (m *MemoryStore) GetFolder(username, foldername string) (*Folder, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if folder, ok := m.folders[username][foldername]; ok {
+		return folderRecord(folder), nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) PutFolder(username string, folder *Folder) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.folders[username] == nil {
+		m.folders[username] = make(map[string]*Folder, 0)
+	}
+	m.folders[username][folder.Name] = folderRecord(folder)
+	return nil
+}
+
+func (m *MemoryStore) DeleteFolder(username, foldername string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.folders[username], foldername)
+	delete(m.files[username], foldername)
+	return nil
+}
+
+func (m *MemoryStore) ListFolders(username string) ([]*Folder, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	folders := make([]*Folder, 0, len(m.folders[username]))
+	for _, name := range sortedKeys(m.folders[username]) {
+		folders = append(folders, folderRecord(m.folders[username][name]))
+	}
+	return folders, nil
+}
+
+func (m *MemoryStore) GetFile(username, foldername, filename string) (*File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if file, ok := m.files[username][foldername][filename]; ok {
+		return file.Clone(), nil
+	}
+	return nil, nil
+}
+
+func (m *MemoryStore) PutFile(username, foldername string, file *File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files[username] == nil {
+		m.files[username] = make(map[string]map[string]*File, 0)
+	}
+	if m.files[username][foldername] == nil {
+		m.files[username][foldername] = make(map[string]*File, 0)
+	}
+	m.files[username][foldername][file.Name] = file.Clone()
+	return nil
+}
+
+func (m *MemoryStore) DeleteFile(username, foldername, filename string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.files[username][foldername], filename)
+	return nil
+}
+
+func (m *MemoryStore) ListFiles(username, foldername string) ([]*File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	files := make([]*File, 0, len(m.files[username][foldername]))
+	for _, name := range sortedKeys(m.files[username][foldername]) {
+		files = append(files, m.files[username][foldername][name].Clone())
+	}
+	return files, nil
+}
+
+func (m *MemoryStore) GetBlob(hash string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.blobs[hash], nil
+}
+
+func (m *MemoryStore) PutBlob(hash string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[hash] = data
+	return nil
+}
+
+func (m *MemoryStore) DeleteBlob(hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, hash)
+	return nil
+}
+
+func (m *MemoryStore) ListBlobs() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return sortedKeys(m.blobs), nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// storeKey is the `user`, `user/folder` or `user/folder/file` path of a record
+// to write to the store.
+type storeKey [3]string
+
+func (k storeKey) path() string {
+	return joinPath(k[0], k[1], k[2])
+}
+
+func (k storeKey) depth() int {
+	n := 0
+	for _, part := range k {
+		if part != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// Open to replace the users of the system by the records of store, which the
+// system then writes every committed change to. The records are only read
+// here; the blobs are read on demand.
+func (s *System) Open(store Store) error {
+	users := make(map[string]*User, 0)
+	records, err := store.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range records {
+		folders, err := store.ListFolders(user.Name)
+		if err != nil {
+			return err
+		}
+		for _, folder := range folders {
+			files, err := store.ListFiles(user.Name, folder.Name)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				folder.AddFile(file.Name, file)
+			}
+			folder.fillTimes()
+			user.AddFolder(folder.Name, folder)
+		}
+		users[user.Name] = user
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Blobs.SetSource(store)
+	if err := s.Blobs.Restore(nil, users); err != nil {
+		return err
+	}
+	s.Store = store
+	s.UserTable = users
+	s.restoreSeq()
+	s.Index.Rebuild(users)
+	s.dirty = nil
+	s.version++
+	return nil
+}
+
+// markDirty to remember the records changed by event until the next flush,
+// which is at once outside of a command, transaction or batch.
+func (s *System) markDirty(event Event) {
+	defer s.writeThrough()
+	if s.Store == nil {
+		return
+	}
+	if s.dirty == nil {
+		s.dirty = make(map[storeKey]bool, 0)
+	}
+	switch event.Type {
+	case EventUserRegistered:
+		s.dirty[storeKey{event.UserName}] = true
+	case EventUserModified:
+		// the folders and files are sealed again with the keys of the user,
+		// and the superseded records compacted away
+		s.dirty[storeKey{event.UserName}] = true
+		s.compact = true
+		if user := s.GetUser(event.UserName); user != nil {
+			for name := range user.Folders {
+				s.dirty[storeKey{event.UserName, name}] = true
+			}
+		}
+	case EventFolderCreated, EventFolderDeleted:
+		s.dirty[storeKey{event.UserName, event.FolderName}] = true
+	case EventFolderRenamed:
+		s.dirty[storeKey{event.UserName, event.OldName}] = true
+		s.dirty[storeKey{event.UserName, event.FolderName}] = true
+	case EventFolderModified:
+		key := storeKey{event.UserName, event.FolderName}
+		if _, ok := s.dirty[key]; !ok {
+			s.dirty[key] = false
+		}
+	default:
+		s.dirty[storeKey{event.UserName, event.FolderName, event.FileName}] = true
+	}
+}
+
+// writeThrough to flush the changes of a method of System called directly,
+// see Store. A failed flush keeps them for the next one.
+func (s *System) writeThrough() {
+	if !s.dispatching && !s.batching && s.tx == nil {
+		s.flush()
+	}
+}
+
+// batch to hold back the flushes of the changes of a method making several
+// of them, until the returned func is called. It returns the error of that
+// flush, nil within a command or an outer batch.
+func (s *System) batch() func() error {
+	if s.dispatching || s.batching {
+		return func() error { return nil }
+	}
+	s.batching = true
+	return func() error {
+		s.batching = false
+		return s.flush()
+	}
+}
+
+// batchResponse to batch the changes of a method of System as batch does,
+// the returned func reporting a failed flush in res, as RunArgs does.
+func (s *System) batchResponse(ew io.Writer, res *RespondType) func() {
+	done := s.batch()
+	return func() {
+		if err := done(); err != nil {
+			fmt.Fprintln(ew, ErrIO.ToString("cannot write the store", err.Error()))
+			if *res == Succeed {
+				*res = ErrIO
+			}
+		}
+	}
+}
+
+// Flush to write the changes not written yet to the store, as after a failed
+// write, and return the error of the write.
+func (s *System) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flush()
+}
+
+// flush writes the dirty records, parents first. A folder marked true is
+// rewritten with all its files, as when it was created, renamed or deleted.
+// New blobs are written before the files referring to them, and collected
+// blobs deleted after. When the records are saved in a snapshot while the
+// blobs are kept in a BlobDir, the saved snapshot may still refer to the
+// collected blobs, so Save deletes them. A transaction is flushed by the
+// system it commits to.
+func (s *System) flush() error {
+	if s.tx != nil {
+		return nil
+	}
+	added, removed := s.Blobs.pending()
+	if err := s.Blobs.write(added); err != nil {
+		return err
+	}
+	if s.snapshotted() && !s.Blobs.Embedded() {
+		removed = nil
+	}
+	if s.Store == nil {
+		return s.Blobs.collect(removed)
+	}
+	if len(s.dirty) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	keys := make([]storeKey, 0, len(s.dirty))
+	for key := range s.dirty {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].depth() != keys[j].depth() {
+			return keys[i].depth() < keys[j].depth()
+		}
+		return keys[i].path() < keys[j].path()
+	})
+
+	for _, key := range keys {
+		if err := s.flushKey(key, s.dirty[key]); err != nil {
+			return err
+		}
+		delete(s.dirty, key)
+	}
+	if err := s.Blobs.collect(removed); err != nil {
+		return err
+	}
+	if compacter, ok := s.Store.(interface{ Compact() error }); ok && s.compact {
+		if err := compacter.Compact(); err != nil {
+			return err
+		}
+	}
+	s.compact = false
+	if syncer, ok := s.Store.(interface{ Sync() error }); ok {
+		return syncer.Sync()
+	}
+	return nil
+}
+
+func (s *System) flushKey(key storeKey, tree bool) error {
+	username, foldername, filename := key[0], key[1], key[2]
+	user := s.GetUser(username)
+	var folder *Folder
+	if user != nil && foldername != "" {
+		folder = user.GetFolder(foldername)
+	}
+
+	switch {
+	case foldername == "" && user == nil:
+		return s.Store.DeleteUser(username)
+	case foldername == "":
+		return s.Store.PutUser(user)
+	case filename == "" && folder == nil:
+		return s.Store.DeleteFolder(username, foldername)
+	case filename == "":
+		record, err := sealFolder(user, foldername, folder)
+		if err != nil {
+			return err
+		}
+		if !tree {
+			return s.Store.PutFolder(username, record)
+		}
+		if err := s.Store.DeleteFolder(username, foldername); err != nil {
+			return err
+		}
+		if err := s.Store.PutFolder(username, record); err != nil {
+			return err
+		}
+		for _, name := range sortedKeys(folder.Files) {
+			file, err := sealFile(user, foldername, folder.Files[name])
+			if err != nil {
+				return err
+			}
+			if err := s.Store.PutFile(username, foldername, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if folder != nil && folder.GetFile(filename) != nil {
+		file, err := sealFile(user, foldername, folder.GetFile(filename))
+		if err != nil {
+			return err
+		}
+		return s.Store.PutFile(username, foldername, file)
+	}
+	return s.Store.DeleteFile(username, foldername, filename)
+}
+
+// writeAll to replace the records of the store by the users of the system.
+// The blobs are written and collected by flush, as set up by Restore.
+func (s *System) writeAll() error {
+	if s.Store == nil {
+		return nil
+	}
+	stored, err := s.Store.ListUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range stored {
+		if err := s.Store.DeleteUser(user.Name); err != nil {
+			return err
+		}
+	}
+	s.dirty = make(map[storeKey]bool, 0)
+	for _, user := range s.UserTable {
+		s.dirty[storeKey{user.Name}] = true
+		for _, folder := range user.Folders {
+			s.dirty[storeKey{user.Name, folder.Name}] = true
+		}
+	}
+	return s.flush()
+}
@@ -0,0 +1,32 @@
+package pkg_test
+
+import (
+	"testing"
+
+	"system/pkg"
+	"system/pkg/storetest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) pkg.Store {
+		return pkg.NewMemoryStore()
+	})
+}
+
+func TestDiskStoreConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) pkg.Store {
+		store, err := pkg.OpenDiskStore(t.TempDir() + "/vfs.db")
+		assert.NoError(t, err)
+		return store
+	})
+}
+
+func TestBlobDirConformance(t *testing.T) {
+	storetest.RunBlobs(t, func(t *testing.T) pkg.BlobSource {
+		dir, err := pkg.OpenBlobDir(t.TempDir())
+		assert.NoError(t, err)
+		return dir
+	})
+}
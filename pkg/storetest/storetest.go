@@ -0,0 +1,177 @@
+// Package storetest checks that an implementation of pkg.Store behaves as
+// the System expects, so that a new backend is tested like the built-in ones:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) pkg.Store {
+//			return NewMyStore(t.TempDir())
+//		})
+//	}
+package storetest
+
+import (
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	"system/pkg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// epoch is the creation time of the records put by the checks.
+var epoch = time.Date(2024, 8, 1, 9, 0, 0, 0, time.UTC)
+
+// Run runs the checks every Store implementation must pass against stores
+// made by open, each test opening a new empty one.
+func Run(t *testing.T, open func(t *testing.T) pkg.Store) {
+	t.Run("Users", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+
+		user, err := store.GetUser("user1")
+		assert.NoError(t, err)
+		assert.Nil(t, user)
+		for _, name := range []string{"user2", "user1", "User3"} {
+			assert.NoError(t, store.PutUser(pkg.CreateUser(name)))
+		}
+		user, err = store.GetUser("user1")
+		assert.NoError(t, err)
+		assert.Equal(t, "user1", user.Name)
+		assert.NotNil(t, user.Folders)
+
+		users, err := store.ListUsers()
+		assert.NoError(t, err)
+		var names []string
+		for _, user := range users {
+			names = append(names, user.Name)
+		}
+		assert.Equal(t, []string{"User3", "user1", "user2"}, names)
+
+		assert.NoError(t, store.DeleteUser("user2"))
+		assert.NoError(t, store.DeleteUser("nobody"))
+		users, _ = store.ListUsers()
+		assert.Len(t, users, 2)
+	})
+
+	t.Run("FoldersAndFiles", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+		assert.NoError(t, store.PutUser(pkg.CreateUser("user1")))
+
+		folder := pkg.CreateFolder("docs", "my docs", "user1", epoch)
+		folder.AddTag("work")
+		folder.AddFile("a", pkg.CreateFile("a", "", "docs", "user1", epoch))
+		assert.NoError(t, store.PutFolder("user1", folder))
+		assert.NoError(t, store.PutFolder("user1", pkg.CreateFolder("archive", "", "user1", epoch)))
+		assert.NoError(t, store.PutFolder("user1", pkg.CreateFolder("doc", "", "user1", epoch)))
+
+		got, err := store.GetFolder("user1", "docs")
+		assert.NoError(t, err)
+		assert.Equal(t, "my docs", got.Description)
+		assert.Equal(t, []string{"work"}, got.Tags)
+		assert.True(t, folder.CreatedAt.Equal(got.CreatedAt))
+		assert.Empty(t, got.Files, "children are not stored with their parent")
+		got, err = store.GetFolder("user1", "nothing")
+		assert.NoError(t, err)
+		assert.Nil(t, got)
+
+		folders, err := store.ListFolders("user1")
+		assert.NoError(t, err)
+		var names []string
+		for _, folder := range folders {
+			names = append(names, folder.Name)
+		}
+		assert.Equal(t, []string{"archive", "doc", "docs"}, names)
+		folders, err = store.ListFolders("nobody")
+		assert.NoError(t, err)
+		assert.Empty(t, folders)
+
+		file := pkg.CreateFile("b", "desc", "docs", "user1", epoch)
+		file.SetMeta("k", "v")
+		assert.NoError(t, store.PutFile("user1", "docs", file))
+		assert.NoError(t, store.PutFile("user1", "docs", pkg.CreateFile("a", "", "docs", "user1", epoch)))
+		assert.NoError(t, store.PutFile("user1", "doc", pkg.CreateFile("c", "", "doc", "user1", epoch)))
+
+		gotFile, err := store.GetFile("user1", "docs", "b")
+		assert.NoError(t, err)
+		assert.Equal(t, "desc", gotFile.Description)
+		assert.Equal(t, map[string]string{"k": "v"}, gotFile.Meta)
+		files, err := store.ListFiles("user1", "docs")
+		assert.NoError(t, err)
+		assert.Len(t, files, 2)
+		assert.Equal(t, "a", files[0].Name)
+		assert.Equal(t, "b", files[1].Name)
+
+		assert.NoError(t, store.DeleteFile("user1", "docs", "a"))
+		files, _ = store.ListFiles("user1", "docs")
+		assert.Len(t, files, 1)
+
+		// deleting a folder deletes its files, not those of a folder sharing its prefix
+		assert.NoError(t, store.DeleteFolder("user1", "doc"))
+		gotFile, _ = store.GetFile("user1", "doc", "c")
+		assert.Nil(t, gotFile)
+		files, _ = store.ListFiles("user1", "docs")
+		assert.Len(t, files, 1)
+
+		// deleting a user deletes everything below
+		assert.NoError(t, store.DeleteUser("user1"))
+		folders, _ = store.ListFolders("user1")
+		assert.Empty(t, folders)
+		gotFile, _ = store.GetFile("user1", "docs", "b")
+		assert.Nil(t, gotFile)
+	})
+
+	RunBlobs(t, func(t *testing.T) pkg.BlobSource {
+		return open(t)
+	})
+
+	t.Run("Copies", func(t *testing.T) {
+		store := open(t)
+		defer store.Close()
+
+		file := pkg.CreateFile("a", "before", "docs", "user1", epoch)
+		file.AddTag("x")
+		assert.NoError(t, store.PutFile("user1", "docs", file))
+		file.Description = "after"
+		file.Tags[0] = "y"
+
+		got, _ := store.GetFile("user1", "docs", "a")
+		assert.Equal(t, "before", got.Description)
+		assert.Equal(t, []string{"x"}, got.Tags)
+		got.Tags[0] = "z"
+		got, _ = store.GetFile("user1", "docs", "a")
+		assert.Equal(t, []string{"x"}, got.Tags)
+	})
+}
+
+// RunBlobs runs the checks of the blobs of a Store against any BlobSource,
+// such as a BlobDir, made by open.
+func RunBlobs(t *testing.T, open func(t *testing.T) pkg.BlobSource) {
+	t.Run("Blobs", func(t *testing.T) {
+		store := open(t)
+		if closer, ok := store.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		data, err := store.GetBlob(pkg.HashContent([]byte("b")))
+		assert.NoError(t, err)
+		assert.Nil(t, data)
+		for _, content := range []string{"b", "a", ""} {
+			assert.NoError(t, store.PutBlob(pkg.HashContent([]byte(content)), []byte(content)))
+		}
+		data, err = store.GetBlob(pkg.HashContent([]byte("a")))
+		assert.NoError(t, err)
+		assert.Equal(t, "a", string(data))
+
+		hashes, err := store.ListBlobs()
+		assert.NoError(t, err)
+		assert.Len(t, hashes, 3)
+		assert.True(t, sort.StringsAreSorted(hashes))
+
+		assert.NoError(t, store.DeleteBlob(pkg.HashContent([]byte("a"))))
+		assert.NoError(t, store.DeleteBlob("nothing"))
+		hashes, _ = store.ListBlobs()
+		assert.Len(t, hashes, 2)
+	})
+}
@@ -5,14 +5,68 @@ import (
 	"io"
 	"os"
 	"regexp"
-	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type System struct {
 	UserTable      map[string]*User
 	CharsValidator *regexp.Regexp
+	Index          *Index
+	Commands       *Registry
+	TimeFormat     string
+	Location       *time.Location
+	// UserPolicy, FolderPolicy and FilePolicy are the naming policies of
+	// users, folders and files. A nil policy leaves the names to
+	// CharsValidator, which also checks the tags and metadata keys.
+	UserPolicy   *NamingPolicy
+	FolderPolicy *NamingPolicy
+	FilePolicy   *NamingPolicy
+	// Clock gives the times of the changes, SystemClock unless a test sets
+	// a FakeClock.
+	Clock Clock
+	// Store receives every committed change, see Flush.
+	Store Store
+	// Blobs holds the content of the files.
+	Blobs *BlobStore
+	// Audit records every dispatched command, and every change made by a
+	// direct call of the API, when set.
+	Audit *AuditLog
+	// Actor is who the commands and API calls are made by, as recorded in
+	// the audit log. SetupSystem sets the user running the process.
+	Actor    string
+	Events   *EventBus
+	Webhooks *WebhookDispatcher
+
+	watchMu sync.Mutex
+	watches []func()
+
+	// mu guards the committed state against transactions, see Tx.
+	mu sync.RWMutex
+	// version counts the published changes, for a transaction to detect
+	// that the system changed since it began.
+	version int
+	// dispatching is set while RunArgs runs a command, whose changes are
+	// audited as the command.
+	dispatching bool
+	// batching is set while a method makes several changes, written to the
+	// store as it returns, see batch.
+	batching bool
+	// session is the transaction opened by `begin`. It is read without s.mu
+	// to route the commands, hence atomic.
+	session atomic.Pointer[Tx]
+	// tx is set on the working copy of a transaction.
+	tx *Tx
+	// dirty holds the records changed since the last flush.
+	dirty map[storeKey]bool
+	// compact is set when the superseded records of the store are to be
+	// dropped on flush, as they may hold data since encrypted.
+	compact bool
+	// chunks caches the last decompressed chunk.
+	chunks chunkCache
+	// seq is the last sequence number given to a folder or file.
+	seq uint64
 }
 
 var (
@@ -26,7 +80,23 @@ func SetupSystem() *System {
 		VFSystem = &System{
 			UserTable:      make(map[string]*User, 0),
 			CharsValidator: regexp.MustCompile(`^[a-zA-Z0-9_]+$`),
+			UserPolicy:     DefaultNamingPolicy(),
+			FolderPolicy:   DefaultNamingPolicy(),
+			FilePolicy:     DefaultNamingPolicy(),
+			Index:          NewIndex(),
+			Store:          NewMemoryStore(),
+			Blobs:          NewBlobStore(),
+			Events:         NewEventBus(),
+			Webhooks:       NewWebhookDispatcher(),
+			Commands:       DefaultCommands(),
+			TimeFormat:     DefaultTimeFormat,
+			Clock:          SystemClock,
+			Actor:          processUser(),
 		}
+		// the dead letters follow the clock of the system, even once replaced
+		VFSystem.Webhooks.Clock = clockFunc(VFSystem.now)
+		VFSystem.Index.Content = VFSystem.indexContent
+		VFSystem.Events.OnEvent(VFSystem.Webhooks.Deliver)
 	})
 	return VFSystem
 }
@@ -38,138 +108,84 @@ func (s *System) Reset() {
 }
 
 // Execute to call APIs by command
-func (s *System) Execute(input string) {
-	parts := strings.Fields(input)
-	if len(parts) == 0 {
-		return
-	}
-
-	command := parts[0]
-	switch command {
-	case "register":
-		if len(parts) != 2 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
-
-		username := parts[1]
-		s.Register(os.Stdout, os.Stderr, username)
-
-	case "create-folder":
-		if len(parts) < 3 || len(parts) > 4 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
-
-		username, foldername := parts[1], parts[2]
-		desc := ""
-		if len(parts) == 4 {
-			desc = parts[3]
-		}
-
-		s.CreateFolder(os.Stdout, os.Stderr, username, foldername, desc)
-
-	case "delete-folder":
-		if len(parts) != 3 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
-
-		username, foldername := parts[1], parts[2]
-
-		s.DeleteFolder(os.Stdout, os.Stderr, username, foldername)
-
-	case "list-folders":
-		if len(parts) < 2 || len(parts) > 4 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
-
-		username := parts[1]
-		sortBy, order, msg := ParseArgs(parts[2:])
-		if msg != "" {
-			fmt.Fprintln(os.Stderr, msg)
-			return
-		}
-
-		s.ListFolders(os.Stdout, os.Stderr, username, sortBy, order)
-
-	case "rename-folder":
-		if len(parts) != 4 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
-		username, folderFrom, folderTo := parts[1], parts[2], parts[3]
-
-		s.RenameFolder(os.Stdout, os.Stderr, username, folderFrom, folderTo)
-
-	case "create-file":
-		if len(parts) < 4 || len(parts) > 5 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
-		username, foldername, filename := parts[1], parts[2], parts[3]
-		desc := ""
-		if len(parts) == 5 {
-			desc = parts[4]
-		}
-
-		s.CreateFile(os.Stdout, os.Stderr, username, foldername, filename, desc)
+func (s *System) Execute(input string) RespondType {
+	return s.Run(os.Stdout, os.Stderr, input)
+}
 
-	case "delete-file":
-		if len(parts) != 4 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
-		username, foldername, filename := parts[1], parts[2], parts[3]
+// Run to dispatch a command line through the command registry, writing to w and ew
+func (s *System) Run(w io.Writer, ew io.Writer, input string) RespondType {
+	return s.RunArgs(w, ew, SplitArgs(input))
+}
 
-		s.DeleteFile(os.Stdout, os.Stderr, username, foldername, filename)
+// RunArgs to dispatch an already split command line through the command registry
+func (s *System) RunArgs(w io.Writer, ew io.Writer, parts []string) RespondType {
+	if len(parts) == 0 {
+		return Succeed
+	}
 
-	case "list-files":
-		if len(parts) < 3 || len(parts) > 5 {
-			fmt.Fprintln(os.Stderr, ErrArgsLength.ToString())
-			return
-		}
+	if tx := s.session.Load(); tx != nil && !sessionCommands[parts[0]] {
+		return tx.RunArgs(w, ew, parts)
+	}
 
-		username, foldername := parts[1], parts[2]
-		sortBy, order, msg := ParseArgs(parts[3:])
-		if msg != "" {
-			fmt.Fprintln(os.Stderr, msg)
-			return
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cmd := s.Commands.Lookup(parts[0])
+	args := parts[1:]
+	s.dispatching = true
+	res := s.dispatch(w, ew, cmd, args)
+	s.dispatching = false
+	if err := s.flush(); err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot write the store", err.Error()))
+		if res == Succeed {
+			res = ErrIO
 		}
+	}
+	s.audit(ew, cmd, parts[0], args, res)
+	return res
+}
 
-		s.ListFiles(os.Stdout, os.Stderr, username, foldername, sortBy, order)
-
-	case "help":
-		GetManInfo()
-
-	case "exit":
-		fmt.Println("See you.")
-		os.Exit(0)
-	default:
-		fmt.Fprintln(os.Stderr, ErrUnknownCmd.ToString())
+func (s *System) dispatch(w io.Writer, ew io.Writer, cmd Command, args []string) RespondType {
+	if cmd == nil {
+		fmt.Fprintln(ew, ErrUnknownCmd.ToString())
+		return ErrUnknownCmd
 	}
+	if !CheckArgs(cmd, args) {
+		fmt.Fprintln(ew, ErrArgsLength.ToString(cmd.Usage()))
+		return ErrArgsLength
+	}
+	args = s.normalizeArgs(cmd, args)
+	if username := s.lockedUser(cmd, args); username != "" {
+		fmt.Fprintln(ew, ErrLocked.ToString(username))
+		return ErrLocked
+	}
+	return cmd.Run(s, w, ew, args)
 }
 
 // Register a new user
-func (s *System) Register(w io.Writer, ew io.Writer, username string) {
-	if !s.CharsValidator.MatchString(username) {
-		fmt.Fprintln(ew, ErrInvalidChars.ToString(username))
-		return
+func (s *System) Register(w io.Writer, ew io.Writer, username string) RespondType {
+	username, res := s.validateName(ew, s.UserPolicy, username)
+	if res != Succeed {
+		return res
 	}
 	if user := s.GetUser(username); user != nil {
 		fmt.Fprintln(ew, ErrAlreadyExists.ToString(username))
-		return
+		return ErrAlreadyExists
 	}
 
 	s.UserTable[username] = CreateUser(username)
+	s.emit(EventUserRegistered, username, "", "")
 	fmt.Fprintf(w, "Add %s successfully.\n", username)
+	return Succeed
 }
 
 // GetUser to find and return user if exists
 func (s *System) GetUser(username string) *User {
 	for name := range s.UserTable {
 		if name == username {
+			if s.tx != nil {
+				return s.tx.own(username)
+			}
 			return s.UserTable[username]
 		}
 	}
@@ -177,202 +193,458 @@ func (s *System) GetUser(username string) *User {
 }
 
 // CreateFolder to create a folder for a user, description is optional
-func (s *System) CreateFolder(w io.Writer, ew io.Writer, username, foldername, desc string) {
+func (s *System) CreateFolder(w io.Writer, ew io.Writer, username, foldername, desc string) RespondType {
 
 	user := s.GetUser(username)
 	if user == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(username))
-		return
+		return ErrNotExists
 	}
-	if !s.CharsValidator.MatchString(foldername) {
-		fmt.Fprintln(ew, ErrInvalidChars.ToString(foldername))
-		return
+	foldername, res := s.validateName(ew, s.FolderPolicy, foldername)
+	if res != Succeed {
+		return res
 	}
 	if folder := user.GetFolder(foldername); folder != nil {
 		fmt.Fprintln(ew, ErrAlreadyExists.ToString(foldername))
-		return
+		return ErrAlreadyExists
 	}
 
-	folder := CreateFolder(foldername, desc, username)
+	folder := CreateFolder(foldername, desc, username, s.now())
+	folder.Seq = s.nextSeq()
 	user.AddFolder(foldername, folder)
+	s.Index.AddFolder(folder)
+	s.emit(EventFolderCreated, username, foldername, "")
 
 	fmt.Fprintf(w, "Create %s successfully.\n", foldername)
+	return Succeed
 }
 
 // DeleteFolder to delete a folder from a user if exists
-func (s *System) DeleteFolder(w io.Writer, ew io.Writer, username, foldername string) {
+func (s *System) DeleteFolder(w io.Writer, ew io.Writer, username, foldername string) RespondType {
 
 	user := s.GetUser(username)
 	if user == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(username))
-		return
+		return ErrNotExists
 	}
-	if folder := user.GetFolder(foldername); folder == nil {
+	folder := user.GetFolder(foldername)
+	if folder == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
-		return
+		return ErrNotExists
 	}
 
+	for _, file := range folder.Files {
+		s.releaseContent(file)
+	}
 	delete(user.Folders, foldername)
+	s.Index.RemoveFolder(username, foldername)
+	s.emit(EventFolderDeleted, username, foldername, "")
 
 	fmt.Fprintf(w, "Delete %v successfully.\n", foldername)
+	return Succeed
 }
 
 // ListFolders to list all the folders of a user if exist
-func (s *System) ListFolders(w io.Writer, ew io.Writer, username, sortBy, order string) {
-	user := s.GetUser(username)
-	if user == nil {
+func (s *System) ListFolders(w io.Writer, ew io.Writer, username string, opts ListOptions) RespondType {
+	if s.GetUser(username) == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(username))
-		return
+		return ErrNotExists
 	}
-	if len(user.Folders) == 0 {
+	folders, next, res := s.QueryFolders(username, opts)
+	if res != Succeed {
+		fmt.Fprintln(ew, res.ToString())
+		return res
+	}
+	if len(folders) == 0 && opts.Format == "" {
 		fmt.Fprintln(ew, WarnNoFolders.ToString(username))
-		return
+		return WarnNoFolders
 	}
 
-	folders := user.GetFolders()
-
-	switch sortBy {
-	case "name":
-		sort.Slice(folders, func(i, j int) bool {
-			if order == "asc" {
-				return folders[i].Name < folders[j].Name
-			}
-			return folders[i].Name > folders[j].Name
-		})
-
-	case "created":
-		sort.Slice(folders, func(i, j int) bool {
-			if order == "asc" {
-				return folders[i].CreatedAt.Before(folders[j].CreatedAt)
-			}
-			return folders[i].CreatedAt.After(folders[j].CreatedAt)
-		})
+	if opts.Format != "" {
+		rows := make([]any, len(folders))
+		for i, folder := range folders {
+			rows[i] = folder
+		}
+		if res := s.writeRows(w, ew, opts.OutputOptions, FolderColumns, rows); res != Succeed {
+			return res
+		}
+	} else {
+		layout, loc := s.timeSettings(opts.OutputOptions)
+		for _, folder := range folders {
+			fmt.Fprintln(w, folder.Format(layout, loc))
+		}
 	}
 
-	for _, folder := range folders {
-		fmt.Fprintln(w, folder.ToString())
-	}
+	printNextPage(ew, next)
+	return Succeed
 }
 
 // RenameFolder to rename a folder of a user
-func (s *System) RenameFolder(w io.Writer, ew io.Writer, username, folderFrom, folderTo string) {
+func (s *System) RenameFolder(w io.Writer, ew io.Writer, username, folderFrom, folderTo string) RespondType {
 	user := s.GetUser(username)
 	if user == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(username))
-		return
+		return ErrNotExists
 	}
 	folder := user.GetFolder(folderFrom)
 	if folder == nil {
 		fmt.Fprintln(ew, WarnNoFolders.ToString(folderFrom))
-		return
+		return WarnNoFolders
+	}
+	// the new name is looked up as stored, lest another folder be replaced;
+	// renaming a folder to its own name finds the folder itself
+	folderTo, res := s.validateName(ew, s.FolderPolicy, folderTo)
+	if res != Succeed {
+		return res
 	}
 	folder2 := user.GetFolder(folderTo)
 	if folder2 != nil {
 		fmt.Fprintln(ew, ErrAlreadyExists.ToString(folder2.Name))
-		return
-	}
-	if !s.CharsValidator.MatchString(folderTo) {
-		fmt.Fprintln(ew, ErrInvalidChars.ToString(folderTo))
-		return
+		return ErrAlreadyExists
 	}
 
 	folder.SetName(folderTo)
 	user.Folders[folderTo] = folder
 	delete(user.Folders, folderFrom)
 
+	// the files are written again with the folder, see markDirty
+	for _, file := range folder.Files {
+		file.FolderName = folderTo
+	}
+	s.Index.RenameFolder(folder, folderFrom)
+	s.publish(Event{Type: EventFolderRenamed, Time: s.now(), UserName: username, FolderName: folderTo, OldName: folderFrom})
+
 	fmt.Fprintf(w, "Rename %s to %s successfully.\n", folderFrom, folderTo)
+	return Succeed
 }
 
 // CreateFile to create a file under a folder of a user
-func (s *System) CreateFile(w io.Writer, ew io.Writer, username, foldername, filename, desc string) {
+func (s *System) CreateFile(w io.Writer, ew io.Writer, username, foldername, filename, desc string) RespondType {
 	user := s.GetUser(username)
 	if user == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(username))
-		return
+		return ErrNotExists
 	}
 	folder := user.GetFolder(foldername)
 	if folder == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
-		return
+		return ErrNotExists
 	}
-	if !s.CharsValidator.MatchString(filename) {
-		fmt.Fprintln(ew, ErrInvalidChars.ToString(filename))
-		return
+	filename, res := s.validateName(ew, s.FilePolicy, filename)
+	if res != Succeed {
+		return res
 	}
 	file := folder.GetFile(filename)
 	if file != nil {
 		fmt.Fprintln(ew, ErrAlreadyExists.ToString(filename))
-		return
+		return ErrAlreadyExists
 	}
 
-	folder.AddFile(filename, CreateFile(
-		filename, desc, foldername, username,
-	))
+	file = CreateFile(filename, desc, foldername, username, s.now())
+	file.Seq = s.nextSeq()
+	file.Compression = folder.Compression
+	folder.AddFile(filename, file)
+	s.Index.AddFile(folder, file)
+	s.emit(EventFileCreated, username, foldername, filename)
 
 	fmt.Fprintf(w, "Create %s in %s/%s successfully.\n", filename, username, foldername)
+	return Succeed
 }
 
 // DeleteFile to delete file under a folder from a user if exist
-func (s *System) DeleteFile(w io.Writer, ew io.Writer, username, foldername, filename string) {
+func (s *System) DeleteFile(w io.Writer, ew io.Writer, username, foldername, filename string) RespondType {
 	user := s.GetUser(username)
 	if user == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(username))
-		return
+		return ErrNotExists
 	}
 	folder := user.GetFolder(foldername)
 	if folder == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
-		return
+		return ErrNotExists
 	}
 	file := folder.GetFile(filename)
 	if file == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(filename))
-		return
+		return ErrNotExists
 	}
 
+	s.releaseContent(file)
 	delete(folder.Files, filename)
+	s.Index.RemoveFile(username, foldername, filename)
+	s.emit(EventFileDeleted, username, foldername, filename)
 
 	fmt.Fprintf(w, "Delete %s in %s/%s successfully.\n", filename, username, foldername)
+	return Succeed
 }
 
 // ListFiles to list all files from a folder of a user
-func (s *System) ListFiles(w io.Writer, ew io.Writer, username, foldername, sortBy, order string) {
+func (s *System) ListFiles(w io.Writer, ew io.Writer, username, foldername string, opts ListOptions) RespondType {
 	user := s.GetUser(username)
 	if user == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(username))
-		return
+		return ErrNotExists
+	}
+	if user.GetFolder(foldername) == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
+	files, next, res := s.QueryFiles(username, foldername, opts)
+	if res != Succeed {
+		fmt.Fprintln(ew, res.ToString())
+		return res
+	}
+	if len(files) == 0 && opts.Format == "" {
+		fmt.Fprintln(ew, WarnEmptyFolder.ToString())
+		return WarnEmptyFolder
+	}
+
+	if opts.Format != "" {
+		rows := make([]any, len(files))
+		for i, file := range files {
+			rows[i] = file
+		}
+		if res := s.writeRows(w, ew, opts.OutputOptions, FileColumns, rows); res != Succeed {
+			return res
+		}
+	} else {
+		layout, loc := s.timeSettings(opts.OutputOptions)
+		for _, file := range files {
+			fmt.Fprintln(w, file.Format(layout, loc))
+		}
+	}
+
+	printNextPage(ew, next)
+	return Succeed
+}
+
+// printNextPage to tell how to fetch the next page of a listing, on ew so
+// that the rows on w stay machine-readable.
+func printNextPage(ew io.Writer, next string) {
+	if next != "" {
+		fmt.Fprintf(ew, "Next page: --cursor %s\n", next)
+	}
+}
+
+// SetDescription to change the description of a folder, or of a file when filename is given
+func (s *System) SetDescription(w io.Writer, ew io.Writer, username, foldername, filename, desc string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
 	}
 	folder := user.GetFolder(foldername)
 	if folder == nil {
 		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
-		return
+		return ErrNotExists
 	}
-	if len(folder.Files) == 0 {
-		fmt.Fprintln(ew, WarnEmptyFolder.ToString())
-		return
+
+	if filename == "" {
+		folder.SetDescription(desc)
+		s.Index.AddFolder(folder)
+		s.emit(EventFolderModified, username, foldername, "")
+
+		fmt.Fprintf(w, "Update description of %s/%s successfully.\n", username, foldername)
+		return Succeed
+	}
+
+	file := folder.GetFile(filename)
+	if file == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(filename))
+		return ErrNotExists
 	}
+	file.SetDescription(desc)
+	s.Index.AddFile(folder, file)
+	s.emit(EventFileModified, username, foldername, filename)
 
-	files := folder.GetFiles()
+	fmt.Fprintf(w, "Update description of %s/%s/%s successfully.\n", username, foldername, filename)
+	return Succeed
+}
 
-	switch sortBy {
-	case "name":
-		sort.Slice(files, func(i, j int) bool {
-			if order == "asc" {
-				return files[i].Name < files[j].Name
-			}
-			return files[i].Name > files[j].Name
-		})
+// Touch to set the modification and access times of a folder of a user to
+// now, or those of a file when filename is given, creating it if needed
+func (s *System) Touch(w io.Writer, ew io.Writer, username, foldername, filename string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
 
-	case "created":
-		sort.Slice(files, func(i, j int) bool {
-			if order == "asc" {
-				return files[i].CreatedAt.Before(files[j].CreatedAt)
-			}
-			return files[i].CreatedAt.After(files[j].CreatedAt)
-		})
+	now := s.now()
+	if filename == "" {
+		folder.AccessedAt = now
+		s.publish(Event{Type: EventFolderModified, Time: now, UserName: username, FolderName: foldername})
+
+		fmt.Fprintf(w, "Touch %s/%s successfully.\n", username, foldername)
+		return Succeed
+	}
+
+	file := folder.GetFile(filename)
+	if file == nil {
+		return s.CreateFile(w, ew, username, foldername, filename, "")
+	}
+	file.AccessedAt = now
+	s.publish(Event{Type: EventFileModified, Time: now, UserName: username, FolderName: foldername, FileName: filename})
+
+	fmt.Fprintf(w, "Touch %s/%s/%s successfully.\n", username, foldername, filename)
+	return Succeed
+}
+
+// Search to list the folders and files of a user matching the query, best match first
+func (s *System) Search(w io.Writer, ew io.Writer, username string, query []string, opts OutputOptions) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
 	}
 
-	for _, file := range files {
-		fmt.Fprintln(w, file.ToString())
+	results := s.Index.Search(username, query)
+	if len(results) == 0 && opts.Format == "" {
+		fmt.Fprintln(ew, WarnNoMatches.ToString())
+		return WarnNoMatches
+	}
+
+	if opts.Format != "" {
+		rows := make([]any, len(results))
+		for i, r := range results {
+			rows[i] = r
+		}
+		return s.writeRows(w, ew, opts, SearchColumns, rows)
+	}
+
+	for _, r := range results {
+		fmt.Fprintf(w, "%s %.3f\n", r.Path(), r.Score)
+	}
+
+	return Succeed
+}
+
+// GetLabels to find the tags and metadata of a `folder` or `folder/file` path of a user
+func (s *System) GetLabels(ew io.Writer, username, path string) (*Labels, RespondType) {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return nil, ErrNotExists
+	}
+	foldername, filename := SplitPath(path)
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return nil, ErrNotExists
+	}
+	if filename == "" {
+		return &folder.Labels, Succeed
+	}
+	file := folder.GetFile(filename)
+	if file == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(filename))
+		return nil, ErrNotExists
+	}
+	return &file.Labels, Succeed
+}
+
+// Tag to add tags to a folder or file of a user
+func (s *System) Tag(w io.Writer, ew io.Writer, username, path string, tags []string) RespondType {
+	labels, res := s.GetLabels(ew, username, path)
+	if labels == nil {
+		return res
+	}
+	for _, tag := range tags {
+		if !s.CharsValidator.MatchString(tag) {
+			fmt.Fprintln(ew, ErrInvalidChars.ToString(tag))
+			return ErrInvalidChars
+		}
+	}
+
+	for _, tag := range tags {
+		labels.AddTag(tag)
+	}
+	s.emitLabels(username, path)
+
+	fmt.Fprintf(w, "Tag %s/%s successfully.\n", username, path)
+	return Succeed
+}
+
+// Untag to remove tags from a folder or file of a user
+func (s *System) Untag(w io.Writer, ew io.Writer, username, path string, tags []string) RespondType {
+	labels, res := s.GetLabels(ew, username, path)
+	if labels == nil {
+		return res
+	}
+	for _, tag := range tags {
+		if !labels.HasTag(tag) {
+			fmt.Fprintln(ew, ErrNotExists.ToString(tag))
+			return ErrNotExists
+		}
+	}
+
+	for _, tag := range tags {
+		labels.RemoveTag(tag)
+	}
+	s.emitLabels(username, path)
+
+	fmt.Fprintf(w, "Untag %s/%s successfully.\n", username, path)
+	return Succeed
+}
+
+// SetMeta to set a metadata value on a folder or file of a user
+func (s *System) SetMeta(w io.Writer, ew io.Writer, username, path, key, value string) RespondType {
+	labels, res := s.GetLabels(ew, username, path)
+	if labels == nil {
+		return res
+	}
+	if !s.CharsValidator.MatchString(key) {
+		fmt.Fprintln(ew, ErrInvalidChars.ToString(key))
+		return ErrInvalidChars
+	}
+
+	labels.SetMeta(key, value)
+	s.emitLabels(username, path)
+
+	fmt.Fprintf(w, "Set %s of %s/%s successfully.\n", key, username, path)
+	return Succeed
+}
+
+// GetMeta to print a metadata value of a folder or file, or all of them when key is empty
+func (s *System) GetMeta(w io.Writer, ew io.Writer, username, path, key string, opts OutputOptions) RespondType {
+	labels, res := s.GetLabels(ew, username, path)
+	if labels == nil {
+		return res
+	}
+
+	if key == "" && opts.Format != "" {
+		var rows []any
+		for _, k := range labels.MetaKeys() {
+			rows = append(rows, [2]string{k, labels.Meta[k]})
+		}
+		return s.writeRows(w, ew, opts, MetaColumns, rows)
+	}
+	if key == "" {
+		for _, k := range labels.MetaKeys() {
+			fmt.Fprintf(w, "%s=%s\n", k, labels.Meta[k])
+		}
+		return Succeed
+	}
+
+	value, ok := labels.GetMeta(key)
+	if !ok {
+		fmt.Fprintln(ew, ErrNotExists.ToString(key))
+		return ErrNotExists
+	}
+	fmt.Fprintln(w, value)
+
+	return Succeed
+}
+
+func (s *System) writeRows(w io.Writer, ew io.Writer, opts OutputOptions, columns []Column, rows []any) RespondType {
+	if err := s.WriteRows(w, opts, columns, rows); err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString(err.Error()))
+		return ErrIO
 	}
+	return Succeed
 }
@@ -0,0 +1,54 @@
+//go:build linux
+
+package pkg
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getTermios(fd uintptr) (*syscall.Termios, error) {
+	var termios syscall.Termios
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCGETS, uintptr(unsafe.Pointer(&termios))); errno != 0 {
+		return nil, errno
+	}
+	return &termios, nil
+}
+
+func setTermios(fd uintptr, termios *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TCSETS, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// IsTerminal reports whether fd is a terminal.
+func IsTerminal(fd uintptr) bool {
+	_, err := getTermios(fd)
+	return err == nil
+}
+
+// MakeRaw to put the terminal fd into raw mode, returning a function which
+// restores the previous mode.
+func MakeRaw(fd uintptr) (func(), error) {
+	old, err := getTermios(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := *old
+	raw.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP | syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	raw.Oflag &^= syscall.OPOST
+	raw.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cflag &^= syscall.CSIZE | syscall.PARENB
+	raw.Cflag |= syscall.CS8
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return func() {
+		setTermios(fd, old)
+	}, nil
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package pkg
+
+import "errors"
+
+// IsTerminal reports whether fd is a terminal. Raw mode is only supported on
+// Linux, so other systems always fall back to line-buffered input.
+func IsTerminal(fd uintptr) bool {
+	return false
+}
+
+// MakeRaw is only supported on Linux.
+func MakeRaw(fd uintptr) (func(), error) {
+	return nil, errors.New("raw mode is not supported on this system")
+}
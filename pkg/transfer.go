@@ -0,0 +1,349 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ManifestName is the sidecar file holding what the host file system cannot
+// keep of an exported folder: descriptions, creation times, tags and metadata.
+const ManifestName = ".vfs-manifest.json"
+
+// ManifestEntry is the record of a folder or file in a Manifest.
+type ManifestEntry struct {
+	Description string `json:",omitempty"`
+	CreatedAt   time.Time
+	Tags        []string          `json:",omitempty"`
+	Meta        map[string]string `json:",omitempty"`
+}
+
+// Manifest describes an exported folder and its files, keyed by file name.
+type Manifest struct {
+	Version int
+	Folder  ManifestEntry
+	Files   map[string]ManifestEntry
+}
+
+func manifestEntry(desc string, createdAt time.Time, labels Labels) ManifestEntry {
+	return ManifestEntry{Description: desc, CreatedAt: createdAt, Tags: labels.Tags, Meta: labels.Meta}
+}
+
+func (e ManifestEntry) labels() Labels {
+	return Labels{Tags: e.Tags, Meta: e.Meta}
+}
+
+// SanitizeName to replace every character rejected by the validator with `_`.
+// See NamingPolicy.Sanitize for the names following a policy.
+func (s *System) SanitizeName(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		if s.CharsValidator.MatchString(string(r)) && !strings.ContainsRune(Separators, r) {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
+
+// importName to map a host name to a name following policy, reporting on ew
+// why it is skipped otherwise.
+func (s *System) importName(ew io.Writer, policy *NamingPolicy, hostpath, name string, sanitize bool) (string, bool) {
+	valid, err := s.validName(policy, name)
+	if err == nil {
+		return valid, true
+	}
+	if sanitize {
+		sanitized := s.SanitizeName(name)
+		if policy != nil {
+			sanitized = policy.Sanitize(name)
+		}
+		if valid, err := s.validName(policy, sanitized); err == nil {
+			return valid, true
+		}
+	}
+	fmt.Fprintf(ew, "Warning: Skip %s, the name breaks the %s rule: %s.\n", hostpath, err.Rule, err.Reason)
+	return "", false
+}
+
+// Import to create a folder for every directory of hostpath, and a file for
+// every regular file in them. Files at the top of hostpath go to a folder
+// named after hostpath itself. Invalid names are sanitized when sanitize is
+// set, skipped otherwise; nested directories, links and existing entries are
+// skipped. Each skip is reported on ew.
+func (s *System) Import(w io.Writer, ew io.Writer, username, hostpath string, sanitize bool) (res RespondType) {
+	defer s.batchResponse(ew, &res)()
+	if s.GetUser(username) == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	entries, err := os.ReadDir(hostpath)
+	if err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot read "+hostpath, err.Error()))
+		return ErrIO
+	}
+
+	folders, files := 0, 0
+	var topFiles []os.DirEntry
+	for _, entry := range entries {
+		switch {
+		case entry.IsDir():
+			n, ok := s.importDir(ew, username, filepath.Join(hostpath, entry.Name()), entry.Name(), sanitize)
+			if ok {
+				folders++
+			}
+			files += n
+		case entry.Type().IsRegular():
+			topFiles = append(topFiles, entry)
+		default:
+			fmt.Fprintf(ew, "Warning: Skip %s, only directories and regular files are imported.\n", filepath.Join(hostpath, entry.Name()))
+		}
+	}
+
+	if len(topFiles) > 0 {
+		abs, err := filepath.Abs(hostpath)
+		if err != nil {
+			abs = hostpath
+		}
+		n, ok := s.importFiles(ew, username, hostpath, filepath.Base(abs), topFiles, sanitize)
+		if ok {
+			folders++
+		}
+		files += n
+	}
+
+	fmt.Fprintf(w, "Import %d folders and %d files from %s successfully.\n", folders, files, hostpath)
+	return Succeed
+}
+
+func (s *System) importDir(ew io.Writer, username, dir, name string, sanitize bool) (int, bool) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(ew, "Warning: Skip %s, %v.\n", dir, err)
+		return 0, false
+	}
+	var files []os.DirEntry
+	for _, entry := range entries {
+		switch {
+		case entry.Name() == ManifestName:
+		case entry.IsDir():
+			fmt.Fprintf(ew, "Warning: Skip %s, nested directories are not supported.\n", filepath.Join(dir, entry.Name()))
+		case entry.Type().IsRegular():
+			files = append(files, entry)
+		default:
+			fmt.Fprintf(ew, "Warning: Skip %s, only directories and regular files are imported.\n", filepath.Join(dir, entry.Name()))
+		}
+	}
+	return s.importFiles(ew, username, dir, name, files, sanitize)
+}
+
+// importFiles to create the folder name from dir, if needed, with the given
+// files. It returns the number of created files and whether the folder was created.
+func (s *System) importFiles(ew io.Writer, username, dir, name string, entries []os.DirEntry, sanitize bool) (int, bool) {
+	foldername, ok := s.importName(ew, s.FolderPolicy, dir, name, sanitize)
+	if !ok {
+		return 0, false
+	}
+
+	var manifest Manifest
+	if data, err := os.ReadFile(filepath.Join(dir, ManifestName)); err == nil {
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			fmt.Fprintf(ew, "Warning: Ignore %s, %v.\n", filepath.Join(dir, ManifestName), err)
+		}
+	}
+
+	user := s.GetUser(username)
+	folder := user.GetFolder(foldername)
+	created := folder == nil
+	if created {
+		if res := s.CreateFolder(io.Discard, ew, username, foldername, manifest.Folder.Description); res != Succeed {
+			fmt.Fprintf(ew, "Warning: Skip %s.\n", dir)
+			return 0, false
+		}
+		folder = user.GetFolder(foldername)
+		folder.Labels = manifest.Folder.labels()
+	}
+
+	count := 0
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		filename, ok := s.importName(ew, s.FilePolicy, path, entry.Name(), sanitize)
+		if !ok {
+			continue
+		}
+		if folder.GetFile(filename) != nil {
+			fmt.Fprintf(ew, "Warning: Skip %s, %s/%s already exists.\n", path, foldername, filename)
+			continue
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			fmt.Fprintf(ew, "Warning: Skip %s, %v.\n", path, err)
+			continue
+		}
+
+		meta, hasMeta := manifest.Files[entry.Name()]
+		if res := s.CreateFile(io.Discard, ew, username, foldername, filename, meta.Description); res != Succeed {
+			src.Close()
+			fmt.Fprintf(ew, "Warning: Skip %s.\n", path)
+			continue
+		}
+		file := folder.GetFile(filename)
+		_, err = s.appendContent(file, src)
+		src.Close()
+		if err != nil {
+			fmt.Fprintf(ew, "Warning: Import %s partially, %v.\n", path, err)
+		}
+		if info, err := entry.Info(); err == nil {
+			file.CreatedAt, file.ModifiedAt, file.AccessedAt = hostTimes(info)
+		}
+		if hasMeta {
+			if !meta.CreatedAt.IsZero() {
+				file.CreatedAt = meta.CreatedAt
+			}
+			file.Labels = meta.labels()
+		}
+		count++
+	}
+
+	// the folder was modified by its new files, it takes the times of dir last
+	if created {
+		if info, err := os.Stat(dir); err == nil {
+			folder.CreatedAt, folder.ModifiedAt, folder.AccessedAt = hostTimes(info)
+		}
+		if !manifest.Folder.CreatedAt.IsZero() {
+			folder.CreatedAt = manifest.Folder.CreatedAt
+		}
+	}
+	return count, created
+}
+
+// hostTimes returns the creation, modification and access times of an
+// imported host file: its modification time stands for its creation time,
+// which the host does not keep.
+func hostTimes(info os.FileInfo) (time.Time, time.Time, time.Time) {
+	accessed, ok := accessTime(info)
+	if !ok {
+		accessed = info.ModTime()
+	}
+	return info.ModTime(), info.ModTime(), accessed
+}
+
+// Export to write a folder of a user to hostpath/foldername: one file per file
+// with its content, modification and access times, and a sidecar manifest
+// keeping the descriptions, creation times, tags and metadata.
+func (s *System) Export(w io.Writer, ew io.Writer, username, foldername, hostpath string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	folder := user.GetFolder(foldername)
+	if folder == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
+
+	if !localName(folder.Name) {
+		fmt.Fprintln(ew, ErrInvalidName.ToString(fmt.Sprintf("%s cannot name a host directory", folder.Name)))
+		return ErrInvalidName
+	}
+	if err := s.exportFolder(folder, filepath.Join(hostpath, folder.Name)); err != nil {
+		fmt.Fprintln(ew, ErrIO.ToString("cannot export "+foldername, err.Error()))
+		return ErrIO
+	}
+
+	fmt.Fprintf(w, "Export %s/%s to %s successfully.\n", username, foldername, filepath.Join(hostpath, folder.Name))
+	return Succeed
+}
+
+// localName reports whether name is an entry of a host directory, rather than
+// a path out of it. The naming policies reject such names, but older stores
+// may hold some.
+func localName(name string) bool {
+	return filepath.IsLocal(name) && !strings.ContainsAny(name, Separators)
+}
+
+// exportFolder to write folder to dir. The names clashing with an entry of
+// dir are found before anything is written, and what was written is removed
+// on failure.
+func (s *System) exportFolder(folder *Folder, dir string) (err error) {
+	files := folder.GetFiles()
+	names := []string{ManifestName}
+	for _, file := range files {
+		if !localName(file.Name) {
+			return fmt.Errorf("%s cannot name a host file", file.Name)
+		}
+		names = append(names, file.Name)
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	_, err = os.Stat(dir)
+	created := errors.Is(err, os.ErrNotExist)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	var written []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, path := range written {
+			os.Remove(path)
+		}
+		if created {
+			os.Remove(dir)
+		}
+	}()
+
+	manifest := Manifest{
+		Version: SnapshotVersion,
+		Folder:  manifestEntry(folder.Description, folder.CreatedAt, folder.Labels),
+		Files:   make(map[string]ManifestEntry, len(folder.Files)),
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.Name)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists", path)
+		}
+		if err != nil {
+			return err
+		}
+		written = append(written, path)
+		if _, err := io.Copy(f, s.contentSection(file, 0, file.Size)); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Chtimes(path, file.AccessedAt, file.ModifiedAt); err != nil {
+			return err
+		}
+		manifest.Files[file.Name] = manifestEntry(file.Description, file.CreatedAt, file.Labels)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, ManifestName), data, 0644); err != nil {
+		written = append(written, filepath.Join(dir, ManifestName))
+		return err
+	}
+	return os.Chtimes(dir, folder.AccessedAt, folder.ModifiedAt)
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TreeOptions holds how `tree` renders the folders and files of a user.
+type TreeOptions struct {
+	// Depth is the number of levels shown below the user, 0 for all of them.
+	Depth     int
+	ShowDesc  bool
+	ShowDates bool
+	// ListOptions holds the sort and time flags, shared with the list commands.
+	ListOptions
+}
+
+// ParseTreeArgs to parse [--depth n] [--show-desc] [--show-dates] and the sort
+// and time flags of the list commands, see ParseListArgs.
+func ParseTreeArgs(args []string, now time.Time) (TreeOptions, string) {
+	var opts TreeOptions
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--depth":
+			if i+1 >= len(args) {
+				return TreeOptions{}, ErrInvalidFlag.ToString()
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 1 {
+				return TreeOptions{}, ErrInvalidFlag.ToString()
+			}
+			opts.Depth = n
+			i++
+		case "--show-desc":
+			opts.ShowDesc = true
+		case "--show-dates":
+			opts.ShowDates = true
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+
+	list, msg := ParseListArgs(rest, now)
+	if msg != "" {
+		return TreeOptions{}, msg
+	}
+	// a tree shows everything, in text
+	if list.Format != "" || list.Limit != 0 || list.Offset != 0 || list.Cursor != "" || len(list.Tags) > 0 ||
+		!list.CreatedSince.IsZero() || !list.CreatedBefore.IsZero() {
+		return TreeOptions{}, ErrInvalidFlag.ToString()
+	}
+	opts.ListOptions = list
+	return opts, ""
+}
+
+// fileSortBy returns the keys of spec which apply to files, as files are
+// sorted like their folders.
+func fileSortBy(spec string) string {
+	var parts []string
+	for _, part := range strings.Split(spec, ",") {
+		field, _, _ := strings.Cut(part, ":")
+		if SortKeys[field].Files {
+			parts = append(parts, part)
+		}
+	}
+	if len(parts) == 0 {
+		return "name"
+	}
+	return strings.Join(parts, ",")
+}
+
+// Tree to print the folders and files of a user as a tree, with the number of
+// folders and files of the user and of each folder
+func (s *System) Tree(w io.Writer, ew io.Writer, username string, opts TreeOptions) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	folders, _, res := s.QueryFolders(username, opts.ListOptions)
+	if res != Succeed {
+		fmt.Fprintln(ew, res.ToString())
+		return res
+	}
+
+	fileOpts := opts.ListOptions
+	fileOpts.SortBy = fileSortBy(fileOpts.SortBy)
+	files := make([][]*File, len(folders))
+	total := 0
+	for i, folder := range folders {
+		if files[i], _, res = s.QueryFiles(username, folder.Name, fileOpts); res != Succeed {
+			fmt.Fprintln(ew, res.ToString())
+			return res
+		}
+		total += len(files[i])
+	}
+
+	fmt.Fprintf(w, "%s (%d folders, %d files)\n", username, len(folders), total)
+	for i, folder := range folders {
+		last := i == len(folders)-1
+		fmt.Fprintln(w, treeBranch("", last)+s.treeFolder(folder, len(files[i]), opts))
+		if opts.Depth == 1 {
+			continue
+		}
+
+		indent := "│   "
+		if last {
+			indent = "    "
+		}
+		for j, file := range files[i] {
+			fmt.Fprintln(w, treeBranch(indent, j == len(files[i])-1)+s.treeFile(file, opts))
+		}
+	}
+	return Succeed
+}
+
+func treeBranch(indent string, last bool) string {
+	if last {
+		return indent + "└── "
+	}
+	return indent + "├── "
+}
+
+func (s *System) treeFolder(folder *Folder, files int, opts TreeOptions) string {
+	return fmt.Sprintf("%s (%d files)", folder.Name, files) + s.treeDetails(folder.Description, folder.CreatedAt, folder.ModifiedAt, opts)
+}
+
+func (s *System) treeFile(file *File, opts TreeOptions) string {
+	return file.Name + s.treeDetails(file.Description, file.CreatedAt, file.ModifiedAt, opts)
+}
+
+// treeDetails returns what --show-desc and --show-dates add after a name.
+func (s *System) treeDetails(desc string, created, modified time.Time, opts TreeOptions) string {
+	details := ""
+	if opts.ShowDesc && desc != "" {
+		details += ": " + desc
+	}
+	if opts.ShowDates {
+		details += fmt.Sprintf(" [created %s, modified %s]", s.FormatTime(created, opts.OutputOptions), s.FormatTime(modified, opts.OutputOptions))
+	}
+	return details
+}
@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrTxConflict is returned when a transaction commits after another writer
+// changed the system.
+var ErrTxConflict = errors.New("the system was changed since the transaction began")
+
+// Tx is a transaction. Its methods, those of System, work on a private copy
+// of the users, so readers of the system never see the staged changes, and
+// commit applies all of them at once. A user is copied when the transaction
+// first uses them, and the changes to the index and the blobs are staged
+// apart from those of the system. Its events and audit entries are held
+// back until then, so subscribers, webhooks and the audit log only see
+// committed changes.
+type Tx struct {
+	*System
+	base    *System
+	version int
+	// owned holds the users copied by the transaction, see own.
+	owned   map[string]bool
+	events  []Event
+	entries []AuditEntry
+	// aborted is set when a command of the transaction failed in a script.
+	aborted bool
+}
+
+// sessionCommands run against the system itself while a transaction opened
+// by `begin` is pending; every other command is staged in the transaction.
+var sessionCommands = map[string]bool{
+	"begin":    true,
+	"commit":   true,
+	"rollback": true,
+	"watch":    true,
+	"webhooks": true,
+	"audit":    true,
+	"help":     true,
+	"exit":     true,
+}
+
+// begin to start a transaction on the committed state. The caller holds s.mu.
+func (s *System) begin() *Tx {
+	tx := &Tx{base: s, version: s.version, owned: make(map[string]bool, 0)}
+	users := make(map[string]*User, len(s.UserTable))
+	for name, user := range s.UserTable {
+		users[name] = user
+	}
+	tx.System = &System{
+		UserTable:      users,
+		CharsValidator: s.CharsValidator,
+		UserPolicy:     s.UserPolicy,
+		FolderPolicy:   s.FolderPolicy,
+		FilePolicy:     s.FilePolicy,
+		Index:          s.Index.Stage(s.mu.RLocker()),
+		Blobs:          s.Blobs.Stage(),
+		Commands:       s.Commands,
+		TimeFormat:     s.TimeFormat,
+		Location:       s.Location,
+		Clock:          s.Clock,
+		Audit:          s.Audit,
+		Actor:          s.Actor,
+		Events:         s.Events,
+		Webhooks:       s.Webhooks,
+		tx:             tx,
+		seq:            s.seq,
+	}
+	tx.Index.Content = tx.indexContent
+	return tx
+}
+
+// own returns the user of username, copied from the committed state when the
+// transaction first uses them, so that its changes stay private.
+func (tx *Tx) own(username string) *User {
+	if tx.owned[username] {
+		return tx.UserTable[username]
+	}
+	tx.base.mu.RLock()
+	user := tx.UserTable[username].Clone()
+	tx.base.mu.RUnlock()
+	tx.UserTable[username] = user
+	tx.owned[username] = true
+	return user
+}
+
+// commit to apply the changes of tx to the system it began on, unless that
+// was changed meanwhile. The caller holds s.mu.
+func (tx *Tx) commit(ew io.Writer) error {
+	s := tx.base
+	if s.version != tx.version {
+		return ErrTxConflict
+	}
+	for name, user := range tx.UserTable {
+		if tx.owned[name] || s.UserTable[name] == nil {
+			s.UserTable[name] = user
+		}
+	}
+	s.Index.Apply(tx.Index)
+	s.Blobs.Apply(tx.Blobs)
+	s.seq = tx.seq
+	for _, entry := range tx.entries {
+		s.record(ew, entry)
+	}
+	for _, event := range tx.events {
+		s.publish(event)
+	}
+	return nil
+}
+
+// Tx to run fn in a transaction. The changes fn makes through tx are applied
+// atomically when it returns nil and discarded when it returns an error;
+// meanwhile readers keep seeing the committed state. When the system was
+// changed by another writer first, nothing is applied and ErrTxConflict is
+// returned, so that fn can be run again. tx must not be used once Tx returns.
+// The warnings of the commit, such as the audit log failing, are written to ew.
+func (s *System) Tx(ew io.Writer, fn func(tx *Tx) error) error {
+	s.mu.RLock()
+	tx := s.begin()
+	s.mu.RUnlock()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done := s.batch()
+	err := tx.commit(ew)
+	if ferr := done(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// InTx reports whether a transaction opened by `begin` is pending.
+func (s *System) InTx() bool {
+	return s.session.Load() != nil
+}
+
+// Begin to open a transaction staging the following commands until Commit or Rollback
+func (s *System) Begin(w io.Writer, ew io.Writer) RespondType {
+	if s.session.Load() != nil {
+		fmt.Fprintln(ew, ErrTransaction.ToString("a transaction is already open"))
+		return ErrTransaction
+	}
+	s.session.Store(s.begin())
+	fmt.Fprintln(w, "Begin transaction successfully.")
+	return Succeed
+}
+
+// Commit to apply the commands staged since Begin
+func (s *System) Commit(w io.Writer, ew io.Writer) (res RespondType) {
+	tx := s.session.Swap(nil)
+	if tx == nil {
+		fmt.Fprintln(ew, ErrTransaction.ToString("no transaction is open"))
+		return ErrTransaction
+	}
+	if tx.aborted {
+		fmt.Fprintln(ew, ErrTransaction.ToString("a command of the transaction failed, it is rolled back"))
+		return ErrTransaction
+	}
+	defer s.batchResponse(ew, &res)()
+	if err := tx.commit(ew); err != nil {
+		fmt.Fprintln(ew, ErrTransaction.ToString(err.Error()))
+		return ErrTransaction
+	}
+	fmt.Fprintf(w, "Commit %d changes successfully.\n", len(tx.events))
+	return Succeed
+}
+
+// Rollback to discard the commands staged since Begin
+func (s *System) Rollback(w io.Writer, ew io.Writer) RespondType {
+	tx := s.session.Swap(nil)
+	if tx == nil {
+		fmt.Fprintln(ew, ErrTransaction.ToString("no transaction is open"))
+		return ErrTransaction
+	}
+	fmt.Fprintf(w, "Rollback %d changes successfully.\n", len(tx.events))
+	return Succeed
+}
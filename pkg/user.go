@@ -3,6 +3,10 @@ package pkg
 type User struct {
 	Name    string
 	Folders map[string]*Folder
+	// Keyring is set once the user is encrypted, see EncryptUser.
+	Keyring *Keyring `json:",omitempty"`
+	// keys are the data keys of the keyring, loaded by Unlock for the session.
+	keys [][]byte
 }
 
 func CreateUser(username string) *User {
@@ -12,6 +16,27 @@ func CreateUser(username string) *User {
 	}
 }
 
+// Clone returns a deep copy of the user and its folders.
+func (u *User) Clone() *User {
+	clone := CreateUser(u.Name)
+	clone.Keyring, clone.keys = u.Keyring, u.keys
+	for name, folder := range u.Folders {
+		clone.Folders[name] = folder.Clone()
+	}
+	return clone
+}
+
+// Encrypted reports whether the folders and files of the user are encrypted.
+func (u *User) Encrypted() bool {
+	return u.Keyring != nil
+}
+
+// Locked reports whether the user is encrypted and their keys not loaded, so
+// their folders and files are still sealed.
+func (u *User) Locked() bool {
+	return u.Keyring != nil && u.keys == nil
+}
+
 func (u *User) GetFolder(foldername string) *Folder {
 	for f := range u.Folders {
 		if f == foldername {
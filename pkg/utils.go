@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 )
 
 var (
@@ -45,76 +48,158 @@ func GetManInfo() {
 	}
 }
 
-func ParseArgs(args []string) (sortBy, order, msg string) {
-	sortBy = "name"
-	order = "asc"
-
-	if len(args) == 0 {
-		return sortBy, order, ""
-	}
-
-	for _, a := range args {
-		switch a {
-		case "--sort-name":
-			sortBy = "name"
-		case "--sort-created":
-			sortBy = "created"
-		case "asc":
-			order = "asc"
-		case "desc":
-			order = "desc"
+// SplitArgs to split a command line on whitespace, keeping double-quoted parts (e.g. "quarterly report") as one argument.
+// Inside quotes, \" and \\ stand for a literal quote and backslash.
+func SplitArgs(input string) []string {
+	var args []string
+	var arg strings.Builder
+	inQuote, inArg, escaped := false, false, false
+
+	for _, r := range input {
+		switch {
+		case escaped:
+			if r != '"' && r != '\\' {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(r)
+			escaped = false
+		case r == '\\' && inQuote:
+			escaped = true
+		case r == '"':
+			inQuote = !inQuote
+			inArg = true
+		case unicode.IsSpace(r) && !inQuote:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
 		default:
-			return "", "", ErrInvalidFlag.ToString()
+			arg.WriteRune(r)
+			inArg = true
 		}
 	}
+	if inArg {
+		args = append(args, arg.String())
+	}
 
-	return sortBy, order, ""
+	return args
 }
 
-func GetHelpInfo() string {
-	return `
-Virtual File System(1)                              User Commands                              Virtual File System(1)
+// ListOptions holds the sorting, filtering, pagination and output options of the list commands.
+type ListOptions struct {
+	// SortBy is a comma-separated list of sort keys, see ParseSortKeys.
+	SortBy     string
+	Order      string
+	Natural    bool
+	IgnoreCase bool
 
+	Tags          []string
+	CreatedSince  time.Time
+	CreatedBefore time.Time
 
-NAME
-       Virtual File System - a CLI file system.
+	Limit  int
+	Offset int
+	Cursor string
 
-SYNOPSIS
-       vfs [-h | --help] [command] [options]
-
-DESCRIPTION
-       This is a pure CLI file system written in Go. The system is used to deal with three types of management: User,
-       Folder, and File.
-
-COMMANDS
-       register [username]
-              Register a new user.
-
-       create-folder [username] [foldername] [description]
-              Create a folder for the specified user.
-
-       delete-folder [username] [foldername]
-              Delete the specified folder for the user.
+	OutputOptions
+}
 
-       list-folders [username] [--sort-name|--sort-created] [asc|desc]
-              List all the folders for the user.
+func ParseArgs(args []string) (sortBy, order, msg string) {
+	// the time filters, relative to now, are dropped
+	opts, msg := ParseListArgs(args, time.Time{})
+	if msg != "" {
+		return "", "", msg
+	}
+	return opts.SortBy, opts.Order, ""
+}
 
-       rename-folder [username] [foldername] [new-folder-name]
-              Rename the folder.
+// ParseListArgs to parse the sort, filter, pagination and output flags of the
+// list commands. Ages such as `7d` are taken back from now.
+func ParseListArgs(args []string, now time.Time) (ListOptions, string) {
+	opts := ListOptions{SortBy: "name", Order: "asc"}
 
-       create-file [username] [foldername] [filename] [description]?
-              Create file from a folder for the user.
+	for i := 0; i < len(args); i++ {
+		ok, last, msg := parseOutputFlag(&opts.OutputOptions, args, i)
+		if msg != "" {
+			return ListOptions{}, msg
+		}
+		if ok {
+			i = last
+			continue
+		}
 
-       delete-file [username] [foldername] [filename]
-              Delete file from a folder for the user.
+		switch args[i] {
+		case "--sort-name":
+			opts.SortBy = "name"
+		case "--sort-created":
+			opts.SortBy = "created"
+		case "--sort-modified":
+			opts.SortBy = "modified"
+		case "asc":
+			opts.Order = "asc"
+		case "desc":
+			opts.Order = "desc"
+		case "--natural":
+			opts.Natural = true
+		case "--ignore-case":
+			opts.IgnoreCase = true
+		case "--sort", "--tag", "--limit", "--offset", "--cursor", "--created-since", "--created-before":
+			if i+1 >= len(args) {
+				return ListOptions{}, ErrInvalidFlag.ToString()
+			}
+			if !parseListFlag(&opts, args[i], args[i+1], now) {
+				return ListOptions{}, ErrInvalidFlag.ToString()
+			}
+			i++
+		default:
+			return ListOptions{}, ErrInvalidFlag.ToString()
+		}
+	}
 
-       list-files [username] [foldername] [--sort-name|--sort-created] [asc|desc]
-              List all files under the folder for the user.
+	if _, ok := ParseSortKeys(opts.SortBy, opts.Order); !ok {
+		return ListOptions{}, ErrInvalidFlag.ToString()
+	}
+	return opts, ""
+}
 
-OPTIONS
-       -h, --help
-              Show help options.
+func parseListFlag(opts *ListOptions, flag, value string, now time.Time) bool {
+	switch flag {
+	case "--sort":
+		opts.SortBy = value
+	case "--tag":
+		opts.Tags = append(opts.Tags, value)
+	case "--limit", "--offset":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return false
+		}
+		if flag == "--limit" {
+			opts.Limit = n
+		} else {
+			opts.Offset = n
+		}
+	case "--cursor":
+		if _, ok := decodeCursor(value); !ok {
+			return false
+		}
+		opts.Cursor = value
+	case "--created-since", "--created-before":
+		t, ok := ParseSince(value, now)
+		if !ok {
+			return false
+		}
+		if flag == "--created-since" {
+			opts.CreatedSince = t
+		} else {
+			opts.CreatedBefore = t
+		}
+	}
+	return true
+}
 
-Virtual File System 1.0                              August 2024                               Virtual File System(1)
-`
+// SplitPath to split a `folder` or `folder/file` path into its folder and file names.
+func SplitPath(path string) (foldername, filename string) {
+	foldername, filename, _ = strings.Cut(path, "/")
+	return foldername, filename
 }
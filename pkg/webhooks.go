@@ -0,0 +1,442 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// errHookRemoved cancels the deliveries of a removed webhook.
+	errHookRemoved = errors.New("webhook removed")
+	// ErrNotDelivered is the error of the dead letters of the events left
+	// when Shutdown gives up.
+	ErrNotDelivered = errors.New("not delivered before shutdown")
+)
+
+// Webhook POSTs the events of a user, or of one of their folders, to URL.
+// The folder of a webhook follows its renames.
+type Webhook struct {
+	ID         int
+	URL        string
+	Secret     string `json:",omitempty"`
+	UserName   string
+	FolderName string `json:",omitempty"`
+	// Sealed is the secret of a webhook of an encrypted user, sealed with
+	// their key until they are unlocked.
+	Sealed []byte `json:",omitempty"`
+}
+
+func (h *Webhook) filter() EventFilter {
+	return EventFilter{UserName: h.UserName, FolderName: h.FolderName}
+}
+
+// DeadLetter is an event which could not be delivered to a webhook.
+type DeadLetter struct {
+	WebhookID int
+	URL       string
+	Event     Event
+	Attempts  int
+	LastError string
+	FailedAt  time.Time
+}
+
+// WebhookPayload is the JSON body POSTed to a webhook.
+type WebhookPayload struct {
+	Event
+	Path string `json:"path"`
+}
+
+// Signature returns the value of the X-VFS-Signature header of body: the
+// hex HMAC-SHA256 of body keyed by secret, prefixed by `sha256=`.
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher delivers the events of the system to the registered
+// webhooks. Each webhook has a queue drained by its own goroutine, so that it
+// receives its events in order. A delivery is retried with exponential
+// backoff (BaseDelay, 2*BaseDelay, ... up to MaxDelay), holding back the next
+// events of the webhook; after MaxAttempts failures the event is kept in the
+// dead letters. Removing a webhook drops its events, and Shutdown keeps those
+// not delivered in time as dead letters.
+type WebhookDispatcher struct {
+	Client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Clock tells when a delivery failed, see DeadLetter.
+	Clock Clock
+
+	mu          sync.Mutex
+	hooks       []*Webhook
+	deadLetters []DeadLetter
+	nextID      int
+	queues      map[int]*hookQueue
+	wg          sync.WaitGroup
+}
+
+// hookQueue holds the events waiting for the worker of a webhook. ctx is
+// cancelled when the webhook is removed or the dispatcher shut down.
+type hookQueue struct {
+	hook    Webhook
+	events  []Event
+	running bool
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+}
+
+func NewWebhookDispatcher() *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 5,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    30 * time.Second,
+		Clock:       SystemClock,
+		nextID:      1,
+		queues:      map[int]*hookQueue{},
+	}
+}
+
+// Add to register hook, assigning its ID.
+func (d *WebhookDispatcher) Add(hook *Webhook) *Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	hook.ID = d.nextID
+	d.nextID++
+	d.hooks = append(d.hooks, hook)
+	return hook
+}
+
+// Remove to unregister the webhook with id, reporting whether it existed.
+func (d *WebhookDispatcher) Remove(id int) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, hook := range d.hooks {
+		if hook.ID == id {
+			d.hooks = append(d.hooks[:i], d.hooks[i+1:]...)
+			if queue := d.queues[id]; queue != nil {
+				queue.events = nil
+				queue.cancel(errHookRemoved)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Hooks returns the registered webhooks.
+func (d *WebhookDispatcher) Hooks() []*Webhook {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Webhook(nil), d.hooks...)
+}
+
+// DeadLetters returns the events which could not be delivered, oldest first.
+func (d *WebhookDispatcher) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DeadLetter(nil), d.deadLetters...)
+}
+
+// Restore to replace the webhooks and dead letters, as loaded from a snapshot.
+func (d *WebhookDispatcher) Restore(hooks []*Webhook, deadLetters []DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hooks, d.deadLetters, d.nextID = hooks, deadLetters, 1
+	for _, hook := range hooks {
+		if hook.ID >= d.nextID {
+			d.nextID = hook.ID + 1
+		}
+	}
+}
+
+// openSecrets to decrypt the sealed secrets of the webhooks of username with keys.
+func (d *WebhookDispatcher) openSecrets(username string, keys [][]byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, hook := range d.hooks {
+		if hook.UserName != username || hook.Sealed == nil {
+			continue
+		}
+		secret, err := openData(keys, hook.Sealed, webhookAAD(username, hook.ID))
+		if err != nil {
+			return fmt.Errorf("cannot decrypt webhook %d: %w", hook.ID, err)
+		}
+		hook.Secret, hook.Sealed = string(secret), nil
+	}
+	return nil
+}
+
+// Deliver to queue event for every matching webhook, starting the worker of
+// the webhook when it is idle. A renamed folder renames the folder of its
+// webhooks first.
+func (d *WebhookDispatcher) Deliver(event Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, hook := range d.hooks {
+		if event.Type == EventFolderRenamed && hook.UserName == event.UserName && hook.FolderName == event.OldName {
+			hook.FolderName = event.FolderName
+		}
+		if !hook.filter().Match(event) {
+			continue
+		}
+		queue := d.queues[hook.ID]
+		if queue == nil {
+			queue = &hookQueue{}
+			queue.ctx, queue.cancel = context.WithCancelCause(context.Background())
+			d.queues[hook.ID] = queue
+		}
+		queue.hook = *hook
+		queue.events = append(queue.events, event)
+		if !queue.running {
+			queue.running = true
+			d.wg.Add(1)
+			go d.work(hook.ID, queue)
+		}
+	}
+}
+
+// work delivers the queued events of a webhook one by one, until the queue
+// is empty or cancelled. The events left by Shutdown are dead letters.
+func (d *WebhookDispatcher) work(id int, queue *hookQueue) {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		if len(queue.events) == 0 || queue.ctx.Err() != nil {
+			for _, event := range queue.events {
+				d.deadLetter(queue.hook, event, 0, context.Cause(queue.ctx))
+			}
+			queue.events, queue.running = nil, false
+			if d.queues[id] == queue {
+				delete(d.queues, id)
+			}
+			d.mu.Unlock()
+			queue.cancel(nil)
+			return
+		}
+		hook, event := queue.hook, queue.events[0]
+		queue.events = queue.events[1:]
+		d.mu.Unlock()
+
+		d.deliver(queue.ctx, hook, event)
+	}
+}
+
+// Wait for the pending deliveries, including their retries.
+func (d *WebhookDispatcher) Wait() {
+	d.wg.Wait()
+}
+
+// Shutdown to wait for the pending deliveries until ctx is done, then cancel
+// them: the events not delivered are kept as dead letters with
+// ErrNotDelivered. It returns the error of ctx when it gave up.
+func (d *WebhookDispatcher) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	d.mu.Lock()
+	for _, queue := range d.queues {
+		queue.cancel(ErrNotDelivered)
+	}
+	d.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
+
+// deliver to post event to hook, retrying until it succeeds, MaxAttempts
+// fail or ctx is cancelled. An event not delivered is a dead letter, unless
+// the webhook was removed. A webhook whose secret is sealed is not signed,
+// its events are dead letters until the user is unlocked.
+func (d *WebhookDispatcher) deliver(ctx context.Context, hook Webhook, event Event) {
+	body, err := json.Marshal(WebhookPayload{Event: event, Path: event.Path()})
+	if err != nil {
+		return
+	}
+	if hook.Sealed != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		d.deadLetter(hook, event, 0, fmt.Errorf("%w: %s", ErrLockedUser, hook.UserName))
+		return
+	}
+
+	delay := d.BaseDelay
+	attempt := 0
+	for {
+		attempt++
+		if err = d.post(ctx, hook, event, body); err == nil {
+			return
+		}
+		if attempt >= d.MaxAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if delay *= 2; delay > d.MaxDelay {
+			delay = d.MaxDelay
+		}
+	}
+	if ctx.Err() != nil {
+		err = context.Cause(ctx)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadLetter(hook, event, attempt, err)
+}
+
+// deadLetter to keep event as not delivered to hook, unless it was removed.
+// The caller holds d.mu.
+func (d *WebhookDispatcher) deadLetter(hook Webhook, event Event, attempts int, err error) {
+	if errors.Is(err, errHookRemoved) {
+		return
+	}
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		WebhookID: hook.ID,
+		URL:       hook.URL,
+		Event:     event,
+		Attempts:  attempts,
+		LastError: err.Error(),
+		FailedAt:  d.Clock.Now(),
+	})
+}
+
+func (d *WebhookDispatcher) post(ctx context.Context, hook Webhook, event Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-VFS-Event", string(event.Type))
+	req.Header.Set("X-VFS-Webhook", strconv.Itoa(hook.ID))
+	req.Header.Set("X-VFS-Signature", Signature(hook.Secret, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// AddWebhook to register a webhook for the events of a user, or of one of
+// their folders when foldername is given. An empty secret is generated and
+// shown once; a given one is never printed.
+func (s *System) AddWebhook(w io.Writer, ew io.Writer, username, foldername, rawURL, secret string) RespondType {
+	user := s.GetUser(username)
+	if user == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(username))
+		return ErrNotExists
+	}
+	if foldername != "" && user.GetFolder(foldername) == nil {
+		fmt.Fprintln(ew, ErrNotExists.ToString(foldername))
+		return ErrNotExists
+	}
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fmt.Fprintln(ew, ErrInvalidURL.ToString(rawURL))
+		return ErrInvalidURL
+	}
+	generated := secret == ""
+	if generated {
+		key := make([]byte, 16)
+		if _, err := rand.Read(key); err != nil {
+			fmt.Fprintln(ew, ErrIO.ToString("cannot generate a secret", err.Error()))
+			return ErrIO
+		}
+		secret = hex.EncodeToString(key)
+	}
+
+	hook := s.Webhooks.Add(&Webhook{URL: rawURL, Secret: secret, UserName: username, FolderName: foldername})
+	fmt.Fprintf(w, "Add webhook %d for %s successfully.\n", hook.ID, joinPath(username, foldername))
+	if generated {
+		// the receiver has no other way to learn a generated secret; it is
+		// shown this once and never listed.
+		fmt.Fprintf(w, "Generated secret: %s\n", secret)
+	}
+	return Succeed
+}
+
+// RemoveWebhook to unregister a webhook by its id
+func (s *System) RemoveWebhook(w io.Writer, ew io.Writer, id string) RespondType {
+	n, err := strconv.Atoi(id)
+	if err != nil || !s.Webhooks.Remove(n) {
+		fmt.Fprintln(ew, ErrNotExists.ToString("webhook "+id))
+		return ErrNotExists
+	}
+	fmt.Fprintf(w, "Remove webhook %s successfully.\n", id)
+	return Succeed
+}
+
+// WebhookColumns are the fields of a webhook. The secret is never listed.
+var WebhookColumns = []Column{
+	{"id", func(row any) any { return row.(*Webhook).ID }},
+	{"user", func(row any) any { return row.(*Webhook).UserName }},
+	{"folder", func(row any) any { return row.(*Webhook).FolderName }},
+	{"url", func(row any) any { return row.(*Webhook).URL }},
+}
+
+// DeadLetterColumns are the fields of a dead letter.
+var DeadLetterColumns = []Column{
+	{"failed_at", func(row any) any { return row.(DeadLetter).FailedAt }},
+	{"webhook", func(row any) any { return row.(DeadLetter).WebhookID }},
+	{"url", func(row any) any { return row.(DeadLetter).URL }},
+	{"event", func(row any) any { return string(row.(DeadLetter).Event.Type) }},
+	{"path", func(row any) any { return row.(DeadLetter).Event.Path() }},
+	{"attempts", func(row any) any { return row.(DeadLetter).Attempts }},
+	{"error", func(row any) any { return row.(DeadLetter).LastError }},
+}
+
+// ListWebhooks to print the webhooks, or the dead letters when dead is set
+func (s *System) ListWebhooks(w io.Writer, ew io.Writer, dead bool, opts OutputOptions) RespondType {
+	var rows []any
+	columns := WebhookColumns
+	if dead {
+		columns = DeadLetterColumns
+		for _, letter := range s.Webhooks.DeadLetters() {
+			rows = append(rows, letter)
+		}
+	} else {
+		for _, hook := range s.Webhooks.Hooks() {
+			rows = append(rows, hook)
+		}
+	}
+
+	if len(rows) == 0 && opts.Format == "" {
+		fmt.Fprintln(ew, WarnNoMatches.ToString())
+		return WarnNoMatches
+	}
+	if opts.Format == "" {
+		opts.Format = "table"
+	}
+	return s.writeRows(w, ew, opts, columns, rows)
+}